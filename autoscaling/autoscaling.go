@@ -533,16 +533,25 @@ func SaveAutoScalingMetricConfig(autoScalingGroupName string, metricConfig halib
 
 // AliasToIP resolve autoscaling instance private ip address
 func AliasToIP(alias string) (string, error) {
-	value, err := db.DB.Get([]byte(fmt.Sprintf("ag-%s", alias)), nil)
+	instanceData, err := AliasToInstanceData(alias)
 	if err != nil {
 		return "", err
 	}
+	return instanceData.IP, nil
+}
+
+// AliasToInstanceData return instance data of alias
+func AliasToInstanceData(alias string) (halib.InstanceData, error) {
 	var instanceData halib.InstanceData
+	value, err := db.DB.Get([]byte(fmt.Sprintf("ag-%s", alias)), nil)
+	if err != nil {
+		return instanceData, err
+	}
 	dec := gob.NewDecoder(bytes.NewReader(value))
 	if err := dec.Decode(&instanceData); err != nil {
-		return "", err
+		return instanceData, err
 	}
-	return instanceData.IP, nil
+	return instanceData, nil
 }
 
 // GetAssignedInstance return ip assigned instance
@@ -573,16 +582,16 @@ func GetAssignedInstance(autoScalingGroupName string) (string, error) {
 	return "", nil
 }
 
-// JoinAutoScalingGroup register request to auto scaling bastion
-func JoinAutoScalingGroup(client *NodeAWSClient, endpoint string) (halib.MetricConfig, error) {
+// JoinAutoScalingGroup register request to auto scaling bastion. returns metric config and alias of this node
+func JoinAutoScalingGroup(client *NodeAWSClient, endpoint string) (halib.MetricConfig, string, error) {
 	instanceID, ip, err := client.GetInstanceMetadata()
 	if err != nil {
-		return halib.MetricConfig{}, err
+		return halib.MetricConfig{}, "", err
 	}
 
 	autoScalingGroupName, err := client.GetAutoScalingGroupName(instanceID)
 	if err != nil {
-		return halib.MetricConfig{}, err
+		return halib.MetricConfig{}, "", err
 	}
 
 	req := halib.AutoScalingInstanceRegisterRequest{
@@ -594,30 +603,30 @@ func JoinAutoScalingGroup(client *NodeAWSClient, endpoint string) (halib.MetricC
 
 	data, err := json.Marshal(req)
 	if err != nil {
-		return halib.MetricConfig{}, err
+		return halib.MetricConfig{}, "", err
 	}
 
 	resp, err := util.RequestToAutoScalingInstanceAPI(endpoint, "register", data)
 	if err != nil {
-		return halib.MetricConfig{}, fmt.Errorf("failed to api request: %s", err.Error())
+		return halib.MetricConfig{}, "", fmt.Errorf("failed to api request: %s", err.Error())
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return halib.MetricConfig{}, fmt.Errorf("status code is %d", resp.StatusCode)
+		return halib.MetricConfig{}, "", fmt.Errorf("status code is %d", resp.StatusCode)
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	defer resp.Body.Close()
 	if err != nil {
-		return halib.MetricConfig{}, err
+		return halib.MetricConfig{}, "", err
 	}
 
 	var r halib.AutoScalingInstanceRegisterResponse
 	if err := json.Unmarshal(body, &r); err != nil {
-		return halib.MetricConfig{}, err
+		return halib.MetricConfig{}, "", err
 	}
 
-	return r.InstanceData.MetricConfig, nil
+	return r.InstanceData.MetricConfig, r.Alias, nil
 }
 
 // LeaveAutoScalingGroup deregister request to auto scaling bastion
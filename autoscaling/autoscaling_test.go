@@ -890,12 +890,14 @@ func TestJoinAutoScalingGroup1(t *testing.T) {
 				SvcAutoScaling: &awsmock.MockAutoScalingClient{},
 			}
 
-			actual, err := JoinAutoScalingGroup(client, endpoint)
+			actual, alias, err := JoinAutoScalingGroup(client, endpoint)
 
 			if c.isNormalTest {
 				assert.Nil(t, err)
+				assert.Equal(t, "dummy-prod-ag-1", alias)
 			} else {
 				assert.NotNil(t, err)
+				assert.Equal(t, "", alias)
 			}
 			assert.Equal(t, c.expected, actual)
 		})
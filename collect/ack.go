@@ -0,0 +1,220 @@
+package collect
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/db"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+	"github.com/syndtr/goleveldb/leveldb"
+	leveldbUtil "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var (
+	// MetricAckLeaseSeconds is seconds until leased metrics are returned again if not acked
+	MetricAckLeaseSeconds int64 = halib.DefaultMetricAckLeaseSeconds
+)
+
+// metricLease is saved as `l-<batch id>`
+type metricLease struct {
+	ExpireAt int64
+	Keys     []string
+	// Counts is number of MetricsData returned from each key.
+	// SaveMetrics may append MetricsData to same key after leased
+	Counts []int
+}
+
+// GetCollectedMetricsWithLease returns collected metrics forwarded by all sinks with max `limit`, without deleting them.
+// returned metrics are leased with batch id until AckCollectedMetrics called.
+// when lease expired, metrics are returned again by following call
+func GetCollectedMetricsWithLease(now time.Time, limit int) ([]halib.MetricsData, string, error) {
+	/*
+		limit > 0 works fine. (otherwise, means unlimited)
+	*/
+	log := util.HappoAgentLogger()
+	var collectedMetricsData []halib.MetricsData
+
+	transaction, err := db.DB.OpenTransaction()
+	if err != nil {
+		return nil, "", err
+	}
+
+	// collect leased keys, and retire expired leases
+	leasedKeys, expiredLeaseKeys := getLeasedMetricKeys(transaction, now)
+	for _, key := range expiredLeaseKeys {
+		transaction.Delete(key, nil)
+	}
+
+	cursors := getSinkCursors(transaction)
+	var undecodableKeys [][]byte
+	var undecodableBytes int64
+
+	var lease metricLease
+	iter := transaction.NewIterator(leveldbUtil.BytesPrefix([]byte("m-")), nil)
+	for iter.Next() {
+		key := string(iter.Key())
+		if leasedKeys[key] || !passedBySinks(cursors, iter.Key()) {
+			continue
+		}
+
+		metricsData := []halib.MetricsData{}
+		dec := gob.NewDecoder(bytes.NewReader(iter.Value()))
+		if err := dec.Decode(&metricsData); err != nil {
+			// never returned, so delete it not to be read again forever
+			log.Errorf("delete undecodable metrics: key=%s: %s", key, err.Error())
+			transaction.Delete(iter.Key(), nil)
+			undecodableKeys = append(undecodableKeys, []byte(key))
+			undecodableBytes += metricKeyBytes(iter.Key(), iter.Value())
+			continue
+		}
+		collectedMetricsData = append(collectedMetricsData, metricsData...)
+		lease.Keys = append(lease.Keys, key)
+		lease.Counts = append(lease.Counts, len(metricsData))
+
+		if limit > 0 && len(lease.Keys) >= limit {
+			break
+		}
+	}
+	iter.Release()
+
+	var batchID string
+	if len(lease.Keys) > 0 {
+		batchID, err = newBatchID()
+		if err != nil {
+			transaction.Discard()
+			return nil, "", err
+		}
+		lease.ExpireAt = now.Unix() + MetricAckLeaseSeconds
+
+		var b bytes.Buffer
+		enc := gob.NewEncoder(&b)
+		if err := enc.Encode(lease); err != nil {
+			transaction.Discard()
+			return nil, "", err
+		}
+		transaction.Put([]byte(fmt.Sprintf("l-%s", batchID)), b.Bytes(), nil)
+	}
+
+	addMetricBufferBytes(-undecodableBytes)
+	if err := transaction.Commit(); err != nil {
+		addMetricBufferBytes(undecodableBytes)
+		return nil, "", err
+	}
+	countUndecodableMetrics(cursors, undecodableKeys)
+
+	if len(lease.Keys) == 0 {
+		return nil, "", nil
+	}
+	return collectedMetricsData, batchID, nil
+}
+
+// countUndecodableMetrics counts keys deleted because they could not be decoded
+func countUndecodableMetrics(cursors map[string][]byte, keys [][]byte) {
+	if len(keys) == 0 {
+		return
+	}
+	countSkippedBySinks(cursors, keys)
+
+	retentionStatus.Lock()
+	defer retentionStatus.Unlock()
+	retentionStatus.undecodableKeys += int64(len(keys))
+}
+
+// AckCollectedMetrics deletes metrics leased with batch id.
+// returns leveldb.ErrNotFound when batch id is unknown or already expired
+func AckCollectedMetrics(batchID string) error {
+	transaction, err := db.DB.OpenTransaction()
+	if err != nil {
+		return err
+	}
+
+	leaseKey := []byte(fmt.Sprintf("l-%s", batchID))
+	value, err := transaction.Get(leaseKey, nil)
+	if err != nil {
+		transaction.Discard()
+		return err
+	}
+	var lease metricLease
+	dec := gob.NewDecoder(bytes.NewReader(value))
+	if err := dec.Decode(&lease); err != nil {
+		transaction.Discard()
+		return err
+	}
+
+	cursors := getSinkCursors(transaction)
+	var ackedBytes int64
+	for i, key := range lease.Keys {
+		value, err := transaction.Get([]byte(key), nil)
+		if err == leveldb.ErrNotFound {
+			// retired or read by /metric without require_ack
+			continue
+		} else if err != nil {
+			transaction.Discard()
+			return err
+		}
+		if !passedBySinks(cursors, []byte(key)) {
+			// sink is added or rewound after leased. kept until forwarded, and returned again
+			continue
+		}
+		ackedBytes += metricKeyBytes([]byte(key), value)
+
+		metricsData := []halib.MetricsData{}
+		dec := gob.NewDecoder(bytes.NewReader(value))
+		if err := dec.Decode(&metricsData); err != nil || len(metricsData) <= lease.Counts[i] {
+			transaction.Delete([]byte(key), nil)
+			continue
+		}
+
+		// keep MetricsData appended after leased
+		var b bytes.Buffer
+		enc := gob.NewEncoder(&b)
+		if err := enc.Encode(metricsData[lease.Counts[i]:]); err != nil {
+			transaction.Discard()
+			return err
+		}
+		transaction.Put([]byte(key), b.Bytes(), nil)
+		ackedBytes -= metricKeyBytes([]byte(key), b.Bytes())
+	}
+	transaction.Delete(leaseKey, nil)
+
+	addMetricBufferBytes(-ackedBytes)
+	if err := transaction.Commit(); err != nil {
+		addMetricBufferBytes(ackedBytes)
+		return err
+	}
+	return nil
+}
+
+// getLeasedMetricKeys returns `m-` keys leased by active leases, and `l-` keys of expired leases
+func getLeasedMetricKeys(transaction *leveldb.Transaction, now time.Time) (map[string]bool, [][]byte) {
+	leasedKeys := map[string]bool{}
+	var expiredLeaseKeys [][]byte
+
+	iter := transaction.NewIterator(leveldbUtil.BytesPrefix([]byte("l-")), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var lease metricLease
+		dec := gob.NewDecoder(bytes.NewReader(iter.Value()))
+		if err := dec.Decode(&lease); err != nil || lease.ExpireAt <= now.Unix() {
+			expiredLeaseKeys = append(expiredLeaseKeys, append([]byte{}, iter.Key()...))
+			continue
+		}
+		for _, key := range lease.Keys {
+			leasedKeys[key] = true
+		}
+	}
+	return leasedKeys, expiredLeaseKeys
+}
+
+func newBatchID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
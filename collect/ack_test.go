@@ -0,0 +1,105 @@
+package collect
+
+import (
+	"testing"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/db"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func TestGetCollectedMetricsWithLease1(t *testing.T) {
+	metricsData1 := []halib.MetricsData{
+		halib.MetricsData{HostName: "host1", Timestamp: 101, Metrics: map[string]float64{"val1": 111}},
+	}
+	metricsData2 := []halib.MetricsData{
+		halib.MetricsData{HostName: "host2", Timestamp: 102, Metrics: map[string]float64{"val1": 211}},
+	}
+
+	//cleanup
+	GetCollectedMetricsWithLimit(-1)
+
+	now := time.Unix(2000, 0)
+	assert.Nil(t, SaveMetrics(time.Unix(1001, 0), metricsData1))
+	assert.Nil(t, SaveMetrics(time.Unix(1002, 0), metricsData2))
+
+	got, batchID1, err := GetCollectedMetricsWithLease(now, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, metricsData1, got)
+	assert.NotEqual(t, "", batchID1)
+
+	// leased metrics are not returned while lease is alive
+	got, batchID2, err := GetCollectedMetricsWithLease(now, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, metricsData2, got)
+	assert.NotEqual(t, batchID1, batchID2)
+
+	got, batchID3, err := GetCollectedMetricsWithLease(now, -1)
+	assert.Nil(t, err)
+	assert.Nil(t, got)
+	assert.Equal(t, "", batchID3)
+
+	// ack
+	assert.Nil(t, AckCollectedMetrics(batchID1))
+	assert.Equal(t, leveldb.ErrNotFound, AckCollectedMetrics(batchID1))
+
+	// unacked metrics are returned again after lease expired
+	expired := now.Add(time.Duration(MetricAckLeaseSeconds+1) * time.Second)
+	got, batchID4, err := GetCollectedMetricsWithLease(expired, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, metricsData2, got)
+	assert.Equal(t, leveldb.ErrNotFound, AckCollectedMetrics(batchID2))
+	assert.Nil(t, AckCollectedMetrics(batchID4))
+
+	assert.Nil(t, GetCollectedMetricsWithLimit(-1))
+}
+
+func TestAckCollectedMetrics1(t *testing.T) {
+	// metrics appended to leased key after leased must be kept
+	metricsData1 := []halib.MetricsData{
+		halib.MetricsData{HostName: "host1", Timestamp: 101, Metrics: map[string]float64{"val1": 111}},
+	}
+	metricsData2 := []halib.MetricsData{
+		halib.MetricsData{HostName: "host2", Timestamp: 101, Metrics: map[string]float64{"val1": 211}},
+	}
+
+	//cleanup
+	GetCollectedMetricsWithLimit(-1)
+
+	assert.Nil(t, SaveMetrics(time.Unix(1001, 0), metricsData1))
+	got, batchID, err := GetCollectedMetricsWithLease(time.Unix(1001, 0), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, metricsData1, got)
+
+	assert.Nil(t, SaveMetrics(time.Unix(1001, 0), metricsData2))
+	assert.Nil(t, AckCollectedMetrics(batchID))
+
+	assert.Equal(t, metricsData2, GetCollectedMetricsWithLimit(-1))
+}
+
+func TestGetCollectedMetricsWithLease2(t *testing.T) {
+	// undecodable metrics are deleted and counted
+	metricsData := []halib.MetricsData{
+		halib.MetricsData{HostName: "host1", Timestamp: 1002, Metrics: map[string]float64{"val1": 111}},
+	}
+
+	//cleanup
+	GetCollectedMetricsWithLimit(-1)
+	before := GetMetricRetentionStatus()
+
+	assert.Nil(t, db.DB.Put([]byte("m-1001"), []byte("broken"), nil))
+	addMetricBufferBytes(metricKeyBytes([]byte("m-1001"), []byte("broken")))
+	assert.Nil(t, SaveMetrics(time.Unix(1002, 0), metricsData))
+
+	got, batchID, err := GetCollectedMetricsWithLease(time.Unix(2000, 0), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, metricsData, got)
+	assert.Nil(t, AckCollectedMetrics(batchID))
+
+	_, err = db.DB.Get([]byte("m-1001"), nil)
+	assert.Equal(t, leveldb.ErrNotFound, err)
+	after := GetMetricRetentionStatus()
+	assert.Equal(t, int64(1), after["undecodable_keys"]-before["undecodable_keys"])
+}
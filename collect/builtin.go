@@ -0,0 +1,375 @@
+package collect
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/heartbeatsjp/happo-agent/util"
+)
+
+// BuiltinMetricPluginPrefix is prefix of reserved plugin_name. plugin_name with this prefix is collected by happo-agent itself
+const BuiltinMetricPluginPrefix = "happo-agent:"
+
+// builtinMetricCollector returns metrics with scheme. returns empty map when no metrics(e.g. first run of delta based metrics)
+type builtinMetricCollector func(scheme string) (map[string]float64, error)
+
+var (
+	builtinMetricCollectors = map[string]builtinMetricCollector{
+		"linux-cpu":        collectLinuxCPU,
+		"linux-memory":     collectLinuxMemory,
+		"linux-load":       collectLinuxLoad,
+		"linux-diskstats":  collectLinuxDiskStats,
+		"linux-net":        collectLinuxNet,
+		"linux-filesystem": collectLinuxFilesystem,
+	}
+
+	// default scheme of each builtin plugin, prefixed with `<hostname>.`. same as sensu plugins replaced
+	builtinMetricSchemes = map[string]string{
+		"linux-cpu":        "cpu",
+		"linux-memory":     "memory",
+		"linux-load":       "load_avg",
+		"linux-diskstats":  "disk",
+		"linux-net":        "net",
+		"linux-filesystem": "disk_usage",
+	}
+
+	procPath = "/proc"
+
+	// previous counters of delta based metrics. key is `<plugin>\t<scheme>`
+	builtinCounters     = map[string]map[string]float64{}
+	builtinCountersLock sync.Mutex
+)
+
+// IsBuiltinMetricPlugin returns true if pluginName is reserved for builtin collector
+func IsBuiltinMetricPlugin(pluginName string) bool {
+	return strings.HasPrefix(pluginName, BuiltinMetricPluginPrefix)
+}
+
+// getBuiltinMetrics collects metrics by builtin collector. pluginOption accepts `--scheme <scheme>`
+func getBuiltinMetrics(pluginName string, pluginOption string) (map[string]float64, error) {
+	collector, scheme, err := parseBuiltinMetricPlugin(pluginName, pluginOption)
+	if err != nil {
+		return nil, err
+	}
+	return collector(scheme)
+}
+
+// parseBuiltinMetricPlugin returns builtin collector and scheme of pluginName and pluginOption
+func parseBuiltinMetricPlugin(pluginName string, pluginOption string) (builtinMetricCollector, string, error) {
+	name := strings.TrimPrefix(pluginName, BuiltinMetricPluginPrefix)
+	collector, ok := builtinMetricCollectors[name]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown builtin plugin: %s", pluginName)
+	}
+
+	scheme := builtinMetricSchemes[name]
+	if hostname, err := os.Hostname(); err == nil {
+		scheme = hostname + "." + scheme
+	}
+	options := strings.Fields(pluginOption)
+	for i := 0; i < len(options); i++ {
+		switch options[i] {
+		case "--scheme", "-s":
+			if i+1 >= len(options) {
+				return nil, "", fmt.Errorf("%s: missing value of %s", pluginName, options[i])
+			}
+			scheme = options[i+1]
+			i++
+		default:
+			return nil, "", fmt.Errorf("%s: unknown option: %s", pluginName, options[i])
+		}
+	}
+
+	return collector, scheme, nil
+}
+
+// counterDeltas returns delta of each counter from previous call of same plugin and scheme, and saves counters.
+// counters not seen at previous call(or reset) are not included, and counters not seen at this call(e.g. removed interface) are dropped
+func counterDeltas(plugin, scheme string, counters map[string]float64) map[string]float64 {
+	builtinCountersLock.Lock()
+	defer builtinCountersLock.Unlock()
+
+	key := plugin + "\t" + scheme
+	prevCounters := builtinCounters[key]
+	deltas := map[string]float64{}
+	for name, value := range counters {
+		if prev, ok := prevCounters[name]; ok && value >= prev {
+			deltas[name] = value - prev
+		}
+	}
+	builtinCounters[key] = counters
+	return deltas
+}
+
+// readProcFile returns fields of each line in file under procPath
+func readProcFile(name string) ([][]string, error) {
+	f, err := os.Open(path.Join(procPath, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines [][]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 {
+			lines = append(lines, fields)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// collectLinuxCPU collects cpu usage percentage from /proc/stat. same keys as metrics-cpu-pcnt-usage.rb
+func collectLinuxCPU(scheme string) (map[string]float64, error) {
+	lines, err := readProcFile("stat")
+	if err != nil {
+		return nil, err
+	}
+
+	cpuFields := []string{"user", "nice", "system", "idle", "iowait", "irq", "softirq", "steal", "guest", "guest_nice"}
+	counters := map[string]float64{}
+	var cpuNames []string
+	for _, fields := range lines {
+		if !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+		cpuName := fields[0]
+		if cpuName == "cpu" {
+			cpuName = "total"
+		}
+		cpuNames = append(cpuNames, cpuName)
+
+		total := float64(0)
+		for i, name := range cpuFields {
+			if i+1 >= len(fields) {
+				break
+			}
+			value, err := strconv.ParseFloat(fields[i+1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse /proc/stat: %s", strings.Join(fields, " "))
+			}
+			counters[cpuName+"."+name] = value
+			if name != "guest" && name != "guest_nice" {
+				// guest is already included in user
+				total += value
+			}
+		}
+		counters[cpuName+".__total"] = total
+	}
+
+	deltas := counterDeltas("linux-cpu", scheme, counters)
+	results := map[string]float64{}
+	for _, cpuName := range cpuNames {
+		total, ok := deltas[cpuName+".__total"]
+		if !ok || total <= 0 {
+			continue
+		}
+		for _, name := range cpuFields {
+			if delta, ok := deltas[cpuName+"."+name]; ok {
+				results[fmt.Sprintf("%s.%s.%s", scheme, cpuName, name)] = delta / total * 100
+			}
+		}
+	}
+	return results, nil
+}
+
+// collectLinuxMemory collects memory usage from /proc/meminfo. same keys as metrics-memory.rb(bytes)
+func collectLinuxMemory(scheme string) (map[string]float64, error) {
+	lines, err := readProcFile("meminfo")
+	if err != nil {
+		return nil, err
+	}
+
+	meminfo := map[string]float64{}
+	for _, fields := range lines {
+		if len(fields) < 2 {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+		meminfo[strings.TrimSuffix(fields[0], ":")] = value * 1024
+	}
+
+	mem := map[string]float64{
+		"total":     meminfo["MemTotal"],
+		"free":      meminfo["MemFree"],
+		"buffers":   meminfo["Buffers"],
+		"cached":    meminfo["Cached"],
+		"swapTotal": meminfo["SwapTotal"],
+		"swapFree":  meminfo["SwapFree"],
+		"dirty":     meminfo["Dirty"],
+	}
+	mem["swapUsed"] = mem["swapTotal"] - mem["swapFree"]
+	mem["used"] = mem["total"] - mem["free"]
+	mem["usedWOBuffersCaches"] = mem["used"] - (mem["buffers"] + mem["cached"])
+	mem["freeWOBuffersCaches"] = mem["free"] + (mem["buffers"] + mem["cached"])
+	if mem["swapTotal"] > 0 {
+		mem["swapUsedPercentage"] = 100 * mem["swapUsed"] / mem["swapTotal"]
+	}
+	if mem["total"] > 0 {
+		mem["usedPercentage"] = 100 * mem["used"] / mem["total"]
+	}
+
+	results := map[string]float64{}
+	for name, value := range mem {
+		results[scheme+"."+name] = value
+	}
+	return results, nil
+}
+
+// collectLinuxLoad collects load average from /proc/loadavg. same keys as metrics-load.rb
+func collectLinuxLoad(scheme string) (map[string]float64, error) {
+	lines, err := readProcFile("loadavg")
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) < 1 || len(lines[0]) < 3 {
+		return nil, fmt.Errorf("failed to parse /proc/loadavg")
+	}
+
+	results := map[string]float64{}
+	for i, name := range []string{"one", "five", "fifteen"} {
+		value, err := strconv.ParseFloat(lines[0][i], 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse /proc/loadavg: %s", strings.Join(lines[0], " "))
+		}
+		results[scheme+"."+name] = value
+	}
+	return results, nil
+}
+
+// collectLinuxDiskStats collects disk io from /proc/diskstats. same keys as metrics-disk.rb.
+// counters are delta from previous run
+func collectLinuxDiskStats(scheme string) (map[string]float64, error) {
+	lines, err := readProcFile("diskstats")
+	if err != nil {
+		return nil, err
+	}
+
+	diskFields := []string{"reads", "readsMerged", "sectorsRead", "readTime", "writes", "writesMerged", "sectorsWritten", "writeTime", "ioInProgress", "ioTime", "ioTimeWeighted"}
+	counters := map[string]float64{}
+	results := map[string]float64{}
+	for _, fields := range lines {
+		if len(fields) < 3+len(diskFields) {
+			continue
+		}
+		device := fields[2]
+		if strings.HasPrefix(device, "loop") || strings.HasPrefix(device, "ram") {
+			continue
+		}
+		for i, name := range diskFields {
+			value, err := strconv.ParseFloat(fields[3+i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse /proc/diskstats: %s", strings.Join(fields, " "))
+			}
+			if name == "ioInProgress" {
+				// gauge
+				results[fmt.Sprintf("%s.%s.%s", scheme, device, name)] = value
+				continue
+			}
+			counters[device+"."+name] = value
+		}
+	}
+
+	for name, delta := range counterDeltas("linux-diskstats", scheme, counters) {
+		results[scheme+"."+name] = delta
+	}
+	return results, nil
+}
+
+// collectLinuxNet collects network interface counters from /proc/net/dev. same keys as metrics-net.rb.
+// counters are delta from previous run
+func collectLinuxNet(scheme string) (map[string]float64, error) {
+	lines, err := readProcFile("net/dev")
+	if err != nil {
+		return nil, err
+	}
+
+	// Inter-|   Receive                                                |  Transmit
+	//  face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+	netFields := map[int]string{0: "rx_bytes", 1: "rx_packets", 2: "rx_errors", 8: "tx_bytes", 9: "tx_packets", 10: "tx_errors"}
+	counters := map[string]float64{}
+	for _, fields := range lines {
+		if !strings.Contains(fields[0], ":") {
+			continue
+		}
+		// `eth0:123` or `eth0: 123`
+		items := strings.SplitN(strings.Join(fields, " "), ":", 2)
+		iface := strings.TrimSpace(items[0])
+		values := strings.Fields(items[1])
+		if len(values) < 16 {
+			continue
+		}
+		for i, name := range netFields {
+			value, err := strconv.ParseFloat(values[i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse /proc/net/dev: %s", strings.Join(fields, " "))
+			}
+			counters[iface+"."+name] = value
+		}
+	}
+
+	results := map[string]float64{}
+	for name, delta := range counterDeltas("linux-net", scheme, counters) {
+		results[scheme+"."+name] = delta
+	}
+	return results, nil
+}
+
+// collectLinuxFilesystem collects usage of mounted filesystems from /proc/mounts and statfs. same keys as metrics-disk-usage.rb(MB)
+func collectLinuxFilesystem(scheme string) (map[string]float64, error) {
+	lines, err := readProcFile("mounts")
+	if err != nil {
+		return nil, err
+	}
+
+	log := util.HappoAgentLogger()
+
+	results := map[string]float64{}
+	seen := map[string]bool{}
+	var statErr error
+	for _, fields := range lines {
+		if len(fields) < 3 || !strings.HasPrefix(fields[0], "/") || seen[fields[1]] {
+			// not block device(e.g. tmpfs, proc)
+			continue
+		}
+		mountPoint := fields[1]
+		seen[mountPoint] = true
+
+		total, avail, free, err := statFilesystem(mountPoint)
+		if err != nil {
+			// e.g. stale NFS mount, permission denied
+			log.Warnf("skip filesystem %s: %s", mountPoint, err.Error())
+			statErr = err
+			continue
+		}
+		if total == 0 {
+			continue
+		}
+
+		name := "root"
+		if mountPoint != "/" {
+			name = strings.Replace(strings.TrimPrefix(mountPoint, "/"), "/", "_", -1)
+			name = strings.Replace(name, ".", "_", -1)
+		}
+		used := total - free
+		results[fmt.Sprintf("%s.%s.used", scheme, name)] = float64(used) / 1024 / 1024
+		results[fmt.Sprintf("%s.%s.avail", scheme, name)] = float64(avail) / 1024 / 1024
+		if used+avail > 0 {
+			results[fmt.Sprintf("%s.%s.used_percentage", scheme, name)] = float64(used) * 100 / float64(used+avail)
+		}
+	}
+	if len(results) == 0 && statErr != nil {
+		// e.g. statfs is not supported
+		return nil, statErr
+	}
+	return results, nil
+}
@@ -0,0 +1,13 @@
+package collect
+
+import "syscall"
+
+// statFilesystem returns total, available(for unprivileged user) and free bytes of filesystem
+func statFilesystem(mountPoint string) (uint64, uint64, uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(mountPoint, &stat); err != nil {
+		return 0, 0, 0, err
+	}
+	bsize := uint64(stat.Bsize)
+	return stat.Blocks * bsize, stat.Bavail * bsize, stat.Bfree * bsize, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package collect
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// statFilesystem is not supported except linux
+func statFilesystem(mountPoint string) (uint64, uint64, uint64, error) {
+	return 0, 0, 0, fmt.Errorf("statfs is not supported on %s", runtime.GOOS)
+}
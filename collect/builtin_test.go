@@ -0,0 +1,176 @@
+package collect
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setupProcPath(t *testing.T, files map[string]string) func() {
+	dir, err := ioutil.TempDir("", "happo-agent-proc")
+	assert.Nil(t, err)
+	assert.Nil(t, os.MkdirAll(path.Join(dir, "net"), 0755))
+	writeProcFiles(t, dir, files)
+
+	orig := procPath
+	procPath = dir
+	return func() {
+		procPath = orig
+		os.RemoveAll(dir)
+	}
+}
+
+func writeProcFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		assert.Nil(t, ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644))
+	}
+}
+
+func TestGetBuiltinMetrics(t *testing.T) {
+	teardown := setupProcPath(t, map[string]string{
+		"loadavg": "0.50 0.25 0.10 1/123 4567\n",
+	})
+	defer teardown()
+
+	hostname, _ := os.Hostname()
+	got, err := getBuiltinMetrics("happo-agent:linux-load", "")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]float64{hostname + ".load_avg.one": 0.5, hostname + ".load_avg.five": 0.25, hostname + ".load_avg.fifteen": 0.1}, got)
+
+	got, err = getBuiltinMetrics("happo-agent:linux-load", "--scheme linux.load")
+	assert.Nil(t, err)
+	assert.Equal(t, 0.5, got["linux.load.one"])
+
+	_, err = getBuiltinMetrics("happo-agent:linux-load", "--scheme")
+	assert.NotNil(t, err)
+	_, err = getBuiltinMetrics("happo-agent:linux-load", "--unknown")
+	assert.NotNil(t, err)
+	_, err = getBuiltinMetrics("happo-agent:unknown", "")
+	assert.NotNil(t, err)
+
+	assert.True(t, IsBuiltinMetricPlugin("happo-agent:linux-cpu"))
+	assert.False(t, IsBuiltinMetricPlugin("metrics-cpu.rb"))
+}
+
+func TestCounterDeltas(t *testing.T) {
+	// same scheme of other plugins does not share counters
+	assert.Equal(t, map[string]float64{}, counterDeltas("linux-net", "same", map[string]float64{"a": 10}))
+	assert.Equal(t, map[string]float64{}, counterDeltas("linux-diskstats", "same", map[string]float64{"a": 100}))
+	assert.Equal(t, map[string]float64{"a": 5}, counterDeltas("linux-net", "same", map[string]float64{"a": 15}))
+	assert.Equal(t, map[string]float64{"a": 1}, counterDeltas("linux-diskstats", "same", map[string]float64{"a": 101}))
+
+	// counters not seen at last call are dropped
+	assert.Equal(t, map[string]float64{}, counterDeltas("linux-net", "same", map[string]float64{"b": 20}))
+	assert.Equal(t, map[string]float64{"b": 1}, counterDeltas("linux-net", "same", map[string]float64{"a": 30, "b": 21}))
+	assert.Equal(t, map[string]float64{"a": 30, "b": 21}, builtinCounters["linux-net\tsame"])
+}
+
+func TestCollectLinuxCPU(t *testing.T) {
+	teardown := setupProcPath(t, map[string]string{
+		"stat": "cpu  100 0 100 800 0 0 0 0 0 0\ncpu0 100 0 100 800 0 0 0 0 0 0\nctxt 1000\n",
+	})
+	defer teardown()
+
+	// first run has no delta
+	got, err := collectLinuxCPU("test_cpu")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]float64{}, got)
+
+	writeProcFiles(t, procPath, map[string]string{
+		"stat": "cpu  150 0 100 850 0 0 0 0 0 0\ncpu0 150 0 100 850 0 0 0 0 0 0\nctxt 2000\n",
+	})
+	got, err = collectLinuxCPU("test_cpu")
+	assert.Nil(t, err)
+	assert.Equal(t, float64(50), got["test_cpu.total.user"])
+	assert.Equal(t, float64(0), got["test_cpu.total.system"])
+	assert.Equal(t, float64(50), got["test_cpu.total.idle"])
+	assert.Equal(t, float64(50), got["test_cpu.cpu0.user"])
+	assert.Equal(t, 20, len(got))
+}
+
+func TestCollectLinuxMemory(t *testing.T) {
+	teardown := setupProcPath(t, map[string]string{
+		"meminfo": "MemTotal:       1000 kB\nMemFree:         200 kB\nBuffers:         100 kB\nCached:          300 kB\nSwapTotal:       400 kB\nSwapFree:        300 kB\nDirty:            10 kB\n",
+	})
+	defer teardown()
+
+	got, err := collectLinuxMemory("memory")
+	assert.Nil(t, err)
+	assert.Equal(t, float64(1000*1024), got["memory.total"])
+	assert.Equal(t, float64(800*1024), got["memory.used"])
+	assert.Equal(t, float64(400*1024), got["memory.usedWOBuffersCaches"])
+	assert.Equal(t, float64(600*1024), got["memory.freeWOBuffersCaches"])
+	assert.Equal(t, float64(100*1024), got["memory.swapUsed"])
+	assert.Equal(t, float64(25), got["memory.swapUsedPercentage"])
+	assert.Equal(t, float64(80), got["memory.usedPercentage"])
+}
+
+func TestCollectLinuxDiskStats(t *testing.T) {
+	teardown := setupProcPath(t, map[string]string{
+		"diskstats": "   8       0 sda 10 0 80 5 20 0 160 10 0 15 15\n   7       0 loop0 1 0 1 1 1 0 1 1 0 1 1\n",
+	})
+	defer teardown()
+
+	got, err := collectLinuxDiskStats("test_disk")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]float64{"test_disk.sda.ioInProgress": 0}, got)
+
+	writeProcFiles(t, procPath, map[string]string{
+		"diskstats": "   8       0 sda 15 0 120 6 30 0 240 20 2 25 35\n   7       0 loop0 1 0 1 1 1 0 1 1 0 1 1\n",
+	})
+	got, err = collectLinuxDiskStats("test_disk")
+	assert.Nil(t, err)
+	assert.Equal(t, float64(5), got["test_disk.sda.reads"])
+	assert.Equal(t, float64(80), got["test_disk.sda.sectorsWritten"])
+	assert.Equal(t, float64(2), got["test_disk.sda.ioInProgress"])
+	assert.Equal(t, float64(20), got["test_disk.sda.ioTimeWeighted"])
+	_, ok := got["test_disk.loop0.reads"]
+	assert.False(t, ok)
+}
+
+func TestCollectLinuxNet(t *testing.T) {
+	header := "Inter-|   Receive                                                |  Transmit\n face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed\n"
+	teardown := setupProcPath(t, map[string]string{
+		"net/dev": header + "  eth0: 1000 10 0 0 0 0 0 0 2000 20 0 0 0 0 0 0\n",
+	})
+	defer teardown()
+
+	got, err := collectLinuxNet("test_net")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]float64{}, got)
+
+	writeProcFiles(t, procPath, map[string]string{
+		"net/dev": header + "  eth0:1500 15 1 0 0 0 0 0 2600 26 0 0 0 0 0 0\n",
+	})
+	got, err = collectLinuxNet("test_net")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]float64{
+		"test_net.eth0.rx_bytes":   500,
+		"test_net.eth0.rx_packets": 5,
+		"test_net.eth0.rx_errors":  1,
+		"test_net.eth0.tx_bytes":   600,
+		"test_net.eth0.tx_packets": 6,
+		"test_net.eth0.tx_errors":  0,
+	}, got)
+}
+
+func TestCollectLinuxFilesystem(t *testing.T) {
+	teardown := setupProcPath(t, map[string]string{
+		"mounts": "proc /proc proc rw 0 0\n/dev/sdz /happo-agent-not-mounted ext4 rw 0 0\n/dev/root / ext4 rw 0 0\n",
+	})
+	defer teardown()
+
+	got, err := collectLinuxFilesystem("disk_usage")
+	if err != nil {
+		// e.g. not linux
+		t.Skip(err)
+	}
+	// failed mount is skipped
+	assert.Contains(t, got, "disk_usage.root.used")
+	for key := range got {
+		assert.Contains(t, []string{"disk_usage.root.used", "disk_usage.root.avail", "disk_usage.root.used_percentage"}, key)
+	}
+}
@@ -2,14 +2,19 @@ package collect
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/gob"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/heartbeatsjp/happo-agent/db"
@@ -30,6 +35,7 @@ var (
 
 // Metrics is main function of metric collection
 func Metrics(configPath string) error {
+	log := util.HappoAgentLogger()
 	var metricsDataBuffer []halib.MetricsData
 
 	metricList, err := GetMetricConfig(configPath)
@@ -41,26 +47,52 @@ func Metrics(configPath string) error {
 		return nil
 	}
 
+	transforms, errs := compileMetricTransforms(metricList.Transforms)
+	for _, err := range errs {
+		log.Errorf("skip invalid metric transform: %s", err.Error())
+	}
+
 	metricTotalCount := 0
 	for _, metricHostList := range metricList.Metrics {
 		for _, metricPlugin := range metricHostList.Plugins {
 			metricTotalCount++
+			if IsBuiltinMetricPlugin(metricPlugin.PluginName) {
+				metricData, err := getBuiltinMetrics(metricPlugin.PluginName, metricPlugin.PluginOption)
+				if err != nil {
+					log.Errorf("Fail to get metrics: %s %s", metricPlugin.PluginName, err.Error())
+					continue
+				}
+				timestamp := time.Now().Unix()
+				metricData = applyMetricTransforms(transforms, metricHostList.Hostname, metricPlugin.PluginName, timestamp, metricData)
+				if len(metricData) == 0 {
+					continue
+				}
+				metricsDataBuffer = append(metricsDataBuffer, halib.MetricsData{
+					HostName:  metricHostList.Hostname,
+					Timestamp: timestamp,
+					Metrics:   metricData,
+				})
+				continue
+			}
+
 			rawMetrics, err := getMetrics(metricPlugin.PluginName, metricPlugin.PluginOption)
 			if err != nil {
 				return err
 			} else if rawMetrics == "" {
 				continue
 			}
-			metricData, timestamp, err := ParseMetricData(rawMetrics)
+			timestampedMetricData, err := ParseTimestampedMetricData(rawMetrics)
 			if err != nil {
 				return err
 			}
-
-			var metrics halib.MetricsData
-			metrics.HostName = metricHostList.Hostname
-			metrics.Timestamp = timestamp
-			metrics.Metrics = metricData
-			metricsDataBuffer = append(metricsDataBuffer, metrics)
+			// transforms are applied in order of timestamp, so that rate is calculated from older sample
+			for _, metricsData := range MetricsDataByTimestamp(metricHostList.Hostname, timestampedMetricData) {
+				metricsData.Metrics = applyMetricTransforms(transforms, metricHostList.Hostname, metricPlugin.PluginName, metricsData.Timestamp, metricsData.Metrics)
+				if len(metricsData.Metrics) == 0 {
+					continue
+				}
+				metricsDataBuffer = append(metricsDataBuffer, metricsData)
+			}
 		}
 	}
 
@@ -69,74 +101,73 @@ func Metrics(configPath string) error {
 	return err
 }
 
-//SaveMetrics save metrics to dbms
+//SaveMetrics save metrics to dbms, under `m-<timestamp>` key of each sample(rolled up sample is under `m-<timestamp>-r<interval>`)
 func SaveMetrics(now time.Time, metricsData []halib.MetricsData) error {
 	log := util.HappoAgentLogger()
 
+	metricsData = checkMetricTimestamps(now, metricsData)
+	cacheMetricSeries(now, metricsData)
+
+	var keys []string
+	metricsDataByKey := map[string][]halib.MetricsData{}
+	for _, m := range metricsData {
+		key := fmt.Sprintf("m-%d", m.Timestamp)
+		if m.Rollup != nil {
+			key = rollupMetricKey(m.Timestamp, m.Rollup.Interval)
+		}
+		if _, ok := metricsDataByKey[key]; !ok {
+			keys = append(keys, key)
+		}
+		metricsDataByKey[key] = append(metricsDataByKey[key], m)
+	}
+
 	// Save Metrics
 	transaction, err := db.DB.OpenTransaction()
 	if err != nil {
 		log.Error(err)
+		return err
 	}
 
-	got, err := transaction.Get(
-		[]byte(fmt.Sprintf("m-%d", now.Unix())),
-		nil)
-	if err != leveldbErrors.ErrNotFound {
-		savedMetricsData := []halib.MetricsData{}
-		dec := gob.NewDecoder(bytes.NewReader(got))
-		dec.Decode(&savedMetricsData)
-		metricsData = append(savedMetricsData, metricsData...)
+	var savedKeys [][]byte
+	var savedBytes int64
+	for _, key := range keys {
+		metricsData := metricsDataByKey[key]
+		got, err := transaction.Get([]byte(key), nil)
+		if err == nil {
+			savedBytes -= metricKeyBytes([]byte(key), got)
+		}
+		if err != leveldbErrors.ErrNotFound {
+			savedMetricsData := []halib.MetricsData{}
+			dec := gob.NewDecoder(bytes.NewReader(got))
+			dec.Decode(&savedMetricsData)
+			metricsData = append(savedMetricsData, metricsData...)
+		}
+
+		var b bytes.Buffer
+		enc := gob.NewEncoder(&b)
+		err = enc.Encode(metricsData)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		transaction.Put([]byte(key), b.Bytes(), nil)
+		savedKeys = append(savedKeys, []byte(key))
+		savedBytes += metricKeyBytes([]byte(key), b.Bytes())
 	}
 
-	var b bytes.Buffer
-	enc := gob.NewEncoder(&b)
-	err = enc.Encode(metricsData)
-	if err != nil {
+	if err := rewindSinkCursors(transaction, savedKeys); err != nil {
+		transaction.Discard()
 		log.Error(err)
-	} else {
-		transaction.Put(
-			[]byte(fmt.Sprintf("m-%d", now.Unix())),
-			b.Bytes(),
-			nil)
+		return err
 	}
 
+	addMetricBufferBytes(savedBytes)
 	err = transaction.Commit()
 	if err != nil {
 		//Fatal
 		log.Fatalln(err)
 	}
 
-	// retire old metrics
-	transaction, err = db.DB.OpenTransaction()
-	if err != nil {
-		log.Error(err)
-	}
-	oldestThreshold := now.Add(time.Duration(-1*db.MetricsMaxLifetimeSeconds) * time.Second)
-	iter := transaction.NewIterator(
-		&leveldbUtil.Range{
-			Start: []byte("m-0"),
-			Limit: []byte(fmt.Sprintf("m-%d", oldestThreshold.Unix()))},
-		nil)
-	for iter.Next() {
-		key := iter.Key()
-		value := iter.Value()
-		transaction.Delete(key, nil)
-
-		// logging
-		unixTime, _ := strconv.Atoi(strings.SplitN(string(key), "-", 2)[1])
-		expired := []halib.MetricsData{}
-		dec := gob.NewDecoder(bytes.NewReader(value))
-		dec.Decode(&expired)
-		log.Warn(fmt.Sprintf("retire old metrics: key=%v(%v), value=%v\n", string(key), time.Unix(int64(unixTime), 0), expired))
-	}
-	iter.Release()
-
-	err = transaction.Commit()
-	if err != nil {
-		log.Error(err)
-	}
-
 	return nil
 }
 
@@ -145,7 +176,7 @@ func GetCollectedMetrics() []halib.MetricsData {
 	return GetCollectedMetricsWithLimit(-1)
 }
 
-// GetCollectedMetricsWithLimit returns collected metrics. with max `limit`
+// GetCollectedMetricsWithLimit returns collected metrics forwarded by all sinks. with max `limit`
 func GetCollectedMetricsWithLimit(limit int) []halib.MetricsData {
 	/*
 		limit > 0 works fine. (otherwise, means unlimited)
@@ -158,6 +189,9 @@ func GetCollectedMetricsWithLimit(limit int) []halib.MetricsData {
 		log.Error(err)
 	}
 
+	cursors := getSinkCursors(transaction)
+	var deletedBytes int64
+
 	var metricsData []halib.MetricsData
 	var dec *gob.Decoder
 	iter := transaction.NewIterator(
@@ -168,6 +202,10 @@ func GetCollectedMetricsWithLimit(limit int) []halib.MetricsData {
 	for iter.Next() {
 		key := iter.Key()
 		value := iter.Value()
+		if !passedBySinks(cursors, key) {
+			// kept until forwarded by all sinks
+			continue
+		}
 
 		metricsData = []halib.MetricsData{}
 		dec = gob.NewDecoder(bytes.NewReader(value))
@@ -178,6 +216,7 @@ func GetCollectedMetricsWithLimit(limit int) []halib.MetricsData {
 		}
 		collectedMetricsData = append(collectedMetricsData, metricsData...)
 		transaction.Delete(key, nil)
+		deletedBytes += metricKeyBytes(key, value)
 
 		i = i + 1
 		if limit > 0 && i >= limit {
@@ -186,29 +225,67 @@ func GetCollectedMetricsWithLimit(limit int) []halib.MetricsData {
 	}
 	iter.Release()
 
+	addMetricBufferBytes(-deletedBytes)
 	err = transaction.Commit()
 	if err != nil {
+		addMetricBufferBytes(deletedBytes)
 		log.Error(err)
 	}
 	return collectedMetricsData
 }
 
-// getMetrics exec sensu plugin and get metrics
-func getMetrics(pluginName string, pluginOption string) (string, error) {
+// GetMetricsAfter returns collected metrics stored after key `after`, without deleting them.
+// when `after` is nil, returns from oldest metrics. returns last read key together(nil if nothing read)
+func GetMetricsAfter(after []byte, limit int) ([]halib.MetricsData, []byte, error) {
+	/*
+		limit > 0 works fine. (otherwise, means unlimited)
+	*/
 	log := util.HappoAgentLogger()
-	var plugin string
+	var collectedMetricsData []halib.MetricsData
 
-	for _, basePath := range strings.Split(SensuPluginPaths, ",") {
-		plugin = path.Join(basePath, pluginName)
-		_, err := os.Stat(plugin)
-		if err == nil {
-			if !util.Production {
-				log.Debug(plugin)
-			}
+	snapshot, err := db.DB.GetSnapshot()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer snapshot.Release()
+
+	r := leveldbUtil.BytesPrefix([]byte("m-"))
+	if after != nil {
+		// next key of `after`
+		r.Start = append(append([]byte{}, after...), 0x00)
+	}
+	iter := snapshot.NewIterator(r, nil)
+	defer iter.Release()
+
+	var lastKey []byte
+	i := 0
+	for iter.Next() {
+		metricsData := []halib.MetricsData{}
+		dec := gob.NewDecoder(bytes.NewReader(iter.Value()))
+		if err := dec.Decode(&metricsData); err != nil {
+			log.Error(err)
+		} else {
+			collectedMetricsData = append(collectedMetricsData, metricsData...)
+		}
+		lastKey = append([]byte{}, iter.Key()...)
+
+		i = i + 1
+		if limit > 0 && i >= limit {
 			break
 		}
 	}
-	_, err := os.Stat(plugin)
+	if err := iter.Error(); err != nil {
+		return nil, nil, err
+	}
+
+	return collectedMetricsData, lastKey, nil
+}
+
+// getMetrics exec sensu plugin and get metrics
+func getMetrics(pluginName string, pluginOption string) (string, error) {
+	log := util.HappoAgentLogger()
+
+	plugin, err := findMetricPlugin(pluginName)
 	if err != nil {
 		log.Error("Plugin not found:" + plugin)
 		return "", nil
@@ -235,10 +312,47 @@ func getMetrics(pluginName string, pluginOption string) (string, error) {
 	return stdout, nil
 }
 
-// ParseMetricData parse sensu-stype metrics output
+// findMetricPlugin returns path of pluginName in SensuPluginPaths. returns error with last tried path if not found
+func findMetricPlugin(pluginName string) (string, error) {
+	log := util.HappoAgentLogger()
+	var plugin string
+	var err error
+
+	for _, basePath := range strings.Split(SensuPluginPaths, ",") {
+		plugin = path.Join(basePath, pluginName)
+		_, err = os.Stat(plugin)
+		if err == nil {
+			if !util.Production {
+				log.Debug(plugin)
+			}
+			return plugin, nil
+		}
+	}
+	return plugin, err
+}
+
+// ParseMetricData parse sensu-stype metrics output. timestamp is max of all lines(see also ParseTimestampedMetricData)
 func ParseMetricData(rawMetricdata string) (map[string]float64, int64, error) {
+	timestampedMetricData, err := ParseTimestampedMetricData(rawMetricdata)
+	if err != nil {
+		return nil, 0, err
+	}
+
 	var timestamp int64
 	results := make(map[string]float64)
+	// value of newer line wins
+	for _, metricsData := range MetricsDataByTimestamp("", timestampedMetricData) {
+		for key, value := range metricsData.Metrics {
+			results[key] = value
+		}
+		timestamp = metricsData.Timestamp
+	}
+	return results, timestamp, nil
+}
+
+// ParseTimestampedMetricData parse sensu-stype metrics output, and returns metrics grouped by timestamp of each line
+func ParseTimestampedMetricData(rawMetricdata string) (map[int64]map[string]float64, error) {
+	results := make(map[int64]map[string]float64)
 
 	for _, line := range strings.Split(rawMetricdata, "\n") {
 		items := strings.Split(line, "\t")
@@ -250,48 +364,204 @@ func ParseMetricData(rawMetricdata string) (map[string]float64, int64, error) {
 		}
 		value, err := strconv.ParseFloat(items[1], 64)
 		if err != nil {
-			return nil, 0, errors.New("Failed to parse values: " + line)
+			return nil, errors.New("Failed to parse values: " + line)
 		}
 
-		timestampValue, err := strconv.ParseInt(items[2], 10, 64)
+		timestamp, err := strconv.ParseInt(items[2], 10, 64)
 		if err != nil {
-			return nil, 0, errors.New("Failed to parse values: " + line)
+			return nil, errors.New("Failed to parse values: " + line)
 		}
-		if timestamp < timestampValue {
-			timestamp = timestampValue
+
+		if results[timestamp] == nil {
+			results[timestamp] = make(map[string]float64)
 		}
+		results[timestamp][items[0]] = value
+	}
+
+	return results, nil
+}
+
+// GetMetricConfig returns required metrics from config file,
+// merged with `*.yaml` in metrics.d directory next to config file(if exists).
+// each file is rendered as text/template with MetricConfigTemplateData before parsing
+func GetMetricConfig(configFile string) (halib.MetricConfig, error) {
+	metricConfig, _, _, err := GetMetricConfigWithSources(configFile)
+	return metricConfig, err
+}
 
-		key := items[0]
+// GetMetricConfigWithSources returns same config as GetMetricConfig, with checksum and mtime of each file,
+// and source file of each plugin entry
+func GetMetricConfigWithSources(configFile string) (halib.MetricConfig, []halib.MetricConfigSource, []halib.MetricConfigEntrySource, error) {
+	log := util.HappoAgentLogger()
+	var sources []halib.MetricConfigSource
+	var entries []halib.MetricConfigEntrySource
 
-		results[key] = value
+	metricConfig, source, err := readMetricConfigFile(configFile)
+	if err != nil {
+		return metricConfig, nil, nil, err
 	}
+	source.Type = halib.MetricConfigSourceFile
+	sources = append(sources, source)
+	entries = append(entries, metricConfigEntrySources(metricConfig, source.Path)...)
 
-	return results, timestamp, nil
+	dropInFiles, err := filepath.Glob(filepath.Join(MetricConfigDir(configFile), "*.yaml"))
+	if err != nil {
+		return metricConfig, nil, nil, err
+	}
+	sort.Strings(dropInFiles)
+	for _, dropInFile := range dropInFiles {
+		dropInConfig, source, err := readMetricConfigFile(dropInFile)
+		if errors.Is(err, errMetricConfigAliasUnknown) {
+			log.Info(fmt.Sprintf("skip metric config until joined to autoscaling group: %s", dropInFile))
+			continue
+		}
+		if err != nil {
+			return metricConfig, nil, nil, fmt.Errorf("%s: %s", dropInFile, err.Error())
+		}
+		source.Type = halib.MetricConfigSourceDropIn
+		if filepath.Base(dropInFile) == halib.MetricConfigAPIFileName {
+			source.Type = halib.MetricConfigSourceAPI
+		}
+		sources = append(sources, source)
+		entries = append(entries, metricConfigEntrySources(dropInConfig, source.Path)...)
+		metricConfig = mergeMetricConfig(metricConfig, dropInConfig)
+	}
+
+	return metricConfig, sources, entries, nil
 }
 
-// GetMetricConfig returns required metrics from config file
-func GetMetricConfig(configFile string) (halib.MetricConfig, error) {
+// metricConfigEntrySources returns source of each plugin entry in config
+func metricConfigEntrySources(config halib.MetricConfig, sourcePath string) []halib.MetricConfigEntrySource {
+	var entries []halib.MetricConfigEntrySource
+	for _, metricHostList := range config.Metrics {
+		for _, metricPlugin := range metricHostList.Plugins {
+			entries = append(entries, halib.MetricConfigEntrySource{
+				Hostname:     metricHostList.Hostname,
+				PluginName:   metricPlugin.PluginName,
+				PluginOption: metricPlugin.PluginOption,
+				Source:       sourcePath,
+			})
+		}
+	}
+	return entries
+}
+
+// MetricConfigDir returns metrics.d directory of config file
+func MetricConfigDir(configFile string) string {
+	return filepath.Join(filepath.Dir(configFile), halib.MetricConfigDirName)
+}
+
+// MetricConfigTemplateData is data of metric config template. e.g. `{{ .Hostname }}`
+type MetricConfigTemplateData struct {
+	Hostname string
+	alias    string
+}
+
+// Alias returns alias of autoscaling node. fails until alias is known, so that config is not rendered with empty alias
+func (d MetricConfigTemplateData) Alias() (string, error) {
+	if d.alias == "" {
+		return "", errMetricConfigAliasUnknown
+	}
+	return d.alias, nil
+}
+
+var (
+	metricConfigAlias     string
+	metricConfigAliasLock sync.RWMutex
+
+	// metricConfigAliasKey is key of saved alias, so that `{{ .Alias }}` is rendered after restart before joined again
+	metricConfigAliasKey = []byte("a-metric-config-alias")
+
+	errMetricConfigAliasUnknown = errors.New("alias of autoscaling node is not known yet")
+)
+
+// SetMetricConfigAlias sets and saves `{{ .Alias }}` of metric config template. (alias of autoscaling node)
+func SetMetricConfigAlias(alias string) error {
+	metricConfigAliasLock.Lock()
+	defer metricConfigAliasLock.Unlock()
+	metricConfigAlias = alias
+
+	if alias == "" {
+		return db.DB.Delete(metricConfigAliasKey, nil)
+	}
+	return db.DB.Put(metricConfigAliasKey, []byte(alias), nil)
+}
+
+func getMetricConfigTemplateData() MetricConfigTemplateData {
+	metricConfigAliasLock.Lock()
+	defer metricConfigAliasLock.Unlock()
+
+	if metricConfigAlias == "" && db.DB != nil {
+		if alias, err := db.DB.Get(metricConfigAliasKey, nil); err == nil {
+			metricConfigAlias = string(alias)
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	return MetricConfigTemplateData{Hostname: hostname, alias: metricConfigAlias}
+}
+
+// readMetricConfigFile returns config of configFile, and source with checksum(sha256 of file content) and mtime
+func readMetricConfigFile(configFile string) (halib.MetricConfig, halib.MetricConfigSource, error) {
 	var metricConfig halib.MetricConfig
+	source := halib.MetricConfigSource{Path: configFile}
 
 	buf, err := ioutil.ReadFile(configFile)
 	if err != nil {
-		return metricConfig, err
+		return metricConfig, source, err
+	}
+	if fi, err := os.Stat(configFile); err == nil {
+		source.ModTime = fi.ModTime().Unix()
+	}
+	source.Checksum = fmt.Sprintf("%x", sha256.Sum256(buf))
+
+	tmpl, err := template.New(filepath.Base(configFile)).Option("missingkey=error").Parse(string(buf))
+	if err != nil {
+		return metricConfig, source, err
+	}
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, getMetricConfigTemplateData()); err != nil {
+		return metricConfig, source, err
 	}
-	err = yaml.Unmarshal(buf, &metricConfig)
+
+	err = yaml.Unmarshal(rendered.Bytes(), &metricConfig)
 	if err != nil {
-		return metricConfig, err
+		return metricConfig, source, err
 	}
 
-	return metricConfig, nil
+	return metricConfig, source, nil
+}
+
+// mergeMetricConfig appends metrics and transforms of src to dst. plugins of same hostname are merged into one entry
+func mergeMetricConfig(dst, src halib.MetricConfig) halib.MetricConfig {
+	dst.Transforms = append(dst.Transforms, src.Transforms...)
+	for _, srcHost := range src.Metrics {
+		merged := false
+		for i := range dst.Metrics {
+			if dst.Metrics[i].Hostname == srcHost.Hostname {
+				dst.Metrics[i].Plugins = append(dst.Metrics[i].Plugins, srcHost.Plugins...)
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			dst.Metrics = append(dst.Metrics, srcHost)
+		}
+	}
+	return dst
 }
 
-// SaveMetricConfig save metric config to config file
+// SaveMetricConfig save metric config to config file.
+// if metrics.d directory exists, save to metrics.d/api.yaml instead, so that config file is not overwritten
 func SaveMetricConfig(config halib.MetricConfig, configFile string) error {
 	buf, err := yaml.Marshal(&config)
 	if err != nil {
 		return err
 	}
 
+	if fi, err := os.Stat(MetricConfigDir(configFile)); err == nil && fi.IsDir() {
+		configFile = filepath.Join(MetricConfigDir(configFile), halib.MetricConfigAPIFileName)
+	}
 	err = ioutil.WriteFile(configFile, buf, os.ModePerm)
 	if err != nil {
 		return err
@@ -337,14 +607,14 @@ func GetMetricDataBufferStatus(extended bool) map[string]int64 {
 	oldestTimestamp := int64(0)
 	newestTimestamp := int64(0)
 	if i > 0 {
-		firstUnixTime, err := strconv.Atoi(strings.SplitN(string(firstKey), "-", 2)[1])
+		firstUnixTime, err := strconv.Atoi(strings.SplitN(string(firstKey), "-", 3)[1])
 		if err != nil {
 			log.Error(err)
 		} else {
 			oldestTimestamp = int64(firstUnixTime)
 		}
 
-		lastUnixTime, err := strconv.Atoi(strings.SplitN(string(lastKey), "-", 2)[1])
+		lastUnixTime, err := strconv.Atoi(strings.SplitN(string(lastKey), "-", 3)[1])
 		if err != nil {
 			log.Error(err)
 		} else {
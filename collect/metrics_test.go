@@ -1,8 +1,11 @@
 package collect
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -125,6 +128,19 @@ func TestParseMetricData3(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestParseTimestampedMetricData1(t *testing.T) {
+	ret, err := ParseTimestampedMetricData("hoge	10	1\nfuga	20	2\nhoge 30 2\ninvalid\n")
+	assert.Nil(t, err)
+	assert.EqualValues(t, map[int64]map[string]float64{
+		1: {"hoge": 10},
+		2: {"fuga": 20, "hoge": 30},
+	}, ret)
+
+	ret, err = ParseTimestampedMetricData("hoge	foo	bar")
+	assert.Nil(t, ret)
+	assert.NotNil(t, err)
+}
+
 func TestGetMetricConfig1(t *testing.T) {
 	config, err := GetMetricConfig(TestConfigFile)
 	assert.EqualValues(t, ConfigData, config)
@@ -151,6 +167,127 @@ func TestSaveMetricConfig1(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestGetMetricConfig4(t *testing.T) {
+	// drop-in directory and template
+	dir, err := ioutil.TempDir("", "happo-agent-metrics")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, halib.MetricConfigDirName), 0755))
+
+	configFile := filepath.Join(dir, "metrics.yaml")
+	assert.Nil(t, ioutil.WriteFile(configFile, []byte(`metrics:
+- hostname: "{{ .Hostname }}"
+  plugins:
+  - plugin_name: metrics_test_plugin
+    plugin_option: ""
+`), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, halib.MetricConfigDirName, "20-app.yaml"), []byte(`metrics:
+- hostname: "app-{{ .Alias }}"
+  plugins:
+  - plugin_name: app_plugin
+    plugin_option: "--name {{ .Alias }}"
+`), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, halib.MetricConfigDirName, "10-base.yaml"), []byte(`metrics:
+- hostname: "{{ .Hostname }}"
+  plugins:
+  - plugin_name: happo-agent:linux-cpu
+    plugin_option: ""
+`), 0644))
+	// not yaml
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, halib.MetricConfigDirName, "README"), []byte(`{{`), 0644))
+
+	hostname, _ := os.Hostname()
+
+	// skipped until alias is known
+	config, err := GetMetricConfig(configFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(config.Metrics))
+
+	assert.Nil(t, SetMetricConfigAlias("web-01"))
+	defer SetMetricConfigAlias("")
+	// restarted: saved alias is used
+	metricConfigAlias = ""
+
+	config, err = GetMetricConfig(configFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(config.Metrics))
+	assert.Equal(t, hostname, config.Metrics[0].Hostname)
+	assert.Equal(t, 2, len(config.Metrics[0].Plugins))
+	assert.Equal(t, "metrics_test_plugin", config.Metrics[0].Plugins[0].PluginName)
+	assert.Equal(t, "happo-agent:linux-cpu", config.Metrics[0].Plugins[1].PluginName)
+	assert.Equal(t, "app-web-01", config.Metrics[1].Hostname)
+	assert.Equal(t, "--name web-01", config.Metrics[1].Plugins[0].PluginOption)
+
+	// saved to metrics.d/api.yaml, config file is kept
+	assert.Nil(t, SaveMetricConfig(ConfigData, configFile))
+	saved, err := ioutil.ReadFile(filepath.Join(dir, halib.MetricConfigDirName, halib.MetricConfigAPIFileName))
+	assert.Nil(t, err)
+	assert.Contains(t, string(saved), "hostname: localhost")
+	config, err = GetMetricConfig(configFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(config.Metrics))
+	assert.Equal(t, "localhost", config.Metrics[2].Hostname)
+
+	// invalid template
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, halib.MetricConfigDirName, "30-invalid.yaml"), []byte(`{{ .Unknown }}`), 0644))
+	_, err = GetMetricConfig(configFile)
+	assert.NotNil(t, err)
+}
+
+func TestGetMetricConfigWithSources1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "happo-agent-metrics")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, halib.MetricConfigDirName), 0755))
+
+	configFile := filepath.Join(dir, "metrics.yaml")
+	dropInFile := filepath.Join(dir, halib.MetricConfigDirName, "10-base.yaml")
+	apiFile := filepath.Join(dir, halib.MetricConfigDirName, halib.MetricConfigAPIFileName)
+	content := `metrics:
+- hostname: localhost
+  plugins:
+  - plugin_name: metrics_test_plugin
+    plugin_option: ""
+`
+	assert.Nil(t, ioutil.WriteFile(configFile, []byte(content), 0644))
+	assert.Nil(t, ioutil.WriteFile(dropInFile, []byte(`metrics:
+- hostname: localhost
+  plugins:
+  - plugin_name: happo-agent:linux-cpu
+    plugin_option: ""
+`), 0644))
+	assert.Nil(t, ioutil.WriteFile(apiFile, []byte(`metrics:
+- hostname: api
+  plugins:
+  - plugin_name: api_plugin
+    plugin_option: "-v"
+`), 0644))
+	mtime := time.Unix(1500000000, 0)
+	assert.Nil(t, os.Chtimes(configFile, mtime, mtime))
+
+	config, sources, entries, err := GetMetricConfigWithSources(configFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(config.Metrics))
+
+	assert.Equal(t, 3, len(sources))
+	assert.Equal(t, halib.MetricConfigSource{
+		Path:     configFile,
+		Type:     halib.MetricConfigSourceFile,
+		Checksum: fmt.Sprintf("%x", sha256.Sum256([]byte(content))),
+		ModTime:  1500000000,
+	}, sources[0])
+	assert.Equal(t, dropInFile, sources[1].Path)
+	assert.Equal(t, halib.MetricConfigSourceDropIn, sources[1].Type)
+	assert.Equal(t, apiFile, sources[2].Path)
+	assert.Equal(t, halib.MetricConfigSourceAPI, sources[2].Type)
+
+	assert.Equal(t, []halib.MetricConfigEntrySource{
+		{Hostname: "localhost", PluginName: "metrics_test_plugin", PluginOption: "", Source: configFile},
+		{Hostname: "localhost", PluginName: "happo-agent:linux-cpu", PluginOption: "", Source: dropInFile},
+		{Hostname: "api", PluginName: "api_plugin", PluginOption: "-v", Source: apiFile},
+	}, entries)
+}
+
 func TestSaveMetrics1(t *testing.T) {
 	var err error
 	metricsData1 := []halib.MetricsData{
@@ -190,8 +327,9 @@ func TestSaveMetrics2(t *testing.T) {
 	err = SaveMetrics(time.Unix(1002, 0), metricsData2)
 	assert.Nil(t, err)
 
+	// saved by timestamp of each sample
 	got := GetCollectedMetricsWithLimit(-1)
-	assert.Equal(t, append(metricsData1, metricsData2...), got)
+	assert.Equal(t, []halib.MetricsData{metricsData1[0], metricsData2[0], metricsData1[1], metricsData2[1]}, got)
 }
 
 func TestSaveMetrics3(t *testing.T) {
@@ -218,12 +356,12 @@ func TestSaveMetrics3(t *testing.T) {
 func TestSaveMetrics4(t *testing.T) {
 	var err error
 	metricsData1 := []halib.MetricsData{
-		halib.MetricsData{HostName: "host1", Timestamp: 101, Metrics: map[string]float64{"val1": 111, "val2": 112}},
-		halib.MetricsData{HostName: "host1", Timestamp: 102, Metrics: map[string]float64{"val1": 121, "val2": 122}},
+		halib.MetricsData{HostName: "host1", Timestamp: 1000, Metrics: map[string]float64{"val1": 111, "val2": 112}},
+		halib.MetricsData{HostName: "host1", Timestamp: 1000, Metrics: map[string]float64{"val1": 121, "val2": 122}},
 	}
 	metricsData2 := []halib.MetricsData{
-		halib.MetricsData{HostName: "host2", Timestamp: 101, Metrics: map[string]float64{"val1": 211, "val2": 212}},
-		halib.MetricsData{HostName: "host2", Timestamp: 102, Metrics: map[string]float64{"val1": 221, "val2": 222}},
+		halib.MetricsData{HostName: "host2", Timestamp: 1000 + db.MetricsMaxLifetimeSeconds + 1, Metrics: map[string]float64{"val1": 211, "val2": 212}},
+		halib.MetricsData{HostName: "host2", Timestamp: 1000 + db.MetricsMaxLifetimeSeconds + 1, Metrics: map[string]float64{"val1": 221, "val2": 222}},
 	}
 
 	err = SaveMetrics(time.Unix(1000, 0), metricsData1)
@@ -232,21 +370,89 @@ func TestSaveMetrics4(t *testing.T) {
 	err = SaveMetrics(time.Unix(1000+db.MetricsMaxLifetimeSeconds+1, 0), metricsData2)
 	assert.Nil(t, err)
 
+	err = RetireMetrics(time.Unix(1000+db.MetricsMaxLifetimeSeconds+1, 0))
+	assert.Nil(t, err)
+
 	got := GetCollectedMetricsWithLimit(-1)
 	//metricsData1 must expired
 	assert.Equal(t, metricsData2, got)
 }
 
+func TestSaveMetrics5(t *testing.T) {
+	// saved under timestamp of each sample, not saved time
+	metricsData := []halib.MetricsData{
+		halib.MetricsData{HostName: "host1", Timestamp: 1003, Metrics: map[string]float64{"val1": 131}},
+		halib.MetricsData{HostName: "host1", Timestamp: 1001, Metrics: map[string]float64{"val1": 111}},
+	}
+
+	//cleanup
+	GetCollectedMetricsWithLimit(-1)
+
+	assert.Nil(t, SaveMetrics(time.Unix(1010, 0), metricsData))
+
+	got, lastKey, err := GetMetricsAfter(nil, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, metricsData[1:], got)
+	assert.Equal(t, "m-1001", string(lastKey))
+	got, lastKey, err = GetMetricsAfter(lastKey, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, metricsData[:1], got)
+	assert.Equal(t, "m-1003", string(lastKey))
+
+	GetCollectedMetricsWithLimit(-1)
+}
+
+func TestGetMetricsAfter1(t *testing.T) {
+	var err error
+	metricsData1 := []halib.MetricsData{
+		halib.MetricsData{HostName: "host1", Timestamp: 1001, Metrics: map[string]float64{"val1": 111, "val2": 112}},
+	}
+	metricsData2 := []halib.MetricsData{
+		halib.MetricsData{HostName: "host2", Timestamp: 1002, Metrics: map[string]float64{"val1": 211, "val2": 212}},
+	}
+
+	//cleanup
+	GetCollectedMetricsWithLimit(-1)
+
+	got, lastKey, err := GetMetricsAfter(nil, -1)
+	assert.Nil(t, err)
+	assert.Nil(t, got)
+	assert.Nil(t, lastKey)
+
+	err = SaveMetrics(time.Unix(1001, 0), metricsData1)
+	assert.Nil(t, err)
+	err = SaveMetrics(time.Unix(1002, 0), metricsData2)
+	assert.Nil(t, err)
+
+	got, lastKey, err = GetMetricsAfter(nil, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, metricsData1, got)
+	assert.Equal(t, "m-1001", string(lastKey))
+
+	got, lastKey, err = GetMetricsAfter(lastKey, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, metricsData2, got)
+	assert.Equal(t, "m-1002", string(lastKey))
+
+	got, lastKey, err = GetMetricsAfter(lastKey, -1)
+	assert.Nil(t, err)
+	assert.Nil(t, got)
+	assert.Nil(t, lastKey)
+
+	// not deleted
+	assert.Equal(t, append(metricsData1, metricsData2...), GetCollectedMetricsWithLimit(-1))
+}
+
 func TestGetMetricDataBufferStatus1(t *testing.T) {
 	var err error
 	var savedMetricData map[string]int64
 	metricsData1 := []halib.MetricsData{
-		halib.MetricsData{HostName: "host1", Timestamp: 101, Metrics: map[string]float64{"val1": 111, "val2": 112}},
-		halib.MetricsData{HostName: "host1", Timestamp: 102, Metrics: map[string]float64{"val1": 121, "val2": 122}},
+		halib.MetricsData{HostName: "host1", Timestamp: 1000, Metrics: map[string]float64{"val1": 111, "val2": 112}},
+		halib.MetricsData{HostName: "host1", Timestamp: 1000, Metrics: map[string]float64{"val1": 121, "val2": 122}},
 	}
 	metricsData2 := []halib.MetricsData{
-		halib.MetricsData{HostName: "host2", Timestamp: 101, Metrics: map[string]float64{"val1": 211, "val2": 212}},
-		halib.MetricsData{HostName: "host2", Timestamp: 102, Metrics: map[string]float64{"val1": 221, "val2": 222}},
+		halib.MetricsData{HostName: "host2", Timestamp: 1001, Metrics: map[string]float64{"val1": 211, "val2": 212}},
+		halib.MetricsData{HostName: "host2", Timestamp: 1001, Metrics: map[string]float64{"val1": 221, "val2": 222}},
 	}
 
 	//cleanup
@@ -301,7 +507,12 @@ func TestGetMetricDataBufferStatusPerformance(t *testing.T) {
 	//init
 	length := 3000
 	for i := 1; i <= length; i++ {
-		err = SaveMetrics(time.Unix(int64(i), 0), metricsData1)
+		metricsData := make([]halib.MetricsData, len(metricsData1))
+		for j, m := range metricsData1 {
+			m.Timestamp = int64(i)
+			metricsData[j] = m
+		}
+		err = SaveMetrics(time.Unix(int64(i), 0), metricsData)
 		assert.Nil(t, err)
 	}
 
@@ -0,0 +1,84 @@
+package collect
+
+import (
+	"bytes"
+	"encoding/gob"
+	"path"
+
+	"github.com/heartbeatsjp/happo-agent/db"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+	leveldbUtil "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// MetricQuery is filter of QueryMetrics. zero value means no filter
+type MetricQuery struct {
+	HostName string
+	// Key is glob pattern of metric key(e.g. `linux.cpu.*`)
+	Key   string
+	From  int64
+	To    int64
+	Limit int
+}
+
+// QueryMetrics returns buffered metrics matched with query, without deleting them.
+// returns max query.Limit MetricsData(when > 0)
+func QueryMetrics(query MetricQuery) ([]halib.MetricsData, error) {
+	log := util.HappoAgentLogger()
+	collectedMetricsData := []halib.MetricsData{}
+
+	if query.Key != "" {
+		if _, err := path.Match(query.Key, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	snapshot, err := db.DB.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snapshot.Release()
+
+	iter := snapshot.NewIterator(leveldbUtil.BytesPrefix([]byte("m-")), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		metricsData := []halib.MetricsData{}
+		dec := gob.NewDecoder(bytes.NewReader(iter.Value()))
+		if err := dec.Decode(&metricsData); err != nil {
+			log.Error(err)
+			continue
+		}
+
+		for _, m := range metricsData {
+			if query.HostName != "" && m.HostName != query.HostName {
+				continue
+			}
+			if (query.From > 0 && m.Timestamp < query.From) || (query.To > 0 && m.Timestamp > query.To) {
+				continue
+			}
+			if query.Key != "" {
+				metrics := map[string]float64{}
+				for key, value := range m.Metrics {
+					if matched, _ := path.Match(query.Key, key); matched {
+						metrics[key] = value
+					}
+				}
+				if len(metrics) == 0 {
+					continue
+				}
+				m.Metrics = metrics
+			}
+
+			collectedMetricsData = append(collectedMetricsData, m)
+			if query.Limit > 0 && len(collectedMetricsData) >= query.Limit {
+				return collectedMetricsData, nil
+			}
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	return collectedMetricsData, nil
+}
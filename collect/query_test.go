@@ -0,0 +1,54 @@
+package collect
+
+import (
+	"testing"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryMetrics1(t *testing.T) {
+	metricsData1 := []halib.MetricsData{
+		halib.MetricsData{HostName: "host1", Timestamp: 101, Metrics: map[string]float64{"linux.cpu.user": 1, "linux.load.one": 0.5}},
+		halib.MetricsData{HostName: "host2", Timestamp: 101, Metrics: map[string]float64{"linux.cpu.user": 2}},
+	}
+	metricsData2 := []halib.MetricsData{
+		halib.MetricsData{HostName: "host1", Timestamp: 102, Metrics: map[string]float64{"linux.cpu.user": 3, "linux.load.one": 0.6}},
+	}
+
+	//cleanup
+	GetCollectedMetricsWithLimit(-1)
+
+	got, err := QueryMetrics(MetricQuery{})
+	assert.Nil(t, err)
+	assert.Equal(t, []halib.MetricsData{}, got)
+
+	assert.Nil(t, SaveMetrics(time.Unix(1001, 0), metricsData1))
+	assert.Nil(t, SaveMetrics(time.Unix(1002, 0), metricsData2))
+
+	got, err = QueryMetrics(MetricQuery{})
+	assert.Nil(t, err)
+	assert.Equal(t, append(metricsData1, metricsData2...), got)
+
+	got, err = QueryMetrics(MetricQuery{HostName: "host1", Key: "linux.load.*"})
+	assert.Nil(t, err)
+	assert.Equal(t, []halib.MetricsData{
+		halib.MetricsData{HostName: "host1", Timestamp: 101, Metrics: map[string]float64{"linux.load.one": 0.5}},
+		halib.MetricsData{HostName: "host1", Timestamp: 102, Metrics: map[string]float64{"linux.load.one": 0.6}},
+	}, got)
+
+	got, err = QueryMetrics(MetricQuery{From: 102, To: 102})
+	assert.Nil(t, err)
+	assert.Equal(t, metricsData2, got)
+
+	got, err = QueryMetrics(MetricQuery{Limit: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, metricsData1, got)
+
+	_, err = QueryMetrics(MetricQuery{Key: "[linux"})
+	assert.NotNil(t, err)
+
+	// not deleted
+	assert.Equal(t, append(metricsData1, metricsData2...), GetCollectedMetricsWithLimit(-1))
+}
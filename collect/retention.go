@@ -0,0 +1,178 @@
+package collect
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/db"
+	"github.com/heartbeatsjp/happo-agent/util"
+	"github.com/syndtr/goleveldb/leveldb"
+	leveldbUtil "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// metricRetentionStatus is counters of RetireMetrics and RollupMetrics. included to /status response
+type metricRetentionStatus struct {
+	sync.Mutex
+	// bufferBytes is running total of key and value bytes of `m-` keys, counted up by first RetireMetrics
+	bufferBytes        int64
+	bufferBytesCounted bool
+	retiredKeys        int64
+	evictedKeys        int64
+	evictedBytes       int64
+	rolledUpKeys       int64
+	undecodableKeys    int64
+	compactions        int64
+	lastRunAt          int64
+}
+
+var retentionStatus = &metricRetentionStatus{}
+
+// RetireMetrics deletes buffered metrics older than db.MetricsMaxLifetimeSeconds,
+// then evicts oldest metrics until total size is under db.MetricsMaxBufferBytes (when > 0).
+// when purged keys >= db.MetricsCompactionMinPurgedKeys (when > 0), compacts `m-` range of leveldb.
+// total size is running counter, so only metrics to retire or evict are read
+func RetireMetrics(now time.Time) error {
+	log := util.HappoAgentLogger()
+
+	transaction, err := db.DB.OpenTransaction()
+	if err != nil {
+		return err
+	}
+
+	if err := countMetricBufferBytes(transaction); err != nil {
+		transaction.Discard()
+		return err
+	}
+	retentionStatus.Lock()
+	bufferBytes := retentionStatus.bufferBytes
+	retentionStatus.Unlock()
+
+	cursors := getSinkCursors(transaction)
+	var purgedKeys [][]byte
+
+	oldestThreshold := now.Add(time.Duration(-1*db.MetricsMaxLifetimeSeconds) * time.Second)
+
+	var retiredKeys, evictedKeys, evictedBytes, purgedBytes int64
+
+	// keys are sorted from oldest
+	iter := transaction.NewIterator(leveldbUtil.BytesPrefix([]byte("m-")), nil)
+	for iter.Next() {
+		key := append([]byte{}, iter.Key()...)
+		size := metricKeyBytes(iter.Key(), iter.Value())
+		if metricKeyTime(key).Before(oldestThreshold) {
+			transaction.Delete(key, nil)
+			retiredKeys++
+			purgedBytes += size
+			purgedKeys = append(purgedKeys, key)
+			log.Warn(fmt.Sprintf("retire old metrics: key=%v(%v)\n", string(key), metricKeyTime(key)))
+			continue
+		}
+		if db.MetricsMaxBufferBytes <= 0 || bufferBytes-purgedBytes <= db.MetricsMaxBufferBytes {
+			break
+		}
+		transaction.Delete(key, nil)
+		evictedKeys++
+		evictedBytes += size
+		purgedBytes += size
+		purgedKeys = append(purgedKeys, key)
+		log.Warn(fmt.Sprintf("evict metrics by buffer size: key=%v(%v), bytes=%d\n", string(key), metricKeyTime(key), size))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		transaction.Discard()
+		return err
+	}
+
+	addMetricBufferBytes(-purgedBytes)
+	if err := transaction.Commit(); err != nil {
+		addMetricBufferBytes(purgedBytes)
+		return err
+	}
+	countSkippedBySinks(cursors, purgedKeys)
+
+	compacted := false
+	if db.MetricsCompactionMinPurgedKeys > 0 && len(purgedKeys) >= db.MetricsCompactionMinPurgedKeys {
+		if err := db.DB.CompactRange(*leveldbUtil.BytesPrefix([]byte("m-"))); err != nil {
+			log.Error(fmt.Sprintf("failed to compact metrics: %s", err.Error()))
+		} else {
+			compacted = true
+		}
+	}
+
+	retentionStatus.Lock()
+	defer retentionStatus.Unlock()
+	retentionStatus.retiredKeys += retiredKeys
+	retentionStatus.evictedKeys += evictedKeys
+	retentionStatus.evictedBytes += evictedBytes
+	if compacted {
+		retentionStatus.compactions++
+	}
+	retentionStatus.lastRunAt = now.Unix()
+
+	return nil
+}
+
+// countMetricBufferBytes counts up total bytes of `m-` keys, only at first call.
+// called while transaction is open, so that no metrics are written while counting
+func countMetricBufferBytes(transaction *leveldb.Transaction) error {
+	retentionStatus.Lock()
+	counted := retentionStatus.bufferBytesCounted
+	retentionStatus.Unlock()
+	if counted {
+		return nil
+	}
+
+	var bufferBytes int64
+	iter := transaction.NewIterator(leveldbUtil.BytesPrefix([]byte("m-")), nil)
+	for iter.Next() {
+		bufferBytes += metricKeyBytes(iter.Key(), iter.Value())
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	retentionStatus.Lock()
+	defer retentionStatus.Unlock()
+	retentionStatus.bufferBytes = bufferBytes
+	retentionStatus.bufferBytesCounted = true
+	return nil
+}
+
+// addMetricBufferBytes adds delta to running total bytes of `m-` keys.
+// called while transaction writing `m-` keys is open, so that it is not interleaved with countMetricBufferBytes
+func addMetricBufferBytes(delta int64) {
+	retentionStatus.Lock()
+	defer retentionStatus.Unlock()
+	if retentionStatus.bufferBytesCounted {
+		retentionStatus.bufferBytes += delta
+	}
+}
+
+// metricKeyBytes returns bytes of `m-` key and its value, counted in buffer bytes
+func metricKeyBytes(key, value []byte) int64 {
+	return int64(len(key) + len(value))
+}
+
+// GetMetricRetentionStatus returns counters of metric retention
+func GetMetricRetentionStatus() map[string]int64 {
+	retentionStatus.Lock()
+	defer retentionStatus.Unlock()
+	return map[string]int64{
+		"buffer_bytes":     retentionStatus.bufferBytes,
+		"retired_keys":     retentionStatus.retiredKeys,
+		"evicted_keys":     retentionStatus.evictedKeys,
+		"evicted_bytes":    retentionStatus.evictedBytes,
+		"rolled_up_keys":   retentionStatus.rolledUpKeys,
+		"undecodable_keys": retentionStatus.undecodableKeys,
+		"compactions":      retentionStatus.compactions,
+		"last_run_at":      retentionStatus.lastRunAt,
+	}
+}
+
+// metricKeyTime returns time of `m-<unixtime>[-r<interval>]` key
+func metricKeyTime(key []byte) time.Time {
+	unixTime, _ := parseMetricKey(key)
+	return time.Unix(unixTime, 0)
+}
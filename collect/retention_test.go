@@ -0,0 +1,138 @@
+package collect
+
+import (
+	"testing"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/db"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/stretchr/testify/assert"
+	leveldbUtil "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+func TestRetireMetrics1(t *testing.T) {
+	metricsData1 := []halib.MetricsData{
+		halib.MetricsData{HostName: "host1", Timestamp: 1000, Metrics: map[string]float64{"val1": 111}},
+	}
+	metricsData2 := []halib.MetricsData{
+		halib.MetricsData{HostName: "host2", Timestamp: 1000 + db.MetricsMaxLifetimeSeconds + 1, Metrics: map[string]float64{"val1": 211}},
+	}
+
+	//cleanup
+	GetCollectedMetricsWithLimit(-1)
+	before := GetMetricRetentionStatus()
+
+	now := time.Unix(1000+db.MetricsMaxLifetimeSeconds+1, 0)
+	assert.Nil(t, SaveMetrics(time.Unix(1000, 0), metricsData1))
+	assert.Nil(t, SaveMetrics(now, metricsData2))
+
+	// saving does not retire
+	assert.Equal(t, int64(2), GetMetricDataBufferStatus(true)["length"])
+
+	assert.Nil(t, RetireMetrics(now))
+	got := GetCollectedMetricsWithLimit(-1)
+	assert.Equal(t, metricsData2, got)
+
+	after := GetMetricRetentionStatus()
+	assert.Equal(t, int64(1), after["retired_keys"]-before["retired_keys"])
+	assert.Equal(t, int64(0), after["evicted_keys"]-before["evicted_keys"])
+	assert.Equal(t, now.Unix(), after["last_run_at"])
+}
+
+func TestRetireMetrics2(t *testing.T) {
+	metricsData := []halib.MetricsData{
+		halib.MetricsData{HostName: "host1", Timestamp: 101, Metrics: map[string]float64{"val1": 111}},
+	}
+
+	//cleanup
+	GetCollectedMetricsWithLimit(-1)
+	before := GetMetricRetentionStatus()
+
+	defer func(maxBufferBytes int64, minPurgedKeys int) {
+		db.MetricsMaxBufferBytes = maxBufferBytes
+		db.MetricsCompactionMinPurgedKeys = minPurgedKeys
+	}(db.MetricsMaxBufferBytes, db.MetricsCompactionMinPurgedKeys)
+
+	for i := int64(0); i < 5; i++ {
+		metricsData[0].Timestamp = 1001 + i
+		assert.Nil(t, SaveMetrics(time.Unix(1001+i, 0), metricsData))
+	}
+	assert.Nil(t, RetireMetrics(time.Unix(1010, 0)))
+	bufferBytes := GetMetricRetentionStatus()["buffer_bytes"]
+	keyBytes := bufferBytes / 5
+
+	// keep newest 2 keys
+	db.MetricsMaxBufferBytes = keyBytes * 2
+	db.MetricsCompactionMinPurgedKeys = 3
+	assert.Nil(t, RetireMetrics(time.Unix(1010, 0)))
+
+	_, lastKey, err := GetMetricsAfter(nil, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, "m-1005", string(lastKey))
+	status := GetMetricDataBufferStatus(true)
+	assert.Equal(t, int64(2), status["length"])
+	assert.Equal(t, int64(1004), status["oldest_timestamp"])
+
+	after := GetMetricRetentionStatus()
+	assert.Equal(t, int64(3), after["evicted_keys"]-before["evicted_keys"])
+	assert.Equal(t, keyBytes*3, after["evicted_bytes"]-before["evicted_bytes"])
+	assert.Equal(t, keyBytes*2, after["buffer_bytes"])
+	assert.Equal(t, int64(1), after["compactions"]-before["compactions"])
+}
+
+func TestRetireMetrics3(t *testing.T) {
+	// running total of buffer bytes follows writes to metrics
+	//cleanup
+	GetCollectedMetricsWithLimit(-1)
+	assert.Nil(t, RetireMetrics(time.Unix(1010, 0)))
+	assert.Equal(t, int64(0), GetMetricRetentionStatus()["buffer_bytes"])
+
+	defer func(tiers []RollupTier) {
+		MetricsRollupTiers = tiers
+	}(MetricsRollupTiers)
+	MetricsRollupTiers = []RollupTier{
+		{After: 10 * time.Minute, Interval: 5 * time.Minute},
+	}
+
+	for _, ts := range []int64{1200, 1260, 1260, 2000, 2060} {
+		assert.Nil(t, SaveMetrics(time.Unix(ts, 0), []halib.MetricsData{
+			{HostName: "host1", Timestamp: ts, Metrics: map[string]float64{"val1": 1}},
+		}))
+	}
+	assert.Nil(t, RollupMetrics(time.Unix(2100, 0)))
+	_, batchID, err := GetCollectedMetricsWithLease(time.Unix(2100, 0), 1)
+	assert.Nil(t, err)
+	assert.Nil(t, AckCollectedMetrics(batchID))
+	GetCollectedMetricsWithLimit(1)
+
+	var bufferBytes int64
+	iter := db.DB.NewIterator(leveldbUtil.BytesPrefix([]byte("m-")), nil)
+	for iter.Next() {
+		bufferBytes += int64(len(iter.Key()) + len(iter.Value()))
+	}
+	iter.Release()
+	assert.NotEqual(t, int64(0), bufferBytes)
+	assert.Equal(t, bufferBytes, GetMetricRetentionStatus()["buffer_bytes"])
+
+	GetCollectedMetricsWithLimit(-1)
+	assert.Equal(t, int64(0), GetMetricRetentionStatus()["buffer_bytes"])
+}
+
+func TestRetireMetrics4(t *testing.T) {
+	// sample with truncated timestamp is clamped by default, not to block retirement
+	//cleanup
+	GetCollectedMetricsWithLimit(-1)
+
+	now := time.Unix(1500000000, 0)
+	assert.Nil(t, SaveMetrics(now, []halib.MetricsData{
+		{HostName: "host1", Timestamp: 999, Metrics: map[string]float64{"val1": 1}},
+	}))
+	assert.Nil(t, SaveMetrics(now.Add(60*time.Second), []halib.MetricsData{
+		{HostName: "host1", Timestamp: now.Unix() + 60, Metrics: map[string]float64{"val1": 2}},
+	}))
+
+	assert.Nil(t, RetireMetrics(now.Add(time.Duration(db.MetricsMaxLifetimeSeconds+30)*time.Second)))
+	got := GetCollectedMetricsWithLimit(-1)
+	assert.Equal(t, 1, len(got))
+	assert.Equal(t, float64(2), got[0].Metrics["val1"])
+}
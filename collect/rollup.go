@@ -0,0 +1,265 @@
+package collect
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/db"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+	"github.com/syndtr/goleveldb/leveldb"
+	leveldbUtil "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// RollupTier is rollup rule. metrics older than After are rolled up by Interval
+type RollupTier struct {
+	After    time.Duration
+	Interval time.Duration
+}
+
+var (
+	// MetricsRollupTiers is rollup tiers. sorted by After. when empty, rollup is disabled
+	MetricsRollupTiers []RollupTier
+)
+
+// ParseRollupTiers parses rollup tiers like `6h:5m,24h:1h`(`<after>:<interval>`, combined with `,`)
+func ParseRollupTiers(s string) ([]RollupTier, error) {
+	var tiers []RollupTier
+	if s == "" {
+		return tiers, nil
+	}
+
+	for _, t := range strings.Split(s, ",") {
+		items := strings.Split(strings.TrimSpace(t), ":")
+		if len(items) != 2 {
+			return nil, fmt.Errorf("invalid rollup tier: %s", t)
+		}
+		after, err := time.ParseDuration(items[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid rollup tier: %s: %s", t, err.Error())
+		}
+		interval, err := time.ParseDuration(items[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid rollup tier: %s: %s", t, err.Error())
+		}
+		if interval < time.Second || interval%time.Second != 0 {
+			return nil, fmt.Errorf("invalid rollup tier: %s: interval must be whole seconds", t)
+		}
+
+		if len(tiers) > 0 {
+			prev := tiers[len(tiers)-1]
+			if after <= prev.After {
+				return nil, fmt.Errorf("invalid rollup tier: %s: must be sorted by after", t)
+			}
+			if interval <= prev.Interval || interval%prev.Interval != 0 {
+				return nil, fmt.Errorf("invalid rollup tier: %s: interval must be multiple of previous interval", t)
+			}
+		}
+		tiers = append(tiers, RollupTier{After: after, Interval: interval})
+	}
+	return tiers, nil
+}
+
+// RollupMetrics rewrites buffered metrics older than After of each tier into `m-<bucket>-r<interval>` keys.
+// raw metrics are rolled up by first tier, and rolled up metrics are rolled up again by next tier.
+// metrics leased by /metric with require_ack are not rolled up or merged into until acked or expired,
+// and metrics are not rolled up until all metric sinks have forwarded them and rolled up key
+func RollupMetrics(now time.Time) error {
+	var rolledUpKeys int64
+	sourceInterval := int64(0) // raw metrics
+	for _, tier := range MetricsRollupTiers {
+		interval := int64(tier.Interval / time.Second)
+		n, err := rollupMetricsByTier(now, now.Add(-1*tier.After).Unix(), sourceInterval, interval)
+		if err != nil {
+			return err
+		}
+		rolledUpKeys += n
+		sourceInterval = interval
+	}
+
+	retentionStatus.Lock()
+	defer retentionStatus.Unlock()
+	retentionStatus.rolledUpKeys += rolledUpKeys
+
+	return nil
+}
+
+// rollupMetricsByTier rolls up keys of sourceInterval in buckets ended before threshold. returns number of rolled up keys
+func rollupMetricsByTier(now time.Time, threshold, sourceInterval, interval int64) (int64, error) {
+	log := util.HappoAgentLogger()
+
+	transaction, err := db.DB.OpenTransaction()
+	if err != nil {
+		return 0, err
+	}
+
+	leasedKeys, _ := getLeasedMetricKeys(transaction, now)
+	cursors := getSinkCursors(transaction)
+
+	var buckets []int64
+	bucketData := map[int64][]halib.MetricsData{}
+	bucketKeys := map[int64][][]byte{}
+	bucketBytes := map[int64]int64{}
+	unforwardedBuckets := map[int64]bool{}
+
+	iter := transaction.NewIterator(leveldbUtil.BytesPrefix([]byte("m-")), nil)
+	for iter.Next() {
+		timestamp, keyInterval := parseMetricKey(iter.Key())
+		if keyInterval != sourceInterval || leasedKeys[string(iter.Key())] {
+			continue
+		}
+		bucket := timestamp - timestamp%interval
+		if bucket+interval > threshold {
+			continue
+		}
+		if !passedBySinks(cursors, iter.Key()) {
+			// rolled up metrics of bucket would be forwarded again, or source metrics would never be forwarded
+			unforwardedBuckets[bucket] = true
+			continue
+		}
+
+		metricsData := []halib.MetricsData{}
+		dec := gob.NewDecoder(bytes.NewReader(iter.Value()))
+		if err := dec.Decode(&metricsData); err != nil {
+			log.Error(err)
+			continue
+		}
+		if _, ok := bucketData[bucket]; !ok {
+			buckets = append(buckets, bucket)
+		}
+		bucketData[bucket] = append(bucketData[bucket], metricsData...)
+		bucketKeys[bucket] = append(bucketKeys[bucket], append([]byte{}, iter.Key()...))
+		bucketBytes[bucket] += metricKeyBytes(iter.Key(), iter.Value())
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		transaction.Discard()
+		return 0, err
+	}
+
+	var rolledUpKeys, rolledUpBytes int64
+	for _, bucket := range buckets {
+		key := []byte(rollupMetricKey(bucket, interval))
+		if unforwardedBuckets[bucket] || !passedBySinks(cursors, key) {
+			continue
+		}
+		if leasedKeys[string(key)] {
+			// late metrics merged into leased key would be deleted by ack
+			continue
+		}
+		metricsData := bucketData[bucket]
+
+		// merge into already rolled up metrics (e.g. appended late)
+		got, err := transaction.Get(key, nil)
+		if err == nil {
+			rolledUpBytes += metricKeyBytes(key, got)
+			savedMetricsData := []halib.MetricsData{}
+			dec := gob.NewDecoder(bytes.NewReader(got))
+			if err := dec.Decode(&savedMetricsData); err != nil {
+				log.Error(err)
+			}
+			metricsData = append(savedMetricsData, metricsData...)
+		} else if err != leveldb.ErrNotFound {
+			transaction.Discard()
+			return 0, err
+		}
+
+		var b bytes.Buffer
+		enc := gob.NewEncoder(&b)
+		if err := enc.Encode(aggregateMetrics(bucket, interval, metricsData)); err != nil {
+			transaction.Discard()
+			return 0, err
+		}
+		transaction.Put(key, b.Bytes(), nil)
+		for _, sourceKey := range bucketKeys[bucket] {
+			transaction.Delete(sourceKey, nil)
+		}
+		rolledUpKeys += int64(len(bucketKeys[bucket]))
+		rolledUpBytes += bucketBytes[bucket] - metricKeyBytes(key, b.Bytes())
+	}
+
+	addMetricBufferBytes(-rolledUpBytes)
+	if err := transaction.Commit(); err != nil {
+		addMetricBufferBytes(rolledUpBytes)
+		return 0, err
+	}
+	return rolledUpKeys, nil
+}
+
+// aggregateMetrics summarizes metrics of each hostname into one rolled up MetricsData
+func aggregateMetrics(bucket, interval int64, metricsData []halib.MetricsData) []halib.MetricsData {
+	var hostnames []string
+	rollups := map[string]*halib.MetricsRollup{}
+	sums := map[string]map[string]float64{}
+
+	for _, m := range metricsData {
+		rollup, ok := rollups[m.HostName]
+		if !ok {
+			hostnames = append(hostnames, m.HostName)
+			rollup = &halib.MetricsRollup{
+				Interval: interval,
+				Count:    map[string]int64{},
+				Min:      map[string]float64{},
+				Max:      map[string]float64{},
+			}
+			rollups[m.HostName] = rollup
+			sums[m.HostName] = map[string]float64{}
+		}
+
+		for key, value := range m.Metrics {
+			count, min, max := int64(1), value, value
+			if m.Rollup != nil {
+				count, min, max = m.Rollup.Count[key], m.Rollup.Min[key], m.Rollup.Max[key]
+			}
+			if count <= 0 {
+				continue
+			}
+			if rollup.Count[key] == 0 || min < rollup.Min[key] {
+				rollup.Min[key] = min
+			}
+			if rollup.Count[key] == 0 || max > rollup.Max[key] {
+				rollup.Max[key] = max
+			}
+			rollup.Count[key] += count
+			sums[m.HostName][key] += value * float64(count)
+		}
+	}
+
+	var results []halib.MetricsData
+	for _, hostname := range hostnames {
+		rollup := rollups[hostname]
+		averages := map[string]float64{}
+		for key, sum := range sums[hostname] {
+			averages[key] = sum / float64(rollup.Count[key])
+		}
+		results = append(results, halib.MetricsData{
+			HostName:  hostname,
+			Timestamp: bucket,
+			Metrics:   averages,
+			Rollup:    rollup,
+		})
+	}
+	return results
+}
+
+func rollupMetricKey(bucket, interval int64) string {
+	return fmt.Sprintf("m-%d-r%d", bucket, interval)
+}
+
+// parseMetricKey returns timestamp and rollup interval(0 if raw metrics) of `m-<timestamp>[-r<interval>]` key
+func parseMetricKey(key []byte) (int64, int64) {
+	items := strings.SplitN(string(key), "-", 3)
+	if len(items) < 2 {
+		return 0, 0
+	}
+	timestamp, _ := strconv.ParseInt(items[1], 10, 64)
+	if len(items) < 3 {
+		return timestamp, 0
+	}
+	interval, _ := strconv.ParseInt(strings.TrimPrefix(items[2], "r"), 10, 64)
+	return timestamp, interval
+}
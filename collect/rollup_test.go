@@ -0,0 +1,207 @@
+package collect
+
+import (
+	"testing"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRollupTiers(t *testing.T) {
+	var cases = []struct {
+		name     string
+		input    string
+		expected []RollupTier
+		isNormal bool
+	}{
+		{"empty", "", nil, true},
+		{"single", "6h:5m", []RollupTier{{6 * time.Hour, 5 * time.Minute}}, true},
+		{"multi", "6h:5m, 24h:1h", []RollupTier{{6 * time.Hour, 5 * time.Minute}, {24 * time.Hour, time.Hour}}, true},
+		{"invalid format", "6h", nil, false},
+		{"invalid duration", "6h:5x", nil, false},
+		{"not whole seconds", "6h:1500ms", nil, false},
+		{"not sorted", "24h:1h,6h:5m", nil, false},
+		{"not multiple", "6h:5m,24h:7m", nil, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tiers, err := ParseRollupTiers(c.input)
+			if c.isNormal {
+				assert.Nil(t, err)
+				assert.Equal(t, c.expected, tiers)
+			} else {
+				assert.NotNil(t, err)
+			}
+		})
+	}
+}
+
+func TestRollupMetrics1(t *testing.T) {
+	//cleanup
+	GetCollectedMetricsWithLimit(-1)
+
+	defer func(tiers []RollupTier) {
+		MetricsRollupTiers = tiers
+	}(MetricsRollupTiers)
+	MetricsRollupTiers = []RollupTier{
+		{After: 10 * time.Minute, Interval: 5 * time.Minute},
+		{After: 30 * time.Minute, Interval: 10 * time.Minute},
+	}
+
+	// 1200-1499: bucket 1200(5m)
+	for i, v := range []float64{1, 2, 6} {
+		assert.Nil(t, SaveMetrics(time.Unix(int64(1200+60*i), 0), []halib.MetricsData{
+			{HostName: "host1", Timestamp: int64(1200 + 60*i), Metrics: map[string]float64{"val1": v}},
+		}))
+	}
+	// 1500-1799: bucket 1500(5m)
+	assert.Nil(t, SaveMetrics(time.Unix(1500, 0), []halib.MetricsData{
+		{HostName: "host1", Timestamp: 1500, Metrics: map[string]float64{"val1": 10}},
+		{HostName: "host2", Timestamp: 1500, Metrics: map[string]float64{"val1": 20}},
+	}))
+	// not old enough
+	assert.Nil(t, SaveMetrics(time.Unix(2000, 0), []halib.MetricsData{
+		{HostName: "host1", Timestamp: 2000, Metrics: map[string]float64{"val1": 100}},
+	}))
+
+	assert.Nil(t, RollupMetrics(time.Unix(2400, 0)))
+
+	got, _, err := GetMetricsAfter(nil, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, []halib.MetricsData{
+		{HostName: "host1", Timestamp: 1200, Metrics: map[string]float64{"val1": 3},
+			Rollup: &halib.MetricsRollup{Interval: 300, Count: map[string]int64{"val1": 3}, Min: map[string]float64{"val1": 1}, Max: map[string]float64{"val1": 6}}},
+		{HostName: "host1", Timestamp: 1500, Metrics: map[string]float64{"val1": 10},
+			Rollup: &halib.MetricsRollup{Interval: 300, Count: map[string]int64{"val1": 1}, Min: map[string]float64{"val1": 10}, Max: map[string]float64{"val1": 10}}},
+		{HostName: "host2", Timestamp: 1500, Metrics: map[string]float64{"val1": 20},
+			Rollup: &halib.MetricsRollup{Interval: 300, Count: map[string]int64{"val1": 1}, Min: map[string]float64{"val1": 20}, Max: map[string]float64{"val1": 20}}},
+		{HostName: "host1", Timestamp: 2000, Metrics: map[string]float64{"val1": 100}},
+	}, got)
+
+	status := GetMetricDataBufferStatus(true)
+	assert.Equal(t, int64(3), status["length"])
+	assert.Equal(t, int64(1200), status["oldest_timestamp"])
+	assert.Equal(t, int64(2000), status["newest_timestamp"])
+
+	// second tier: 5m rollups are rolled up again with weighted average
+	assert.Nil(t, RollupMetrics(time.Unix(4000, 0)))
+
+	got = GetCollectedMetricsWithLimit(-1)
+	assert.Equal(t, []halib.MetricsData{
+		{HostName: "host1", Timestamp: 1200, Metrics: map[string]float64{"val1": 4.75},
+			Rollup: &halib.MetricsRollup{Interval: 600, Count: map[string]int64{"val1": 4}, Min: map[string]float64{"val1": 1}, Max: map[string]float64{"val1": 10}}},
+		{HostName: "host2", Timestamp: 1200, Metrics: map[string]float64{"val1": 20},
+			Rollup: &halib.MetricsRollup{Interval: 600, Count: map[string]int64{"val1": 1}, Min: map[string]float64{"val1": 20}, Max: map[string]float64{"val1": 20}}},
+		// 10m bucket 1800-2399 is not old enough for second tier
+		{HostName: "host1", Timestamp: 1800, Metrics: map[string]float64{"val1": 100},
+			Rollup: &halib.MetricsRollup{Interval: 300, Count: map[string]int64{"val1": 1}, Min: map[string]float64{"val1": 100}, Max: map[string]float64{"val1": 100}}},
+	}, got)
+}
+
+func TestRollupMetrics2(t *testing.T) {
+	//cleanup
+	GetCollectedMetricsWithLimit(-1)
+
+	defer func(tiers []RollupTier) {
+		MetricsRollupTiers = tiers
+	}(MetricsRollupTiers)
+	MetricsRollupTiers = []RollupTier{
+		{After: 10 * time.Minute, Interval: 5 * time.Minute},
+	}
+
+	metricsData := []halib.MetricsData{
+		{HostName: "host1", Timestamp: 1200, Metrics: map[string]float64{"val1": 1}},
+	}
+	assert.Nil(t, SaveMetrics(time.Unix(1200, 0), metricsData))
+
+	// leased metrics are not rolled up
+	got, batchID, err := GetCollectedMetricsWithLease(time.Unix(2400, 0), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, metricsData, got)
+	assert.Nil(t, RollupMetrics(time.Unix(2400, 0)))
+	assert.Nil(t, AckCollectedMetrics(batchID))
+	assert.Nil(t, GetCollectedMetricsWithLimit(-1))
+}
+
+func TestRollupMetrics3(t *testing.T) {
+	// metrics are not rolled up until all sinks have forwarded them
+	//cleanup
+	GetCollectedMetricsWithLimit(-1)
+	defer RegisterSinkCursors(nil)
+
+	defer func(tiers []RollupTier) {
+		MetricsRollupTiers = tiers
+	}(MetricsRollupTiers)
+	MetricsRollupTiers = []RollupTier{
+		{After: 10 * time.Minute, Interval: 5 * time.Minute},
+	}
+
+	for _, ts := range []int64{1200, 1260, 1320, 1500} {
+		assert.Nil(t, SaveMetrics(time.Unix(ts, 0), []halib.MetricsData{
+			{HostName: "host1", Timestamp: ts, Metrics: map[string]float64{"val1": 1}},
+		}))
+	}
+
+	// sink have never forwarded
+	assert.Nil(t, RegisterSinkCursors([]string{"s1"}))
+	assert.Nil(t, RollupMetrics(time.Unix(2400, 0)))
+	assert.Equal(t, int64(4), GetMetricDataBufferStatus(true)["length"])
+
+	// bucket 1200 is forwarded partially
+	assert.Nil(t, AdvanceSinkCursor("s1", nil, []byte("m-1260")))
+	assert.Nil(t, RollupMetrics(time.Unix(2400, 0)))
+	assert.Equal(t, int64(4), GetMetricDataBufferStatus(true)["length"])
+
+	// bucket 1200 is forwarded. rolled up key of bucket 1500 would be after cursor
+	assert.Nil(t, AdvanceSinkCursor("s1", []byte("m-1260"), []byte("m-1500")))
+	assert.Nil(t, RollupMetrics(time.Unix(2400, 0)))
+	got, _, err := GetMetricsAfter(nil, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, []halib.MetricsData{
+		{HostName: "host1", Timestamp: 1200, Metrics: map[string]float64{"val1": 1},
+			Rollup: &halib.MetricsRollup{Interval: 300, Count: map[string]int64{"val1": 3}, Min: map[string]float64{"val1": 1}, Max: map[string]float64{"val1": 1}}},
+		{HostName: "host1", Timestamp: 1500, Metrics: map[string]float64{"val1": 1}},
+	}, got)
+
+	// rolled up key is not forwarded again
+	got, _, err = GetMetricsAfter([]byte("m-1500"), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(got))
+}
+
+func TestRollupMetrics4(t *testing.T) {
+	// late metrics are not merged into leased rolled up key
+	//cleanup
+	GetCollectedMetricsWithLimit(-1)
+
+	defer func(tiers []RollupTier) {
+		MetricsRollupTiers = tiers
+	}(MetricsRollupTiers)
+	MetricsRollupTiers = []RollupTier{
+		{After: 10 * time.Minute, Interval: 5 * time.Minute},
+	}
+
+	assert.Nil(t, SaveMetrics(time.Unix(1200, 0), []halib.MetricsData{
+		{HostName: "host1", Timestamp: 1200, Metrics: map[string]float64{"val1": 1}},
+	}))
+	assert.Nil(t, RollupMetrics(time.Unix(2400, 0)))
+	_, batchID, err := GetCollectedMetricsWithLease(time.Unix(2400, 0), -1)
+	assert.Nil(t, err)
+
+	// appended late into leased bucket
+	assert.Nil(t, SaveMetrics(time.Unix(2400, 0), []halib.MetricsData{
+		{HostName: "host1", Timestamp: 1260, Metrics: map[string]float64{"val1": 3}},
+	}))
+	assert.Nil(t, RollupMetrics(time.Unix(2400, 0)))
+	assert.Nil(t, AckCollectedMetrics(batchID))
+
+	// late metrics are kept, and rolled up after ack
+	assert.Nil(t, RollupMetrics(time.Unix(2400, 0)))
+	got := GetCollectedMetricsWithLimit(-1)
+	assert.Equal(t, []halib.MetricsData{
+		{HostName: "host1", Timestamp: 1200, Metrics: map[string]float64{"val1": 3},
+			Rollup: &halib.MetricsRollup{Interval: 300, Count: map[string]int64{"val1": 1}, Min: map[string]float64{"val1": 3}, Max: map[string]float64{"val1": 3}}},
+	}, got)
+}
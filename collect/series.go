@@ -0,0 +1,78 @@
+package collect
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+)
+
+// MetricSample is one value of metric series
+type MetricSample struct {
+	Timestamp int64
+	Value     float64
+}
+
+var (
+	// MetricSeriesCacheSeconds is seconds of recent metrics kept in memory for metric threshold check
+	MetricSeriesCacheSeconds int64 = halib.DefaultMetricSeriesCacheSeconds
+
+	// hostname -> metric key -> samples(sorted by Timestamp)
+	seriesCache     = map[string]map[string][]MetricSample{}
+	seriesCacheLock sync.RWMutex
+)
+
+// cacheMetricSeries saves metrics to in-memory series cache, and drops samples older than MetricSeriesCacheSeconds
+func cacheMetricSeries(now time.Time, metricsData []halib.MetricsData) {
+	if MetricSeriesCacheSeconds <= 0 {
+		return
+	}
+	oldest := now.Unix() - MetricSeriesCacheSeconds
+
+	seriesCacheLock.Lock()
+	defer seriesCacheLock.Unlock()
+
+	for _, m := range metricsData {
+		if m.Rollup != nil || m.Timestamp < oldest {
+			continue
+		}
+		hostSeries, ok := seriesCache[m.HostName]
+		if !ok {
+			hostSeries = map[string][]MetricSample{}
+			seriesCache[m.HostName] = hostSeries
+		}
+		for key, value := range m.Metrics {
+			samples := append(hostSeries[key], MetricSample{Timestamp: m.Timestamp, Value: value})
+			if len(samples) > 1 && samples[len(samples)-2].Timestamp > m.Timestamp {
+				// appended late
+				sort.SliceStable(samples, func(i, j int) bool { return samples[i].Timestamp < samples[j].Timestamp })
+			}
+			hostSeries[key] = samples
+		}
+	}
+
+	for hostname, hostSeries := range seriesCache {
+		for key, samples := range hostSeries {
+			i := sort.Search(len(samples), func(i int) bool { return samples[i].Timestamp >= oldest })
+			if i == len(samples) {
+				delete(hostSeries, key)
+			} else if i > 0 {
+				hostSeries[key] = append([]MetricSample{}, samples[i:]...)
+			}
+		}
+		if len(hostSeries) == 0 {
+			delete(seriesCache, hostname)
+		}
+	}
+}
+
+// GetMetricSeries returns cached samples of hostname and key with Timestamp >= since
+func GetMetricSeries(hostname, key string, since int64) []MetricSample {
+	seriesCacheLock.RLock()
+	defer seriesCacheLock.RUnlock()
+
+	samples := seriesCache[hostname][key]
+	i := sort.Search(len(samples), func(i int) bool { return samples[i].Timestamp >= since })
+	return append([]MetricSample{}, samples[i:]...)
+}
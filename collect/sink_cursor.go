@@ -0,0 +1,211 @@
+package collect
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/heartbeatsjp/happo-agent/db"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	leveldbUtil "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// cursors of metric sinks are saved as `c-<sink name>`. value is last forwarded `m-` key,
+// or empty when sink have never forwarded
+
+// metricSinkStatus is counters of keys around sink cursors. included to /status response
+type metricSinkStatus struct {
+	sync.Mutex
+	skippedKeys map[string]int64
+	rewoundKeys map[string]int64
+}
+
+var sinkStatus = &metricSinkStatus{
+	skippedKeys: map[string]int64{},
+	rewoundKeys: map[string]int64{},
+}
+
+// metricIteratorSource is leveldb.DB, leveldb.Snapshot or leveldb.Transaction
+type metricIteratorSource interface {
+	NewIterator(slice *leveldbUtil.Range, ro *opt.ReadOptions) iterator.Iterator
+}
+
+// SinkCursorKey returns key of cursor of sink
+func SinkCursorKey(name string) []byte {
+	return []byte(fmt.Sprintf("c-%s", name))
+}
+
+// RegisterSinkCursors saves empty cursor of each sink which have no cursor yet, and deletes cursor of sink not in names.
+// so that buffered metrics are not rolled up before forwarded by newly configured sink
+func RegisterSinkCursors(names []string) error {
+	transaction, err := db.DB.OpenTransaction()
+	if err != nil {
+		return err
+	}
+
+	cursors := getSinkCursors(transaction)
+	registered := map[string]bool{}
+	for _, name := range names {
+		registered[name] = true
+		if _, ok := cursors[name]; !ok {
+			transaction.Put(SinkCursorKey(name), []byte{}, nil)
+		}
+	}
+	for name := range cursors {
+		if !registered[name] {
+			transaction.Delete(SinkCursorKey(name), nil)
+		}
+	}
+
+	return transaction.Commit()
+}
+
+// GetSinkCursor returns last forwarded key of sink. returns nil if sink have never forwarded
+func GetSinkCursor(name string) ([]byte, error) {
+	cursor, err := db.DB.Get(SinkCursorKey(name), nil)
+	if err == leveldb.ErrNotFound || len(cursor) == 0 {
+		return nil, nil
+	}
+	return cursor, err
+}
+
+// AdvanceSinkCursor moves cursor of sink from `from` to `to`.
+// if cursor was rewound by SaveMetrics after `from` is read, cursor is kept to forward rewound keys
+func AdvanceSinkCursor(name string, from, to []byte) error {
+	transaction, err := db.DB.OpenTransaction()
+	if err != nil {
+		return err
+	}
+
+	cursor, err := transaction.Get(SinkCursorKey(name), nil)
+	if err != nil && err != leveldb.ErrNotFound {
+		transaction.Discard()
+		return err
+	}
+	if !bytes.Equal(cursor, from) {
+		transaction.Discard()
+		return nil
+	}
+
+	transaction.Put(SinkCursorKey(name), to, nil)
+	return transaction.Commit()
+}
+
+// getSinkCursors returns cursor of each sink. cursor is nil if sink have never forwarded
+func getSinkCursors(source metricIteratorSource) map[string][]byte {
+	cursors := map[string][]byte{}
+	iter := source.NewIterator(leveldbUtil.BytesPrefix([]byte("c-")), nil)
+	for iter.Next() {
+		name := strings.TrimPrefix(string(iter.Key()), "c-")
+		var cursor []byte
+		if len(iter.Value()) > 0 {
+			cursor = append([]byte{}, iter.Value()...)
+		}
+		cursors[name] = cursor
+	}
+	iter.Release()
+	return cursors
+}
+
+// passedBySinks returns true if key have been forwarded by all sinks
+func passedBySinks(cursors map[string][]byte, key []byte) bool {
+	for _, cursor := range cursors {
+		if cursor == nil || bytes.Compare(key, cursor) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// countSkippedBySinks counts key deleted before forwarded, for each sink
+func countSkippedBySinks(cursors map[string][]byte, keys [][]byte) {
+	skipped := map[string]int64{}
+	for name, cursor := range cursors {
+		for _, key := range keys {
+			if cursor == nil || bytes.Compare(key, cursor) > 0 {
+				skipped[name]++
+			}
+		}
+	}
+	if len(skipped) == 0 {
+		return
+	}
+
+	sinkStatus.Lock()
+	defer sinkStatus.Unlock()
+	for name, n := range skipped {
+		sinkStatus.skippedKeys[name] += n
+	}
+}
+
+// rewindSinkCursors moves cursor of sink which have passed keys, to just before the oldest of them.
+// so that metrics saved with past timestamp are forwarded too
+func rewindSinkCursors(transaction *leveldb.Transaction, keys [][]byte) error {
+	rewound := map[string]int64{}
+	for name, cursor := range getSinkCursors(transaction) {
+		var oldest []byte
+		for _, key := range keys {
+			if cursor == nil || bytes.Compare(key, cursor) > 0 {
+				continue
+			}
+			rewound[name]++
+			if oldest == nil || bytes.Compare(key, oldest) < 0 {
+				oldest = key
+			}
+		}
+		if oldest == nil {
+			continue
+		}
+
+		iter := transaction.NewIterator(leveldbUtil.BytesPrefix([]byte("m-")), nil)
+		found := false
+		if iter.Seek(oldest) {
+			found = iter.Prev()
+		} else {
+			found = iter.Last()
+		}
+		var prev []byte
+		if found {
+			prev = append([]byte{}, iter.Key()...)
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return err
+		}
+		transaction.Put(SinkCursorKey(name), prev, nil)
+	}
+	if len(rewound) == 0 {
+		return nil
+	}
+
+	sinkStatus.Lock()
+	defer sinkStatus.Unlock()
+	for name, n := range rewound {
+		sinkStatus.rewoundKeys[name] += n
+	}
+	return nil
+}
+
+// GetMetricSinkStatus returns counters of each sink
+func GetMetricSinkStatus() map[string]map[string]int64 {
+	cursors := getSinkCursors(db.DB)
+
+	sinkStatus.Lock()
+	defer sinkStatus.Unlock()
+	status := map[string]map[string]int64{}
+	for name, cursor := range cursors {
+		var cursorTimestamp int64
+		if cursor != nil {
+			cursorTimestamp, _ = parseMetricKey(cursor)
+		}
+		status[name] = map[string]int64{
+			"cursor_timestamp": cursorTimestamp,
+			"skipped_keys":     sinkStatus.skippedKeys[name],
+			"rewound_keys":     sinkStatus.rewoundKeys[name],
+		}
+	}
+	return status
+}
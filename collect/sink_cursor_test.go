@@ -0,0 +1,119 @@
+package collect
+
+import (
+	"testing"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterSinkCursors1(t *testing.T) {
+	defer RegisterSinkCursors(nil)
+
+	assert.Nil(t, RegisterSinkCursors([]string{"s1", "s2"}))
+	assert.Nil(t, AdvanceSinkCursor("s1", nil, []byte("m-1001")))
+
+	// registered again: cursor is kept
+	assert.Nil(t, RegisterSinkCursors([]string{"s1"}))
+	cursor, err := GetSinkCursor("s1")
+	assert.Nil(t, err)
+	assert.Equal(t, "m-1001", string(cursor))
+
+	// removed from config
+	status := GetMetricSinkStatus()
+	assert.Equal(t, 1, len(status))
+	assert.Equal(t, int64(1001), status["s1"]["cursor_timestamp"])
+}
+
+func TestAdvanceSinkCursor1(t *testing.T) {
+	defer RegisterSinkCursors(nil)
+	assert.Nil(t, RegisterSinkCursors([]string{"s1"}))
+
+	assert.Nil(t, AdvanceSinkCursor("s1", nil, []byte("m-1002")))
+	// cursor was moved after read: kept
+	assert.Nil(t, AdvanceSinkCursor("s1", []byte("m-1001"), []byte("m-1003")))
+	cursor, err := GetSinkCursor("s1")
+	assert.Nil(t, err)
+	assert.Equal(t, "m-1002", string(cursor))
+}
+
+func TestSaveMetricsBeforeSinkCursor1(t *testing.T) {
+	//cleanup
+	GetCollectedMetricsWithLimit(-1)
+	defer RegisterSinkCursors(nil)
+	assert.Nil(t, RegisterSinkCursors([]string{"s1", "s2"}))
+
+	for _, ts := range []int64{1001, 1003} {
+		assert.Nil(t, SaveMetrics(time.Unix(ts, 0), []halib.MetricsData{
+			{HostName: "host1", Timestamp: ts, Metrics: map[string]float64{"val1": 1}},
+		}))
+	}
+	assert.Nil(t, AdvanceSinkCursor("s1", nil, []byte("m-1003")))
+	assert.Nil(t, AdvanceSinkCursor("s2", nil, []byte("m-1001")))
+
+	// saved with past timestamp: s1 is rewound, s2 is not
+	assert.Nil(t, SaveMetrics(time.Unix(1003, 0), []halib.MetricsData{
+		{HostName: "host1", Timestamp: 1002, Metrics: map[string]float64{"val1": 2}},
+	}))
+	cursor, _ := GetSinkCursor("s1")
+	assert.Equal(t, "m-1001", string(cursor))
+	cursor, _ = GetSinkCursor("s2")
+	assert.Equal(t, "m-1001", string(cursor))
+
+	// before oldest key
+	assert.Nil(t, AdvanceSinkCursor("s1", []byte("m-1001"), []byte("m-1003")))
+	assert.Nil(t, SaveMetrics(time.Unix(1003, 0), []halib.MetricsData{
+		{HostName: "host1", Timestamp: 1000, Metrics: map[string]float64{"val1": 0}},
+	}))
+	cursor, _ = GetSinkCursor("s1")
+	assert.Nil(t, cursor)
+	cursor, _ = GetSinkCursor("s2")
+	assert.Nil(t, cursor)
+
+	status := GetMetricSinkStatus()
+	assert.Equal(t, int64(2), status["s1"]["rewound_keys"])
+	assert.Equal(t, int64(1), status["s2"]["rewound_keys"])
+
+	// not deleted by /metric before forwarded by all sinks
+	assert.Equal(t, 0, len(GetCollectedMetricsWithLimit(-1)))
+	assert.Nil(t, AdvanceSinkCursor("s1", nil, []byte("m-1003")))
+	assert.Equal(t, 0, len(GetCollectedMetricsWithLimit(-1)))
+	assert.Nil(t, AdvanceSinkCursor("s2", nil, []byte("m-1001")))
+	assert.Equal(t, 2, len(GetCollectedMetricsWithLimit(-1)))
+	assert.Nil(t, AdvanceSinkCursor("s2", []byte("m-1001"), []byte("m-1003")))
+	assert.Equal(t, 2, len(GetCollectedMetricsWithLimit(-1)))
+	assert.Equal(t, int64(0), GetMetricSinkStatus()["s2"]["skipped_keys"]-status["s2"]["skipped_keys"])
+}
+
+func TestGetCollectedMetricsWithLeaseBeforeSinkCursor1(t *testing.T) {
+	//cleanup
+	GetCollectedMetricsWithLimit(-1)
+	defer RegisterSinkCursors(nil)
+
+	for _, ts := range []int64{1001, 1002} {
+		assert.Nil(t, SaveMetrics(time.Unix(ts, 0), []halib.MetricsData{
+			{HostName: "host1", Timestamp: ts, Metrics: map[string]float64{"val1": 1}},
+		}))
+	}
+
+	// not leased before forwarded
+	assert.Nil(t, RegisterSinkCursors([]string{"s1"}))
+	assert.Nil(t, AdvanceSinkCursor("s1", nil, []byte("m-1001")))
+	got, batchID, err := GetCollectedMetricsWithLease(time.Unix(1100, 0), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(got))
+
+	// not deleted by ack when sink is added after leased
+	assert.Nil(t, RegisterSinkCursors([]string{"s1", "s2"}))
+	assert.Nil(t, AckCollectedMetrics(batchID))
+	assert.Equal(t, int64(2), GetMetricDataBufferStatus(true)["length"])
+
+	assert.Nil(t, AdvanceSinkCursor("s2", nil, []byte("m-1002")))
+	assert.Nil(t, AdvanceSinkCursor("s1", []byte("m-1001"), []byte("m-1002")))
+	got, batchID, err = GetCollectedMetricsWithLease(time.Unix(1100, 0), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(got))
+	assert.Nil(t, AckCollectedMetrics(batchID))
+	assert.Equal(t, int64(0), GetMetricDataBufferStatus(true)["length"])
+}
@@ -0,0 +1,324 @@
+package collect
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/db"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+	"github.com/syndtr/goleveldb/leveldb"
+	leveldbUtil "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var (
+	// MetricTextfileDir is directory of metric text files written by other processes(when empty, disable)
+	MetricTextfileDir string
+	// MetricTextfileStaleSeconds is seconds since last modified, after that metric text file is flagged as stale(when 0, disable)
+	MetricTextfileStaleSeconds int64 = halib.DefaultMetricTextfileStaleSeconds
+
+	textfileStatus = &metricTextfileStatus{}
+)
+
+// metricTextfileStatus is counters of CollectTextfileMetrics. included to /status response.
+// mtime of ingested file is saved as `f-<file path>`, so that files are not ingested again after restart
+type metricTextfileStatus struct {
+	sync.Mutex
+	files         int64
+	staleFiles    int64
+	errorFiles    int64
+	ingestedFiles int64
+	lastRunAt     int64
+}
+
+// CollectTextfileMetrics reads new or modified metric text files in MetricTextfileDir, and saves them as metrics.
+// timestamp of metrics is mtime of file
+func CollectTextfileMetrics(now time.Time) error {
+	if MetricTextfileDir == "" {
+		return nil
+	}
+
+	metricsData, ingested, err := readTextfileMetrics(MetricTextfileDir, now)
+	if err != nil {
+		return err
+	}
+	if len(metricsData) > 0 {
+		if err := SaveMetrics(now, metricsData); err != nil {
+			return err
+		}
+	}
+	// saved after metrics, so that files are ingested again when failed to save metrics
+	return db.DB.Write(ingested, nil)
+}
+
+// readTextfileMetrics returns metrics of files in dir which are not ingested yet,
+// and batch to save mtime of them(and to delete mtime of removed files)
+func readTextfileMetrics(dir string, now time.Time) ([]halib.MetricsData, *leveldb.Batch, error) {
+	log := util.HappoAgentLogger()
+
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ingestedMtimes := getTextfileIngestedMtimes()
+
+	textfileStatus.Lock()
+	defer textfileStatus.Unlock()
+
+	ingested := new(leveldb.Batch)
+
+	var metricsData []halib.MetricsData
+	var files, staleFiles, errorFiles int64
+	exists := map[string]bool{}
+	for _, fi := range fileInfos {
+		if !fi.Mode().IsRegular() || textfileFormat(fi.Name()) == "" {
+			continue
+		}
+		filePath := filepath.Join(dir, fi.Name())
+		exists[filePath] = true
+		files++
+
+		if MetricTextfileStaleSeconds > 0 && now.Sub(fi.ModTime()) > time.Duration(MetricTextfileStaleSeconds)*time.Second {
+			log.Warnf("metric text file is stale: %s (last modified at %s)", filePath, fi.ModTime().Format(time.RFC3339))
+			staleFiles++
+		}
+
+		if mtime, ok := ingestedMtimes[filePath]; ok && mtime == fi.ModTime().UnixNano() {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			log.Errorf("Fail to read metric text file: %s %s", filePath, err.Error())
+			errorFiles++
+			continue
+		}
+		hostname, metrics, err := parseTextfile(fi.Name(), content)
+		if err != nil {
+			log.Errorf("Fail to parse metric text file: %s %s", filePath, err.Error())
+			errorFiles++
+			continue
+		}
+		ingested.Put(textfileIngestedKey(filePath), []byte(strconv.FormatInt(fi.ModTime().UnixNano(), 10)))
+		textfileStatus.ingestedFiles++
+		if len(metrics) == 0 {
+			continue
+		}
+		metricsData = append(metricsData, halib.MetricsData{
+			HostName:  hostname,
+			Timestamp: fi.ModTime().Unix(),
+			Metrics:   metrics,
+		})
+	}
+
+	for filePath := range ingestedMtimes {
+		if !exists[filePath] {
+			ingested.Delete(textfileIngestedKey(filePath))
+		}
+	}
+	textfileStatus.files = files
+	textfileStatus.staleFiles = staleFiles
+	textfileStatus.errorFiles = errorFiles
+	textfileStatus.lastRunAt = now.Unix()
+
+	return metricsData, ingested, nil
+}
+
+func textfileIngestedKey(filePath string) []byte {
+	return []byte(fmt.Sprintf("f-%s", filePath))
+}
+
+// getTextfileIngestedMtimes returns mtime(unix nano) of ingested files by file path
+func getTextfileIngestedMtimes() map[string]int64 {
+	mtimes := map[string]int64{}
+	iter := db.DB.NewIterator(leveldbUtil.BytesPrefix([]byte("f-")), nil)
+	defer iter.Release()
+	for iter.Next() {
+		mtime, err := strconv.ParseInt(string(iter.Value()), 10, 64)
+		if err != nil {
+			continue
+		}
+		mtimes[strings.TrimPrefix(string(iter.Key()), "f-")] = mtime
+	}
+	return mtimes
+}
+
+// GetMetricTextfileStatus returns status of textfile collector
+func GetMetricTextfileStatus() map[string]int64 {
+	textfileStatus.Lock()
+	defer textfileStatus.Unlock()
+
+	return map[string]int64{
+		"files":          textfileStatus.files,
+		"stale_files":    textfileStatus.staleFiles,
+		"error_files":    textfileStatus.errorFiles,
+		"ingested_files": textfileStatus.ingestedFiles,
+		"last_run_at":    textfileStatus.lastRunAt,
+	}
+}
+
+// textfileFormat returns format of metric text file by extension. returns "" when file is not metric text file
+func textfileFormat(name string) string {
+	switch filepath.Ext(name) {
+	case halib.MetricTextfileExtPrometheus:
+		return "prometheus"
+	case halib.MetricTextfileExtSensu, halib.MetricTextfileExtGraphite:
+		return "sensu"
+	default:
+		return ""
+	}
+}
+
+// parseTextfile parses metric text file. hostname is `# hostname: <hostname>` header, or file name without extension
+func parseTextfile(name string, content []byte) (string, map[string]float64, error) {
+	format := textfileFormat(name)
+	hostname := strings.TrimSuffix(name, filepath.Ext(name))
+	metrics := map[string]float64{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			header := strings.TrimSpace(strings.TrimPrefix(line, "#"))
+			if strings.HasPrefix(header, "hostname:") {
+				hostname = strings.TrimSpace(strings.TrimPrefix(header, "hostname:"))
+			}
+			continue
+		}
+
+		var key string
+		var value float64
+		var err error
+		if format == "prometheus" {
+			key, value, err = parsePrometheusLine(line)
+		} else {
+			key, value, err = parseSensuLine(line)
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("line %d: %s", lineNo, err.Error())
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		metrics[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return "", nil, err
+	}
+	if hostname == "" {
+		return "", nil, errors.New("hostname is empty")
+	}
+
+	return hostname, metrics, nil
+}
+
+// parseSensuLine parses sensu(graphite) style line `<key> <value> [<timestamp>]`. timestamp is ignored
+func parseSensuLine(line string) (string, float64, error) {
+	items := strings.Fields(line)
+	if len(items) != 2 && len(items) != 3 {
+		return "", 0, fmt.Errorf("invalid line: %s", line)
+	}
+	value, err := strconv.ParseFloat(items[1], 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid value: %s", line)
+	}
+	return items[0], value, nil
+}
+
+// parsePrometheusLine parses prometheus text format line `<name>[{<label>="<value>",...}] <value> [<timestamp>]`. timestamp is ignored.
+// key is name and label values joined with `.` in order of label name(e.g. `http_requests_total{method="get",code="200"}` -> `http_requests_total.200.get`)
+func parsePrometheusLine(line string) (string, float64, error) {
+	name := line
+	rest := ""
+	labels := map[string]string{}
+
+	if i := strings.IndexAny(line, "{ \t"); i >= 0 {
+		name, rest = line[:i], line[i:]
+	}
+	if name == "" {
+		return "", 0, fmt.Errorf("invalid line: %s", line)
+	}
+	if strings.HasPrefix(rest, "{") {
+		var err error
+		labels, rest, err = parsePrometheusLabels(rest[1:])
+		if err != nil {
+			return "", 0, fmt.Errorf("%s: %s", err.Error(), line)
+		}
+	}
+
+	items := strings.Fields(rest)
+	if len(items) != 1 && len(items) != 2 {
+		return "", 0, fmt.Errorf("invalid line: %s", line)
+	}
+	value, err := strconv.ParseFloat(items[0], 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid value: %s", line)
+	}
+
+	labelNames := []string{}
+	for labelName := range labels {
+		labelNames = append(labelNames, labelName)
+	}
+	sort.Strings(labelNames)
+	keys := []string{name}
+	for _, labelName := range labelNames {
+		keys = append(keys, strings.NewReplacer(".", "_", " ", "_").Replace(labels[labelName]))
+	}
+
+	return strings.Join(keys, "."), value, nil
+}
+
+// parsePrometheusLabels parses `<label>="<value>",...}` and returns labels and rest of line
+func parsePrometheusLabels(s string) (map[string]string, string, error) {
+	labels := map[string]string{}
+	for {
+		s = strings.TrimLeft(s, " ,")
+		if strings.HasPrefix(s, "}") {
+			return labels, s[1:], nil
+		}
+		i := strings.Index(s, "=\"")
+		if i <= 0 {
+			return nil, "", errors.New("invalid labels")
+		}
+		labelName := strings.TrimSpace(s[:i])
+		s = s[i+2:]
+
+		var value strings.Builder
+		closed := false
+		for j := 0; j < len(s); j++ {
+			if s[j] == '\\' && j+1 < len(s) {
+				j++
+				if s[j] == 'n' {
+					value.WriteByte('\n')
+				} else {
+					value.WriteByte(s[j])
+				}
+				continue
+			}
+			if s[j] == '"' {
+				s = s[j+1:]
+				closed = true
+				break
+			}
+			value.WriteByte(s[j])
+		}
+		if !closed {
+			return nil, "", errors.New("invalid labels")
+		}
+		labels[labelName] = value.String()
+	}
+}
@@ -0,0 +1,101 @@
+package collect
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTextfile(t *testing.T) {
+	hostname, metrics, err := parseTextfile("web01.sensu", []byte("backup.size 100 1505180794\nbackup.files\t3\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "web01", hostname)
+	assert.Equal(t, map[string]float64{"backup.size": 100, "backup.files": 3}, metrics)
+
+	content := `# hostname: db01
+# HELP http_requests_total total requests
+# TYPE http_requests_total counter
+http_requests_total{method="get",code="200"} 10
+http_requests_total{method="post",code="500",path="/a b.c\"d"} 2 1505180794000
+up 1
+temperature NaN
+`
+	hostname, metrics, err = parseTextfile("job.prom", []byte(content))
+	assert.Nil(t, err)
+	assert.Equal(t, "db01", hostname)
+	assert.Equal(t, map[string]float64{
+		"http_requests_total.200.get":            10,
+		"http_requests_total.500.post./a_b_c\"d": 2,
+		"up":                                     1,
+	}, metrics)
+
+	_, _, err = parseTextfile("web01.sensu", []byte("backup.size abc\n"))
+	assert.NotNil(t, err)
+	_, _, err = parseTextfile("web01.prom", []byte("up{job=\"a} 1\n"))
+	assert.NotNil(t, err)
+}
+
+func TestReadTextfileMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "happo-agent-textfile")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	mtime := now.Add(-10 * time.Second).Truncate(time.Second)
+	staleMtime := now.Add(-2 * time.Hour).Truncate(time.Second)
+	files := map[string]time.Time{
+		"web01.prom":  mtime,
+		"web02.sensu": staleMtime,
+		"web03.tmp":   mtime,
+	}
+	for name, t1 := range files {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte("up 1\n"), 0644))
+		assert.Nil(t, os.Chtimes(filepath.Join(dir, name), t1, t1))
+	}
+
+	metricsData, ingested, err := readTextfileMetrics(dir, now)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(metricsData))
+	assert.Nil(t, db.DB.Write(ingested, nil))
+	for _, m := range metricsData {
+		switch m.HostName {
+		case "web01":
+			assert.Equal(t, mtime.Unix(), m.Timestamp)
+		case "web02":
+			assert.Equal(t, staleMtime.Unix(), m.Timestamp)
+		default:
+			t.Errorf("unexpected hostname: %s", m.HostName)
+		}
+	}
+	status := GetMetricTextfileStatus()
+	assert.Equal(t, int64(2), status["files"])
+	assert.Equal(t, int64(1), status["stale_files"])
+
+	// not modified
+	metricsData, _, err = readTextfileMetrics(dir, now)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(metricsData))
+
+	// modified
+	assert.Nil(t, os.Chtimes(filepath.Join(dir, "web01.prom"), now, now))
+	metricsData, ingested, err = readTextfileMetrics(dir, now)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(metricsData))
+	assert.Equal(t, "web01", metricsData[0].HostName)
+	assert.Nil(t, db.DB.Write(ingested, nil))
+
+	// removed
+	assert.Nil(t, os.Remove(filepath.Join(dir, "web02.sensu")))
+	_, ingested, err = readTextfileMetrics(dir, now)
+	assert.Nil(t, err)
+	assert.Nil(t, db.DB.Write(ingested, nil))
+	assert.Equal(t, map[string]int64{filepath.Join(dir, "web01.prom"): now.UnixNano()}, getTextfileIngestedMtimes())
+
+	_, _, err = readTextfileMetrics(filepath.Join(dir, "notfound"), now)
+	assert.NotNil(t, err)
+}
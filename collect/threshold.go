@@ -0,0 +1,178 @@
+package collect
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+)
+
+// MetricThresholdPluginName is reserved plugin_name of /monitor. evaluates collected metrics against thresholds
+const MetricThresholdPluginName = BuiltinMetricPluginPrefix + "metric-threshold"
+
+// thresholdRange is nagios plugin style threshold range(e.g. `10`, `10:`, `~:10`, `10:20`, `@10:20`)
+type thresholdRange struct {
+	raw    string
+	start  float64
+	end    float64
+	inside bool
+}
+
+// parseThresholdRange parses nagios plugin style threshold range
+func parseThresholdRange(s string) (*thresholdRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+	r := &thresholdRange{raw: s, start: 0, end: math.Inf(1)}
+
+	v := s
+	if strings.HasPrefix(v, "@") {
+		r.inside = true
+		v = v[1:]
+	}
+	var err error
+	if i := strings.Index(v, ":"); i >= 0 {
+		if v[:i] == "~" {
+			r.start = math.Inf(-1)
+		} else if v[:i] != "" {
+			if r.start, err = strconv.ParseFloat(v[:i], 64); err != nil {
+				return nil, fmt.Errorf("invalid threshold: %s", s)
+			}
+		}
+		if v[i+1:] != "" {
+			if r.end, err = strconv.ParseFloat(v[i+1:], 64); err != nil {
+				return nil, fmt.Errorf("invalid threshold: %s", s)
+			}
+		}
+	} else {
+		if r.end, err = strconv.ParseFloat(v, 64); err != nil {
+			return nil, fmt.Errorf("invalid threshold: %s", s)
+		}
+	}
+	if r.start > r.end {
+		return nil, fmt.Errorf("invalid threshold: %s", s)
+	}
+	return r, nil
+}
+
+// alert returns true if value should be alerted
+func (r *thresholdRange) alert(value float64) bool {
+	if r == nil {
+		return false
+	}
+	outside := value < r.start || value > r.end
+	if r.inside {
+		return !outside
+	}
+	return outside
+}
+
+func (r *thresholdRange) String() string {
+	if r == nil {
+		return ""
+	}
+	return r.raw
+}
+
+// CheckMetricThreshold evaluates cached metric series by option, and returns nagios plugin style return value and message.
+// option is `-H <hostname> -k <metric key> [-f last|avg|min|max|rate] [-t <window seconds>] [-w <warning range>] [-c <critical range>]`
+func CheckMetricThreshold(option string, now time.Time) (int, string) {
+	fs := flag.NewFlagSet(MetricThresholdPluginName, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	hostname := fs.String("H", "", "hostname")
+	key := fs.String("k", "", "metric key")
+	function := fs.String("f", "last", "last, avg, min, max or rate")
+	window := fs.Int64("t", halib.DefaultMetricThresholdWindowSeconds, "window seconds")
+	warning := fs.String("w", "", "warning range")
+	critical := fs.String("c", "", "critical range")
+
+	unknown := func(err error) (int, string) {
+		return halib.MonitorUnknown, fmt.Sprintf("METRIC-THRESHOLD UNKNOWN - %s", err.Error())
+	}
+
+	if err := fs.Parse(strings.Fields(option)); err != nil {
+		return unknown(err)
+	}
+	if *hostname == "" || *key == "" {
+		return unknown(errors.New("-H and -k are required"))
+	}
+	switch *function {
+	case "last", "avg", "min", "max", "rate":
+	default:
+		return unknown(fmt.Errorf("unknown function: %s", *function))
+	}
+	if *window <= 0 {
+		return unknown(fmt.Errorf("invalid window: %d", *window))
+	}
+	warningRange, err := parseThresholdRange(*warning)
+	if err != nil {
+		return unknown(err)
+	}
+	criticalRange, err := parseThresholdRange(*critical)
+	if err != nil {
+		return unknown(err)
+	}
+
+	samples := GetMetricSeries(*hostname, *key, now.Unix()-*window)
+	value, err := aggregateSamples(*function, samples)
+	if err != nil {
+		return unknown(fmt.Errorf("%s %s: %s", *hostname, *key, err.Error()))
+	}
+
+	ret, status := halib.MonitorOK, "OK"
+	if criticalRange.alert(value) {
+		ret, status = halib.MonitorError, "CRITICAL"
+	} else if warningRange.alert(value) {
+		ret, status = halib.MonitorWarning, "WARNING"
+	}
+
+	message := fmt.Sprintf("METRIC-THRESHOLD %s - %s %s %s(%ds)=%v | '%s'=%v;%s;%s",
+		status, *hostname, *key, *function, *window, value,
+		*key, value, warningRange, criticalRange)
+	return ret, message
+}
+
+// aggregateSamples returns value of samples by function
+func aggregateSamples(function string, samples []MetricSample) (float64, error) {
+	if len(samples) == 0 {
+		return 0, errors.New("no data in window")
+	}
+
+	switch function {
+	case "last":
+		return samples[len(samples)-1].Value, nil
+	case "avg":
+		sum := float64(0)
+		for _, s := range samples {
+			sum += s.Value
+		}
+		return sum / float64(len(samples)), nil
+	case "min":
+		min := samples[0].Value
+		for _, s := range samples {
+			min = math.Min(min, s.Value)
+		}
+		return min, nil
+	case "max":
+		max := samples[0].Value
+		for _, s := range samples {
+			max = math.Max(max, s.Value)
+		}
+		return max, nil
+	case "rate":
+		// per second
+		first, last := samples[0], samples[len(samples)-1]
+		if last.Timestamp <= first.Timestamp {
+			return 0, errors.New("rate requires 2 or more samples in window")
+		}
+		return (last.Value - first.Value) / float64(last.Timestamp-first.Timestamp), nil
+	default:
+		return 0, fmt.Errorf("unknown function: %s", function)
+	}
+}
@@ -0,0 +1,93 @@
+package collect
+
+import (
+	"testing"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseThresholdRange(t *testing.T) {
+	var cases = []struct {
+		input    string
+		alerts   []float64
+		noAlerts []float64
+		isNormal bool
+	}{
+		{"10", []float64{-1, 11}, []float64{0, 10}, true},
+		{"10:", []float64{9}, []float64{10, 1000}, true},
+		{"~:10", []float64{11}, []float64{-1000, 10}, true},
+		{"10:20", []float64{9, 21}, []float64{10, 20}, true},
+		{"@10:20", []float64{10, 20}, []float64{9, 21}, true},
+		{"x", nil, nil, false},
+		{"20:10", nil, nil, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.input, func(t *testing.T) {
+			r, err := parseThresholdRange(c.input)
+			if !c.isNormal {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			for _, v := range c.alerts {
+				assert.True(t, r.alert(v), v)
+			}
+			for _, v := range c.noAlerts {
+				assert.False(t, r.alert(v), v)
+			}
+		})
+	}
+}
+
+func TestCheckMetricThreshold(t *testing.T) {
+	now := time.Unix(10000, 0)
+	cacheMetricSeries(now, []halib.MetricsData{
+		{HostName: "threshold-host", Timestamp: 9700, Metrics: map[string]float64{"load": 1, "bytes": 1000}},
+		{HostName: "threshold-host", Timestamp: 9880, Metrics: map[string]float64{"load": 4, "bytes": 7000}},
+		{HostName: "threshold-host", Timestamp: 9940, Metrics: map[string]float64{"load": 7, "bytes": 7600}},
+		// appended late
+		{HostName: "threshold-host", Timestamp: 9820, Metrics: map[string]float64{"load": 1, "bytes": 6400}},
+	})
+
+	var cases = []struct {
+		option   string
+		ret      int
+		expected string
+	}{
+		{"-H threshold-host -k load -w 5 -c 10", halib.MonitorWarning,
+			"METRIC-THRESHOLD WARNING - threshold-host load last(300s)=7 | 'load'=7;5;10"},
+		{"-H threshold-host -k load -f avg -t 200 -w 5 -c 10", halib.MonitorOK,
+			"METRIC-THRESHOLD OK - threshold-host load avg(200s)=4 | 'load'=4;5;10"},
+		{"-H threshold-host -k load -f max -t 600 -w 5 -c 6", halib.MonitorError,
+			"METRIC-THRESHOLD CRITICAL - threshold-host load max(600s)=7 | 'load'=7;5;6"},
+		{"-H threshold-host -k load -f min -t 600 -w 2:", halib.MonitorWarning,
+			"METRIC-THRESHOLD WARNING - threshold-host load min(600s)=1 | 'load'=1;2:;"},
+		{"-H threshold-host -k bytes -f rate -t 200 -c 20", halib.MonitorOK,
+			"METRIC-THRESHOLD OK - threshold-host bytes rate(200s)=10 | 'bytes'=10;;20"},
+		{"-H threshold-host -k load -t 10", halib.MonitorUnknown,
+			"METRIC-THRESHOLD UNKNOWN - threshold-host load: no data in window"},
+		{"-H threshold-host -k load -f rate -t 60 -c 20", halib.MonitorUnknown,
+			"METRIC-THRESHOLD UNKNOWN - threshold-host load: rate requires 2 or more samples in window"},
+		{"-H threshold-host -k load -f median", halib.MonitorUnknown,
+			"METRIC-THRESHOLD UNKNOWN - unknown function: median"},
+		{"-k load", halib.MonitorUnknown,
+			"METRIC-THRESHOLD UNKNOWN - -H and -k are required"},
+		{"-H threshold-host -k load -w x", halib.MonitorUnknown,
+			"METRIC-THRESHOLD UNKNOWN - invalid threshold: x"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.option, func(t *testing.T) {
+			ret, message := CheckMetricThreshold(c.option, now)
+			assert.Equal(t, c.ret, ret)
+			assert.Equal(t, c.expected, message)
+		})
+	}
+
+	// expired from cache
+	cacheMetricSeries(time.Unix(9700+MetricSeriesCacheSeconds+1, 0), nil)
+	assert.Equal(t, []MetricSample{{9820, 1}, {9880, 4}, {9940, 7}}, GetMetricSeries("threshold-host", "load", 0))
+}
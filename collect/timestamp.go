@@ -0,0 +1,112 @@
+package collect
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/db"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+)
+
+var (
+	// MetricsMaxFutureSeconds is max seconds of sample timestamp ahead of saved time(when 0, disable)
+	MetricsMaxFutureSeconds int64 = halib.DefaultMetricsMaxFutureSeconds
+	// MetricsMaxPastSeconds is max seconds of sample timestamp behind saved time(when 0, disable).
+	// samples are keyed by its timestamp, so too old(e.g. short) timestamp would be never retired
+	MetricsMaxPastSeconds = db.MetricsMaxLifetimeSeconds
+	// MetricsTimestampPolicy is handling of samples out of MetricsMaxFutureSeconds or MetricsMaxPastSeconds.
+	// `clamp` replaces timestamp with saved time, `reject` drops sample
+	MetricsTimestampPolicy = halib.MetricsTimestampPolicyClamp
+
+	timestampStatus = &metricTimestampStatus{}
+)
+
+// metricTimestampStatus is counters of checkMetricTimestamps. included to /status response
+type metricTimestampStatus struct {
+	sync.Mutex
+	futureClamped  int64
+	futureRejected int64
+	pastClamped    int64
+	pastRejected   int64
+}
+
+// ValidateMetricsTimestampPolicy returns error if policy is unknown
+func ValidateMetricsTimestampPolicy(policy string) error {
+	switch policy {
+	case halib.MetricsTimestampPolicyClamp, halib.MetricsTimestampPolicyReject:
+		return nil
+	default:
+		return fmt.Errorf("unknown metrics timestamp policy: %s", policy)
+	}
+}
+
+// checkMetricTimestamps clamps or rejects samples too far in the future or past from now by MetricsTimestampPolicy
+func checkMetricTimestamps(now time.Time, metricsData []halib.MetricsData) []halib.MetricsData {
+	log := util.HappoAgentLogger()
+
+	timestampStatus.Lock()
+	defer timestampStatus.Unlock()
+
+	checked := make([]halib.MetricsData, 0, len(metricsData))
+	for _, m := range metricsData {
+		future := MetricsMaxFutureSeconds > 0 && m.Timestamp > now.Unix()+MetricsMaxFutureSeconds
+		past := MetricsMaxPastSeconds > 0 && m.Timestamp < now.Unix()-MetricsMaxPastSeconds
+		if m.Rollup != nil || (!future && !past) {
+			checked = append(checked, m)
+			continue
+		}
+
+		log.Warnf("timestamp of metrics out of range: %s %d (%s)", m.HostName, m.Timestamp, MetricsTimestampPolicy)
+		if MetricsTimestampPolicy == halib.MetricsTimestampPolicyReject {
+			if future {
+				timestampStatus.futureRejected++
+			} else {
+				timestampStatus.pastRejected++
+			}
+			continue
+		}
+		if future {
+			timestampStatus.futureClamped++
+		} else {
+			timestampStatus.pastClamped++
+		}
+		m.Timestamp = now.Unix()
+		checked = append(checked, m)
+	}
+	return checked
+}
+
+// GetMetricTimestampStatus returns counters of samples out of timestamp range
+func GetMetricTimestampStatus() map[string]int64 {
+	timestampStatus.Lock()
+	defer timestampStatus.Unlock()
+
+	return map[string]int64{
+		"future_clamped":  timestampStatus.futureClamped,
+		"future_rejected": timestampStatus.futureRejected,
+		"past_clamped":    timestampStatus.pastClamped,
+		"past_rejected":   timestampStatus.pastRejected,
+	}
+}
+
+// MetricsDataByTimestamp returns MetricsData of hostname for each timestamp, ordered by timestamp
+func MetricsDataByTimestamp(hostname string, metrics map[int64]map[string]float64) []halib.MetricsData {
+	var timestamps []int64
+	for timestamp := range metrics {
+		timestamps = append(timestamps, timestamp)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	var metricsData []halib.MetricsData
+	for _, timestamp := range timestamps {
+		metricsData = append(metricsData, halib.MetricsData{
+			HostName:  hostname,
+			Timestamp: timestamp,
+			Metrics:   metrics[timestamp],
+		})
+	}
+	return metricsData
+}
@@ -0,0 +1,57 @@
+package collect
+
+import (
+	"testing"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckMetricTimestamps(t *testing.T) {
+	origFuture, origPast, origPolicy := MetricsMaxFutureSeconds, MetricsMaxPastSeconds, MetricsTimestampPolicy
+	defer func() {
+		MetricsMaxFutureSeconds, MetricsMaxPastSeconds, MetricsTimestampPolicy = origFuture, origPast, origPolicy
+	}()
+	MetricsMaxFutureSeconds = 300
+	MetricsMaxPastSeconds = 3600
+
+	now := time.Unix(10000, 0)
+	metricsData := []halib.MetricsData{
+		{HostName: "host1", Timestamp: 9000, Metrics: map[string]float64{"val1": 1}},
+		{HostName: "host1", Timestamp: 10300, Metrics: map[string]float64{"val1": 2}},
+		{HostName: "host1", Timestamp: 10301, Metrics: map[string]float64{"val1": 3}},
+		{HostName: "host1", Timestamp: 6399, Metrics: map[string]float64{"val1": 4}},
+		{HostName: "host1", Timestamp: 1000, Metrics: map[string]float64{"val1": 5}, Rollup: &halib.MetricsRollup{Interval: 300}},
+	}
+	before := GetMetricTimestampStatus()
+
+	MetricsTimestampPolicy = halib.MetricsTimestampPolicyClamp
+	got := checkMetricTimestamps(now, metricsData)
+	assert.Equal(t, []int64{9000, 10300, 10000, 10000, 1000}, []int64{got[0].Timestamp, got[1].Timestamp, got[2].Timestamp, got[3].Timestamp, got[4].Timestamp})
+	assert.Equal(t, int64(10301), metricsData[2].Timestamp)
+
+	MetricsTimestampPolicy = halib.MetricsTimestampPolicyReject
+	got = checkMetricTimestamps(now, metricsData)
+	assert.Equal(t, 3, len(got))
+	assert.Equal(t, float64(5), got[2].Metrics["val1"])
+
+	after := GetMetricTimestampStatus()
+	for _, key := range []string{"future_clamped", "future_rejected", "past_clamped", "past_rejected"} {
+		assert.Equal(t, before[key]+1, after[key], key)
+	}
+
+	assert.Nil(t, ValidateMetricsTimestampPolicy("reject"))
+	assert.NotNil(t, ValidateMetricsTimestampPolicy("drop"))
+}
+
+func TestMetricsDataByTimestamp(t *testing.T) {
+	got := MetricsDataByTimestamp("host1", map[int64]map[string]float64{
+		200: {"val1": 2},
+		100: {"val1": 1, "val2": 1},
+	})
+	assert.Equal(t, []halib.MetricsData{
+		{HostName: "host1", Timestamp: 100, Metrics: map[string]float64{"val1": 1, "val2": 1}},
+		{HostName: "host1", Timestamp: 200, Metrics: map[string]float64{"val1": 2}},
+	}, got)
+}
@@ -0,0 +1,224 @@
+package collect
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"math"
+	"regexp"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/db"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+	"github.com/syndtr/goleveldb/leveldb"
+	leveldbErrors "github.com/syndtr/goleveldb/leveldb/errors"
+	leveldbUtil "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// metricTransform is compiled halib.MetricTransformConfig
+type metricTransform struct {
+	config halib.MetricTransformConfig
+	drop   []*regexp.Regexp
+	rate   []*regexp.Regexp
+	scale  []*regexp.Regexp
+	rename []*regexp.Regexp
+}
+
+// transformState is previous value of rate transform. saved as `t-<hostname>\t<key>`
+type transformState struct {
+	Timestamp int64
+	Value     float64
+}
+
+// compileMetricTransforms compiles regexps of transform configs.
+// invalid transform is skipped and returned as error, so that other transforms and metrics are not affected
+func compileMetricTransforms(configs []halib.MetricTransformConfig) ([]*metricTransform, []error) {
+	compile := func(patterns []string) ([]*regexp.Regexp, error) {
+		var regexps []*regexp.Regexp
+		for _, pattern := range patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, err
+			}
+			regexps = append(regexps, re)
+		}
+		return regexps, nil
+	}
+
+	var transforms []*metricTransform
+	var errs []error
+	for _, config := range configs {
+		if config.PluginName == "" {
+			errs = append(errs, fmt.Errorf("transform: plugin_name is required"))
+			continue
+		}
+		if config.CounterBits != 0 && config.CounterBits != 32 && config.CounterBits != 64 {
+			errs = append(errs, fmt.Errorf("transform %s: counter_bits must be 32 or 64", config.PluginName))
+			continue
+		}
+
+		t := &metricTransform{config: config}
+		var err error
+		var scalePatterns, renamePatterns []string
+		for _, scale := range config.Scale {
+			scalePatterns = append(scalePatterns, scale.Match)
+		}
+		for _, rename := range config.Rename {
+			renamePatterns = append(renamePatterns, rename.Match)
+		}
+		for _, c := range []struct {
+			dst      *[]*regexp.Regexp
+			patterns []string
+		}{
+			{&t.drop, config.Drop},
+			{&t.rate, config.Rate},
+			{&t.scale, scalePatterns},
+			{&t.rename, renamePatterns},
+		} {
+			*c.dst, err = compile(c.patterns)
+			if err != nil {
+				break
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("transform %s: %s", config.PluginName, err.Error()))
+			continue
+		}
+		transforms = append(transforms, t)
+	}
+	return transforms, errs
+}
+
+// applyMetricTransforms applies transforms matched with hostname and pluginName to metrics
+func applyMetricTransforms(transforms []*metricTransform, hostname, pluginName string, timestamp int64, metrics map[string]float64) map[string]float64 {
+	for _, t := range transforms {
+		if t.config.PluginName != pluginName || (t.config.Hostname != "" && t.config.Hostname != hostname) {
+			continue
+		}
+		metrics = t.apply(hostname, timestamp, metrics)
+	}
+	return metrics
+}
+
+func (t *metricTransform) apply(hostname string, timestamp int64, metrics map[string]float64) map[string]float64 {
+	log := util.HappoAgentLogger()
+
+	rateBatch := new(leveldb.Batch)
+	transformed := map[string]float64{}
+	for key, value := range metrics {
+		if matchAny(t.drop, key) {
+			continue
+		}
+
+		if matchAny(t.rate, key) {
+			var ok bool
+			value, ok = t.rateOf(hostname, key, timestamp, value, rateBatch)
+			if !ok {
+				continue
+			}
+		}
+
+		for i, re := range t.scale {
+			if re.MatchString(key) {
+				value *= t.config.Scale[i].Factor
+			}
+		}
+
+		for i, re := range t.rename {
+			key = re.ReplaceAllString(key, t.config.Rename[i].Replace)
+		}
+
+		transformed[t.config.Prefix+key] = value
+	}
+
+	if rateBatch.Len() > 0 {
+		if err := db.DB.Write(rateBatch, nil); err != nil {
+			log.Error(err)
+		}
+	}
+	return transformed
+}
+
+// rateOf returns rate per second of counter from previous value saved in dbms.
+// returns false at first value, or when counter is reset
+func (t *metricTransform) rateOf(hostname, key string, timestamp int64, value float64, batch *leveldb.Batch) (float64, bool) {
+	log := util.HappoAgentLogger()
+
+	stateKey := transformStateKey(hostname, key)
+	var prev transformState
+	got, err := db.DB.Get(stateKey, nil)
+	if err != nil && err != leveldbErrors.ErrNotFound {
+		log.Error(err)
+	}
+	found := err == nil
+	if found {
+		if err := gob.NewDecoder(bytes.NewReader(got)).Decode(&prev); err != nil {
+			log.Error(err)
+			found = false
+		}
+	}
+
+	if found && timestamp <= prev.Timestamp {
+		// older sample(e.g. appended late) never overwrites newer state
+		return 0, false
+	}
+
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(transformState{Timestamp: timestamp, Value: value}); err != nil {
+		log.Error(err)
+	} else {
+		batch.Put(stateKey, b.Bytes())
+	}
+
+	if !found {
+		return 0, false
+	}
+
+	delta := value - prev.Value
+	if delta < 0 {
+		counterMax := math.Exp2(float64(t.config.CounterBits))
+		if t.config.CounterBits == 0 || prev.Value >= counterMax || prev.Value < counterMax/2 {
+			// reset
+			return 0, false
+		}
+		// wrapped
+		delta = counterMax - prev.Value + value
+	}
+	return delta / float64(timestamp-prev.Timestamp), true
+}
+
+func transformStateKey(hostname, key string) []byte {
+	return []byte(fmt.Sprintf("t-%s\t%s", hostname, key))
+}
+
+func matchAny(regexps []*regexp.Regexp, s string) bool {
+	for _, re := range regexps {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// RetireMetricTransformStates deletes previous values of rate transform older than db.MetricsMaxLifetimeSeconds
+func RetireMetricTransformStates(now time.Time) error {
+	log := util.HappoAgentLogger()
+
+	oldest := now.Unix() - db.MetricsMaxLifetimeSeconds
+	batch := new(leveldb.Batch)
+	iter := db.DB.NewIterator(leveldbUtil.BytesPrefix([]byte("t-")), nil)
+	for iter.Next() {
+		var state transformState
+		if err := gob.NewDecoder(bytes.NewReader(iter.Value())).Decode(&state); err != nil || state.Timestamp < oldest {
+			log.Debugf("retire transform state: %q", iter.Key())
+			batch.Delete(append([]byte{}, iter.Key()...))
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	return db.DB.Write(batch, nil)
+}
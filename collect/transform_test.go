@@ -0,0 +1,94 @@
+package collect
+
+import (
+	"testing"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/db"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyMetricTransforms(t *testing.T) {
+	transforms, errs := compileMetricTransforms([]halib.MetricTransformConfig{
+		{
+			PluginName:  "metrics-net.rb",
+			Drop:        []string{`\.lo\.`},
+			Rate:        []string{`_bytes$`},
+			CounterBits: 32,
+			Scale:       []halib.MetricTransformScale{{Match: `_bytes$`, Factor: 8}},
+			Rename:      []halib.MetricTransformRename{{Match: `_bytes$`, Replace: "_bits"}},
+			Prefix:      "app.",
+		},
+		{
+			PluginName: "metrics-net.rb",
+			Hostname:   "other",
+			Drop:       []string{`.*`},
+		},
+	})
+	assert.Empty(t, errs)
+
+	// first value of rate is dropped
+	got := applyMetricTransforms(transforms, "transform01", "metrics-net.rb", 1000, map[string]float64{
+		"net.eth0.rx_bytes":   1000,
+		"net.eth0.rx_packets": 10,
+		"net.lo.rx_bytes":     1000,
+	})
+	assert.Equal(t, map[string]float64{"app.net.eth0.rx_packets": 10}, got)
+
+	got = applyMetricTransforms(transforms, "transform01", "metrics-net.rb", 1060, map[string]float64{
+		"net.eth0.rx_bytes":   7000,
+		"net.eth0.rx_packets": 20,
+	})
+	assert.Equal(t, map[string]float64{"app.net.eth0.rx_bits": 800, "app.net.eth0.rx_packets": 20}, got)
+
+	// wrapped
+	got = applyMetricTransforms(transforms, "transform02", "metrics-net.rb", 1000, map[string]float64{"net.eth0.rx_bytes": 4294967000})
+	got = applyMetricTransforms(transforms, "transform02", "metrics-net.rb", 1010, map[string]float64{"net.eth0.rx_bytes": 104})
+	assert.Equal(t, map[string]float64{"app.net.eth0.rx_bits": 320}, got)
+
+	// reset
+	got = applyMetricTransforms(transforms, "transform03", "metrics-net.rb", 1000, map[string]float64{"net.eth0.rx_bytes": 1000})
+	got = applyMetricTransforms(transforms, "transform03", "metrics-net.rb", 1010, map[string]float64{"net.eth0.rx_bytes": 10})
+	assert.Equal(t, map[string]float64{}, got)
+	got = applyMetricTransforms(transforms, "transform03", "metrics-net.rb", 1020, map[string]float64{"net.eth0.rx_bytes": 20})
+	assert.Equal(t, map[string]float64{"app.net.eth0.rx_bits": 8}, got)
+
+	// older sample does not overwrite newer state
+	got = applyMetricTransforms(transforms, "transform04", "metrics-net.rb", 1010, map[string]float64{"net.eth0.rx_bytes": 2000})
+	got = applyMetricTransforms(transforms, "transform04", "metrics-net.rb", 1000, map[string]float64{"net.eth0.rx_bytes": 1000})
+	assert.Equal(t, map[string]float64{}, got)
+	got = applyMetricTransforms(transforms, "transform04", "metrics-net.rb", 1020, map[string]float64{"net.eth0.rx_bytes": 3000})
+	assert.Equal(t, map[string]float64{"app.net.eth0.rx_bits": 800}, got)
+
+	// hostname and plugin_name
+	got = applyMetricTransforms(transforms, "other", "metrics-net.rb", 1000, map[string]float64{"net.eth0.rx_packets": 10})
+	assert.Equal(t, map[string]float64{}, got)
+	got = applyMetricTransforms(transforms, "transform01", "metrics-cpu.rb", 1000, map[string]float64{"cpu.user": 10})
+	assert.Equal(t, map[string]float64{"cpu.user": 10}, got)
+
+	// retire
+	assert.Nil(t, RetireMetricTransformStates(time.Unix(1040+db.MetricsMaxLifetimeSeconds, 0)))
+	_, err := db.DB.Get(transformStateKey("transform01", "net.eth0.rx_bytes"), nil)
+	assert.Nil(t, err)
+	_, err = db.DB.Get(transformStateKey("transform02", "net.eth0.rx_bytes"), nil)
+	assert.NotNil(t, err)
+}
+
+func TestCompileMetricTransforms(t *testing.T) {
+	_, errs := compileMetricTransforms([]halib.MetricTransformConfig{{PluginName: "a", Drop: []string{"("}}})
+	assert.Equal(t, 1, len(errs))
+	_, errs = compileMetricTransforms([]halib.MetricTransformConfig{{PluginName: "a", CounterBits: 16}})
+	assert.Equal(t, 1, len(errs))
+	_, errs = compileMetricTransforms([]halib.MetricTransformConfig{{Drop: []string{"a"}}})
+	assert.Equal(t, 1, len(errs))
+
+	// only invalid transform is skipped
+	transforms, errs := compileMetricTransforms([]halib.MetricTransformConfig{
+		{PluginName: "a", Rename: []halib.MetricTransformRename{{Match: "(", Replace: "x"}}},
+		{PluginName: "b", Drop: []string{"^x"}},
+	})
+	assert.EqualError(t, errs[0], "transform a: error parsing regexp: missing closing ): `(`")
+	assert.Equal(t, 1, len(transforms))
+	assert.Equal(t, "b", transforms[0].config.PluginName)
+}
@@ -0,0 +1,99 @@
+package collect
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+)
+
+// ValidateMetricConfig resolves every plugin of config in SensuPluginPaths, without saving config.
+// with execute, executes each plugin once and reports exit code, parsed keys and parse error.
+// builtin plugins are not executed, because delta based collectors keep previous counters
+func ValidateMetricConfig(config halib.MetricConfig, execute bool) *halib.MetricConfigValidation {
+	validation := &halib.MetricConfigValidation{Plugins: []halib.MetricPluginValidation{}}
+
+	_, errs := compileMetricTransforms(config.Transforms)
+	for _, err := range errs {
+		validation.Errors = append(validation.Errors, err.Error())
+	}
+
+	for _, metricHostList := range config.Metrics {
+		if metricHostList.Hostname == "" {
+			validation.Errors = append(validation.Errors, "hostname is empty")
+		}
+		for _, metricPlugin := range metricHostList.Plugins {
+			result := validateMetricPlugin(metricPlugin.PluginName, metricPlugin.PluginOption, execute)
+			result.Hostname = metricHostList.Hostname
+			validation.Plugins = append(validation.Plugins, result)
+		}
+	}
+
+	validation.Valid = len(validation.Errors) == 0
+	for _, result := range validation.Plugins {
+		if result.Error != "" {
+			validation.Valid = false
+		}
+	}
+	return validation
+}
+
+func validateMetricPlugin(pluginName, pluginOption string, execute bool) halib.MetricPluginValidation {
+	result := halib.MetricPluginValidation{PluginName: pluginName, PluginOption: pluginOption}
+
+	if pluginName == "" {
+		result.Error = "plugin_name is empty"
+		return result
+	}
+
+	if IsBuiltinMetricPlugin(pluginName) {
+		result.Path = "builtin"
+		if _, _, err := parseBuiltinMetricPlugin(pluginName, pluginOption); err != nil {
+			result.Error = err.Error()
+		}
+		return result
+	}
+
+	plugin, err := findMetricPlugin(pluginName)
+	if err != nil {
+		result.Error = fmt.Sprintf("plugin not found: %s", pluginName)
+		return result
+	}
+	result.Path = plugin
+	if !execute {
+		return result
+	}
+
+	exitCode, stdout, stderr, err := util.ExecCommand(plugin, pluginOption)
+	result.Executed = true
+	result.ExitCode = exitCode
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if exitCode != 0 {
+		result.Error = fmt.Sprintf("exit status %d: %s", exitCode, stderr)
+		return result
+	}
+
+	timestampedMetricData, err := ParseTimestampedMetricData(stdout)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	keys := map[string]bool{}
+	for _, metricData := range timestampedMetricData {
+		for key := range metricData {
+			keys[key] = true
+		}
+	}
+	for key := range keys {
+		result.Keys = append(result.Keys, key)
+	}
+	sort.Strings(result.Keys)
+	if len(result.Keys) == 0 {
+		result.Error = "no metrics in output"
+	}
+	return result
+}
@@ -0,0 +1,61 @@
+package collect
+
+import (
+	"os"
+	"testing"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/stretchr/testify/assert"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestValidateMetricConfig(t *testing.T) {
+	wd, err := os.Getwd()
+	assert.Nil(t, err)
+	origPaths := SensuPluginPaths
+	SensuPluginPaths = wd
+	defer func() { SensuPluginPaths = origPaths }()
+
+	var config halib.MetricConfig
+	assert.Nil(t, yaml.Unmarshal([]byte(`
+metrics:
+  - hostname: localhost
+    plugins:
+    - plugin_name: metrics_test_plugin
+      plugin_option: "10"
+    - plugin_name: metrics_test_plugin
+      plugin_option: "abc"
+    - plugin_name: notfound_plugin
+      plugin_option: ""
+    - plugin_name: happo-agent:linux-load
+      plugin_option: "--unknown"
+transforms:
+  - plugin_name: metrics_test_plugin
+    drop: ["("]
+`), &config))
+
+	validation := ValidateMetricConfig(config, false)
+	assert.False(t, validation.Valid)
+	assert.Equal(t, 1, len(validation.Errors))
+	assert.Equal(t, 4, len(validation.Plugins))
+	assert.Equal(t, wd+"/metrics_test_plugin", validation.Plugins[0].Path)
+	assert.False(t, validation.Plugins[0].Executed)
+	assert.Equal(t, "", validation.Plugins[0].Error)
+	assert.Equal(t, "plugin not found: notfound_plugin", validation.Plugins[2].Error)
+	assert.Equal(t, "builtin", validation.Plugins[3].Path)
+	assert.NotEqual(t, "", validation.Plugins[3].Error)
+
+	validation = ValidateMetricConfig(config, true)
+	assert.True(t, validation.Plugins[0].Executed)
+	assert.Equal(t, 0, validation.Plugins[0].ExitCode)
+	assert.Equal(t, 1, len(validation.Plugins[0].Keys))
+	assert.Equal(t, "", validation.Plugins[0].Error)
+	assert.True(t, validation.Plugins[1].Executed)
+	assert.Contains(t, validation.Plugins[1].Error, "Failed to parse values")
+	assert.False(t, validation.Plugins[3].Executed)
+
+	config.Transforms = nil
+	config.Metrics[0].Plugins = config.Metrics[0].Plugins[:1]
+	validation = ValidateMetricConfig(config, true)
+	assert.True(t, validation.Valid)
+}
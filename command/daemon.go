@@ -9,6 +9,7 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"strings"
 	"syscall"
 	"time"
 
@@ -22,6 +23,8 @@ import (
 	"github.com/heartbeatsjp/happo-agent/db"
 	"github.com/heartbeatsjp/happo-agent/halib"
 	"github.com/heartbeatsjp/happo-agent/model"
+	"github.com/heartbeatsjp/happo-agent/sink"
+	"github.com/heartbeatsjp/happo-agent/statsd"
 	"github.com/heartbeatsjp/happo-agent/util"
 	"github.com/martini-contrib/binding"
 	"golang.org/x/net/netutil"
@@ -88,6 +91,10 @@ func CmdDaemon(c *cli.Context) {
 	}()
 
 	m := customClassic()
+	// Gzip before Renderer, since Renderer writes to http.ResponseWriter mapped at that time
+	if c.Bool("enable-gzip-middleware") {
+		m.Use(util.Gzip())
+	}
 	m.Use(render.Renderer())
 	m.Use(util.ACL(c.StringSlice("allowed-hosts")))
 	m.Use(
@@ -131,7 +138,23 @@ func CmdDaemon(c *cli.Context) {
 	db.Open(dbfile)
 	defer db.Close()
 	db.MetricsMaxLifetimeSeconds = c.Int64("metrics-max-lifetime-seconds")
+	db.MetricsMaxBufferBytes = c.Int64("metrics-max-buffer-bytes")
+	db.MetricsCompactionMinPurgedKeys = c.Int("metrics-compaction-min-purged-keys")
+	collect.MetricsRollupTiers, err = collect.ParseRollupTiers(c.String("metrics-rollup-tiers"))
+	if err != nil {
+		log.Fatal(err)
+	}
 	db.MachineStateMaxLifetimeSeconds = c.Int64("machine-state-max-lifetime-seconds")
+	collect.MetricAckLeaseSeconds = c.Int64("metric-ack-lease-seconds")
+	collect.MetricSeriesCacheSeconds = c.Int64("metric-series-cache-seconds")
+	collect.MetricsMaxFutureSeconds = c.Int64("metrics-max-future-seconds")
+	collect.MetricsMaxPastSeconds = c.Int64("metrics-max-past-seconds")
+	collect.MetricsTimestampPolicy = c.String("metrics-timestamp-policy")
+	if err := collect.ValidateMetricsTimestampPolicy(collect.MetricsTimestampPolicy); err != nil {
+		log.Fatal(err)
+	}
+	collect.MetricTextfileDir = c.String("metric-textfile-dir")
+	collect.MetricTextfileStaleSeconds = c.Int64("metric-textfile-stale-seconds")
 
 	isAutoScalingNode := c.Bool("enable-autoscaling-node")
 	if isAutoScalingNode {
@@ -176,11 +199,14 @@ func CmdDaemon(c *cli.Context) {
 
 		go func() {
 			time.Sleep(time.Duration(autoScalingJoinWaitSeconds) * time.Second)
-			metricConfig, err := autoscaling.JoinAutoScalingGroup(client, autoScalingBastionEndpoint)
+			metricConfig, alias, err := autoscaling.JoinAutoScalingGroup(client, autoScalingBastionEndpoint)
 			if err != nil {
 				log.Error(fmt.Sprintf("failed to join: %s", err.Error()))
 				return
 			}
+			if err := collect.SetMetricConfigAlias(alias); err != nil {
+				log.Error(fmt.Sprintf("failed to save alias: %s", err.Error()))
+			}
 			if err := collect.SaveMetricConfig(metricConfig, c.String("metric-config")); err != nil {
 				log.Error(fmt.Sprintf("failed to save metric config: %s", err.Error()))
 				return
@@ -190,6 +216,24 @@ func CmdDaemon(c *cli.Context) {
 	}
 
 	model.SetProxyTimeout(c.Int64("proxy-timeout-seconds"))
+	model.ProxyMaxIdleConnsPerHost = c.Int("proxy-max-idle-conns-per-host")
+	model.ProxyIdleConnTimeoutSeconds = c.Int64("proxy-idle-conn-timeout-seconds")
+	model.ProxyEnableHTTP2 = c.Bool("proxy-http2")
+	model.ProxyBreakerFailures = c.Int("proxy-breaker-failures")
+	model.ProxyBreakerOpenSeconds = c.Int64("proxy-breaker-open-seconds")
+	model.ProxyTraceName = c.String("proxy-trace-name")
+	model.ProxyMultiConcurrency = c.Int("proxy-multi-concurrency")
+	model.ProxyMultiMaxTargets = c.Int("proxy-multi-max-targets")
+	model.ProxyAllowedRoutes = strings.Split(c.String("proxy-allowed-routes"), ",")
+	model.ProxyMaxResponseBytes, err = model.ParseProxyMaxResponseBytes(c.String("proxy-max-response-bytes"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	model.TunnelTokens, err = model.ParseTunnelTokens(c.String("tunnel-tokens"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	model.TunnelReconnectSeconds = c.Int64("tunnel-reconnect-seconds")
 
 	model.AppVersion = c.App.Version
 	m.Get("/", func() string {
@@ -198,7 +242,12 @@ func CmdDaemon(c *cli.Context) {
 
 	util.CommandTimeout = time.Duration(c.Int("command-timeout"))
 	model.MetricConfigFile = c.String("metric-config")
+	model.MetricAppendAllowedHostnames = c.StringSlice("metric-append-allowed-hostnames")
+	model.MetricAppendMaxSamples = c.Int("metric-append-max-samples")
+	model.MetricAppendMaxKeys = c.Int("metric-append-max-keys")
 	model.AutoScalingConfigFile = c.String("autoscaling-config")
+	model.ReloadAutoScalingConfig()
+	model.WatchAutoScalingConfig(time.Duration(c.Int64("autoscaling-config-reload-seconds")) * time.Second)
 	if _, err := autoscaling.GetAutoScalingConfig(model.AutoScalingConfigFile); err == nil {
 		client, err := autoscaling.NewAWSClient()
 		if err == nil {
@@ -216,11 +265,18 @@ func CmdDaemon(c *cli.Context) {
 	collect.SensuPluginPaths = c.String("sensu-plugin-paths")
 
 	m.Post("/proxy", binding.Json(halib.ProxyRequest{}), model.Proxy)
+	m.Post("/proxy/multi", binding.Json(halib.ProxyMultiRequest{}), model.ProxyMulti)
+	m.Get("/tunnel", model.Tunnel)
 	m.Post("/inventory", binding.Json(halib.InventoryRequest{}), model.Inventory)
 	m.Post("/monitor", binding.Json(halib.MonitorRequest{}), model.Monitor)
 	m.Post("/metric", binding.Json(halib.MetricRequest{}), model.Metric)
+	m.Get("/metric/query", model.MetricQuery)
+	m.Post("/metric/ack", binding.Json(halib.MetricAckRequest{}), model.MetricAck)
 	m.Post("/metric/append", binding.Json(halib.MetricAppendRequest{}), model.MetricAppend)
+	m.Get("/metric/config", model.MetricConfig)
+	m.Post("/metric/config", binding.Json(halib.MetricConfigRequest{}), model.MetricConfig)
 	m.Post("/metric/config/update", binding.Json(halib.MetricConfigUpdateRequest{}), model.MetricConfigUpdate)
+	m.Post("/metric/config/validate", binding.Json(halib.MetricConfigValidateRequest{}), model.MetricConfigValidate)
 	if runtime.GOOS != "windows" {
 		m.Post("/autoscaling/refresh", binding.Json(halib.AutoScalingRefreshRequest{}), model.AutoScalingRefresh)
 		m.Post("/autoscaling/delete", binding.Json(halib.AutoScalingDeleteRequest{}), model.AutoScalingDelete)
@@ -267,6 +323,58 @@ func CmdDaemon(c *cli.Context) {
 		}
 	}()
 
+	// Reverse-connect tunnel to bastion
+	if endpoint := c.String("tunnel-bastion-endpoint"); endpoint != "" {
+		hostID := c.String("tunnel-host-id")
+		if hostID == "" {
+			hostID, _ = os.Hostname()
+		}
+		tlsConfig, err := model.NewTunnelTLSConfig(c.String("tunnel-bastion-ca-file"), c.String("tunnel-bastion-cert-sha256"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		go model.ServeTunnel(endpoint, hostID, c.String("tunnel-bastion-token"), tlsConfig, m)
+	}
+
+	if err := sink.Start(c.String("metric-sink-config")); err != nil {
+		log.Fatal(fmt.Sprintf("failed to start metric sink: %s", err.Error()))
+	}
+
+	statsdPercentiles, err := statsd.ParsePercentiles(c.String("statsd-percentiles"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = statsd.Start(statsd.Config{
+		Address:              c.String("statsd-address"),
+		Socket:               c.String("statsd-socket"),
+		Hostname:             c.String("statsd-hostname"),
+		FlushIntervalSeconds: c.Int64("statsd-flush-interval-seconds"),
+		Percentiles:          statsdPercentiles,
+	})
+	if err != nil {
+		log.Fatal(fmt.Sprintf("failed to start statsd listener: %s", err.Error()))
+	}
+
+	// Metric retention timer
+	go func() {
+		timeRetention := time.NewTicker(time.Duration(c.Int64("metrics-retention-interval-seconds")) * time.Second).C
+		for {
+			select {
+			case <-timeRetention:
+				now := time.Now()
+				if err := collect.RollupMetrics(now); err != nil {
+					log.Error(err)
+				}
+				if err := collect.RetireMetrics(now); err != nil {
+					log.Error(err)
+				}
+				if err := collect.RetireMetricTransformStates(now); err != nil {
+					log.Error(err)
+				}
+			}
+		}
+	}()
+
 	model.DisableCollectMetrics = c.Bool("disable-collect-metrics")
 	util.HappoAgentLogger().Debug("disable-collect-metrics: ", model.DisableCollectMetrics)
 
@@ -280,6 +388,10 @@ func CmdDaemon(c *cli.Context) {
 				if err != nil {
 					log.Error(err)
 				}
+				err = collect.CollectTextfileMetrics(time.Now())
+				if err != nil {
+					log.Error(err)
+				}
 			}
 		}
 	}
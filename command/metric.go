@@ -34,21 +34,16 @@ func CmdAppendMetric(c *cli.Context) error {
 		}
 	}
 
-	var metricsDataSlice []halib.MetricsData
 	read, err := ioutil.ReadAll(f)
 	if err != nil {
 		return err
 	}
-	metricData, timestamp, err := collect.ParseMetricData(string(read))
+	timestampedMetricData, err := collect.ParseTimestampedMetricData(string(read))
 	if err != nil {
 		return err
 	}
 
-	var m halib.MetricsData
-	m.HostName = hostname
-	m.Timestamp = timestamp
-	m.Metrics = metricData
-	metricsDataSlice = append(metricsDataSlice, m)
+	metricsDataSlice := collect.MetricsDataByTimestamp(hostname, timestampedMetricData)
 
 	if dryRun {
 		fmt.Println(metricsDataSlice)
@@ -69,9 +64,24 @@ func CmdAppendMetric(c *cli.Context) error {
 	if err != nil && resp == nil {
 		return err
 	}
+	var metricAppendResponse halib.MetricAppendResponse
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil {
+		json.Unmarshal(body, &metricAppendResponse)
+	}
+	for _, rejected := range metricAppendResponse.Rejected {
+		fmt.Fprintf(os.Stderr, "Rejected: %s %d %s\n", rejected.HostName, rejected.Timestamp, rejected.Reason)
+	}
 	if resp.StatusCode != http.StatusOK {
+		if metricAppendResponse.Message != "" {
+			return fmt.Errorf("%s: %s", resp.Status, metricAppendResponse.Message)
+		}
 		return errors.New(resp.Status)
 	}
+	if len(metricAppendResponse.Rejected) > 0 {
+		return errors.New(metricAppendResponse.Message)
+	}
 	fmt.Println("Success.")
 
 	return nil
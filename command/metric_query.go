@@ -0,0 +1,84 @@
+package command
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/codegangsta/cli"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+)
+
+// CmdMetricQuery implements subcommand `metric query`
+func CmdMetricQuery(c *cli.Context) error {
+	query := url.Values{}
+	for _, name := range []string{"hostname", "key"} {
+		if c.String(name) != "" {
+			query.Set(name, c.String(name))
+		}
+	}
+	for _, name := range []string{"from", "to", "limit"} {
+		if c.Int64(name) > 0 {
+			query.Set(name, strconv.FormatInt(c.Int64(name), 10))
+		}
+	}
+
+	out, err := queryMetrics(c.String("bastion-endpoint"), query, c.Bool("json"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	fmt.Print(out)
+	return nil
+}
+
+func queryMetrics(endpoint string, query url.Values, jsonOutput bool) (string, error) {
+	res, err := util.RequestToMetricQueryAPI(endpoint, query)
+	if err != nil {
+		return "", err
+	}
+
+	var metricQueryResponse halib.MetricQueryResponse
+	data, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(data, &metricQueryResponse); err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", res.Status, metricQueryResponse.Message)
+	}
+
+	if jsonOutput {
+		b, err := json.MarshalIndent(metricQueryResponse.MetricData, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(b) + "\n", nil
+	}
+
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "HOSTNAME\tTIMESTAMP\tKEY\tVALUE")
+	for _, m := range metricQueryResponse.MetricData {
+		var keys []string
+		for key := range m.Metrics {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%v\n", m.HostName, m.Timestamp, key, m.Metrics[key])
+		}
+	}
+	w.Flush()
+	return buf.String(), nil
+}
@@ -0,0 +1,55 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_queryMetrics(t *testing.T) {
+	var res halib.MetricQueryResponse
+	res.MetricData = []halib.MetricsData{
+		{HostName: "host1", Timestamp: 1001, Metrics: map[string]float64{"linux.load.one": 0.5, "linux.cpu.user": 1.5}},
+	}
+	b, err := json.Marshal(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotQuery url.Values
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				gotQuery = r.URL.Query()
+				if gotQuery.Get("key") == "[" {
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprintln(w, `{"metric_data":null,"message":"invalid key: ["}`)
+					return
+				}
+				fmt.Fprintln(w, string(b))
+			}))
+	defer ts.Close()
+
+	out, err := queryMetrics(ts.URL, url.Values{"hostname": []string{"host1"}}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "host1", gotQuery.Get("hostname"))
+	assert.Equal(t, `HOSTNAME  TIMESTAMP  KEY             VALUE
+host1     1001       linux.cpu.user  1.5
+host1     1001       linux.load.one  0.5
+`, out)
+
+	out, err = queryMetrics(ts.URL, url.Values{}, true)
+	assert.Nil(t, err)
+	var got []halib.MetricsData
+	assert.Nil(t, json.Unmarshal([]byte(out), &got))
+	assert.Equal(t, res.MetricData, got)
+
+	_, err = queryMetrics(ts.URL, url.Values{"key": []string{"["}}, false)
+	assert.NotNil(t, err)
+}
@@ -21,6 +21,24 @@ var GlobalFlags = []cli.Flag{
 		Usage:  "log level(debug|info|warn)",
 		EnvVar: "HAPPO_AGENT_LOG_LEVEL",
 	},
+	cli.StringFlag{
+		Name:   "outbound-proxy",
+		Value:  "",
+		Usage:  "Proxy of outbound connections(http://[user:pass@]host:port or socks5://[user:pass@]host:port. when empty, connect directly).",
+		EnvVar: "HAPPO_AGENT_OUTBOUND_PROXY",
+	},
+	cli.StringFlag{
+		Name:   "outbound-proxy-rules",
+		Value:  "",
+		Usage:  "Proxy of outbound connections for each destination(comma separated `<CIDR|IP|host|.domain>=<proxy URL>`). take precedence over --outbound-proxy.",
+		EnvVar: "HAPPO_AGENT_OUTBOUND_PROXY_RULES",
+	},
+	cli.StringFlag{
+		Name:   "outbound-no-proxy",
+		Value:  "",
+		Usage:  "Destinations of outbound connections connected directly(comma separated `<CIDR|IP|host|.domain>`).",
+		EnvVar: "HAPPO_AGENT_OUTBOUND_NO_PROXY",
+	},
 }
 
 var daemonFlags = []cli.Flag{
@@ -60,6 +78,18 @@ var daemonFlags = []cli.Flag{
 		Usage:  "AutoScaling config file path",
 		EnvVar: "HAPPO_AGENT_AUTOSCALING_CONFIG",
 	},
+	cli.Int64Flag{
+		Name:   "autoscaling-config-reload-seconds",
+		Value:  halib.DefaultAutoScalingConfigReloadSeconds,
+		Usage:  "Interval seconds to check change of autoscaling config and reload it(when 0, reload only by /autoscaling/config/update).",
+		EnvVar: "HAPPO_AGENT_AUTOSCALING_CONFIG_RELOAD_SECONDS",
+	},
+	cli.StringFlag{
+		Name:   "metric-sink-config",
+		Value:  halib.DefaultMetricSinkConfigPath,
+		Usage:  "Metric sink(push-mode metric forwarding) config file path",
+		EnvVar: "HAPPO_AGENT_METRIC_SINK_CONFIG",
+	},
 	cli.StringFlag{
 		Name:   "cpu-profile, C",
 		Value:  "",
@@ -96,18 +126,232 @@ var daemonFlags = []cli.Flag{
 		Usage:  "Metrics Max Lifetime Seconds.",
 		EnvVar: "HAPPO_AGENT_METRICS_MAX_LIFETIME_SECONDS",
 	},
+	cli.Int64Flag{
+		Name:   "metrics-max-buffer-bytes",
+		Value:  db.MetricsMaxBufferBytes,
+		Usage:  "Metrics Max Buffer Bytes. when exceeded, oldest metrics are evicted(when 0, unlimited).",
+		EnvVar: "HAPPO_AGENT_METRICS_MAX_BUFFER_BYTES",
+	},
+	cli.IntFlag{
+		Name:   "metrics-compaction-min-purged-keys",
+		Value:  db.MetricsCompactionMinPurgedKeys,
+		Usage:  "Compact metrics in dbfile when retired/evicted keys at once exceed this(when 0, disable compaction).",
+		EnvVar: "HAPPO_AGENT_METRICS_COMPACTION_MIN_PURGED_KEYS",
+	},
+	cli.Int64Flag{
+		Name:   "metrics-retention-interval-seconds",
+		Value:  halib.DefaultMetricsRetentionIntervalSeconds,
+		Usage:  "Interval Seconds of retiring/evicting buffered metrics.",
+		EnvVar: "HAPPO_AGENT_METRICS_RETENTION_INTERVAL_SECONDS",
+	},
+	cli.StringFlag{
+		Name:   "metrics-rollup-tiers",
+		Usage:  "Rollup tiers of buffered metrics. `<after>:<interval>` combined with `,` (e.g. 6h:5m,24h:1h). when empty, disable rollup.",
+		EnvVar: "HAPPO_AGENT_METRICS_ROLLUP_TIERS",
+	},
 	cli.Int64Flag{
 		Name:   "machine-state-max-lifetime-seconds",
 		Value:  db.MachineStateMaxLifetimeSeconds,
 		Usage:  "Machine State Max Lifetime Seconds.",
 		EnvVar: "HAPPO_AGENT_MACHINE_STATE_MAX_LIFETIME_SECONDS",
 	},
+	cli.Int64Flag{
+		Name:   "metric-ack-lease-seconds",
+		Value:  halib.DefaultMetricAckLeaseSeconds,
+		Usage:  "Seconds until metrics returned by /metric with require_ack are returned again if not acked.",
+		EnvVar: "HAPPO_AGENT_METRIC_ACK_LEASE_SECONDS",
+	},
+	cli.StringSliceFlag{
+		Name:   "metric-append-allowed-hostnames",
+		Value:  &cli.StringSlice{},
+		Usage:  "Hostname glob patterns accepted by /metric/append. aliases of autoscaling instances are also accepted (You can multiple define. when undefined, all hostnames)",
+		EnvVar: "HAPPO_AGENT_METRIC_APPEND_ALLOWED_HOSTNAMES",
+	},
+	cli.IntFlag{
+		Name:   "metric-append-max-samples",
+		Value:  halib.DefaultMetricAppendMaxSamples,
+		Usage:  "Max number of metric_data in one /metric/append request(when 0, unlimited).",
+		EnvVar: "HAPPO_AGENT_METRIC_APPEND_MAX_SAMPLES",
+	},
+	cli.IntFlag{
+		Name:   "metric-append-max-keys",
+		Value:  halib.DefaultMetricAppendMaxKeys,
+		Usage:  "Max number of metric keys in one /metric/append request(when 0, unlimited).",
+		EnvVar: "HAPPO_AGENT_METRIC_APPEND_MAX_KEYS",
+	},
+	cli.Int64Flag{
+		Name:   "metric-series-cache-seconds",
+		Value:  halib.DefaultMetricSeriesCacheSeconds,
+		Usage:  "Seconds of recent metrics kept in memory for happo-agent:metric-threshold check(when 0, disable).",
+		EnvVar: "HAPPO_AGENT_METRIC_SERIES_CACHE_SECONDS",
+	},
+	cli.Int64Flag{
+		Name:   "metrics-max-future-seconds",
+		Value:  halib.DefaultMetricsMaxFutureSeconds,
+		Usage:  "Max seconds of metric timestamp ahead of saved time(when 0, disable).",
+		EnvVar: "HAPPO_AGENT_METRICS_MAX_FUTURE_SECONDS",
+	},
+	cli.Int64Flag{
+		Name:   "metrics-max-past-seconds",
+		Value:  db.MetricsMaxLifetimeSeconds,
+		Usage:  "Max seconds of metric timestamp behind saved time(when 0, disable).",
+		EnvVar: "HAPPO_AGENT_METRICS_MAX_PAST_SECONDS",
+	},
+	cli.StringFlag{
+		Name:   "metrics-timestamp-policy",
+		Value:  halib.MetricsTimestampPolicyClamp,
+		Usage:  "Handling of metrics with timestamp out of range. clamp(replace with saved time) or reject.",
+		EnvVar: "HAPPO_AGENT_METRICS_TIMESTAMP_POLICY",
+	},
+	cli.StringFlag{
+		Name:   "metric-textfile-dir",
+		Value:  "",
+		Usage:  "Directory of metric text files(*.prom, *.sensu, *.graphite) written by other processes(when empty, disable).",
+		EnvVar: "HAPPO_AGENT_METRIC_TEXTFILE_DIR",
+	},
+	cli.Int64Flag{
+		Name:   "metric-textfile-stale-seconds",
+		Value:  halib.DefaultMetricTextfileStaleSeconds,
+		Usage:  "Seconds since last modified, after that metric text file is flagged as stale(when 0, disable).",
+		EnvVar: "HAPPO_AGENT_METRIC_TEXTFILE_STALE_SECONDS",
+	},
+	cli.StringFlag{
+		Name:   "statsd-address",
+		Value:  "",
+		Usage:  "UDP address of StatsD listener(e.g. :8125. when empty, disable).",
+		EnvVar: "HAPPO_AGENT_STATSD_ADDRESS",
+	},
+	cli.StringFlag{
+		Name:   "statsd-socket",
+		Value:  "",
+		Usage:  "Unix datagram socket path of StatsD listener(when empty, disable).",
+		EnvVar: "HAPPO_AGENT_STATSD_SOCKET",
+	},
+	cli.StringFlag{
+		Name:   "statsd-hostname",
+		Value:  "",
+		Usage:  "Hostname of metrics received by StatsD listener(when empty, hostname of this host).",
+		EnvVar: "HAPPO_AGENT_STATSD_HOSTNAME",
+	},
+	cli.Int64Flag{
+		Name:   "statsd-flush-interval-seconds",
+		Value:  halib.DefaultStatsDFlushIntervalSeconds,
+		Usage:  "Interval seconds of StatsD listener to save aggregated metrics.",
+		EnvVar: "HAPPO_AGENT_STATSD_FLUSH_INTERVAL_SECONDS",
+	},
+	cli.StringFlag{
+		Name:   "statsd-percentiles",
+		Value:  halib.DefaultStatsDPercentiles,
+		Usage:  "Percentiles of StatsD timers. combined with `,` (e.g. 90,99).",
+		EnvVar: "HAPPO_AGENT_STATSD_PERCENTILES",
+	},
 	cli.Int64Flag{
 		Name:   "proxy-timeout-seconds",
 		Value:  180,
 		Usage:  "/proxy timeout Seconds.",
 		EnvVar: "HAPPO_AGENT_PROXY_TIMEOUT_SECONDS",
 	},
+	cli.IntFlag{
+		Name:   "proxy-max-idle-conns-per-host",
+		Value:  halib.DefaultProxyMaxIdleConnsPerHost,
+		Usage:  "Max idle (keep-alive) connections kept for each next hop of /proxy.",
+		EnvVar: "HAPPO_AGENT_PROXY_MAX_IDLE_CONNS_PER_HOST",
+	},
+	cli.Int64Flag{
+		Name:   "proxy-idle-conn-timeout-seconds",
+		Value:  halib.DefaultProxyIdleConnTimeoutSeconds,
+		Usage:  "Seconds of idle connection to next hop of /proxy kept before closed.",
+		EnvVar: "HAPPO_AGENT_PROXY_IDLE_CONN_TIMEOUT_SECONDS",
+	},
+	cli.BoolFlag{
+		Name:   "proxy-http2",
+		Usage:  "Enable HTTP/2 to next hop of /proxy.",
+		EnvVar: "HAPPO_AGENT_PROXY_HTTP2",
+	},
+	cli.IntFlag{
+		Name:   "proxy-breaker-failures",
+		Value:  halib.DefaultProxyBreakerFailures,
+		Usage:  "Number of consecutive failures to next hop of /proxy which opens circuit(when 0, disable).",
+		EnvVar: "HAPPO_AGENT_PROXY_BREAKER_FAILURES",
+	},
+	cli.Int64Flag{
+		Name:   "proxy-breaker-open-seconds",
+		Value:  halib.DefaultProxyBreakerOpenSeconds,
+		Usage:  "Seconds of open circuit of next hop of /proxy until half-open probe is allowed.",
+		EnvVar: "HAPPO_AGENT_PROXY_BREAKER_OPEN_SECONDS",
+	},
+	cli.StringFlag{
+		Name:   "proxy-trace-name",
+		Value:  "",
+		Usage:  "Name of this happo-agent in trace of /proxy(when empty, hostname).",
+		EnvVar: "HAPPO_AGENT_PROXY_TRACE_NAME",
+	},
+	cli.IntFlag{
+		Name:   "proxy-multi-concurrency",
+		Value:  halib.DefaultProxyMultiConcurrency,
+		Usage:  "Max number of targets requested at once by /proxy/multi.",
+		EnvVar: "HAPPO_AGENT_PROXY_MULTI_CONCURRENCY",
+	},
+	cli.IntFlag{
+		Name:   "proxy-multi-max-targets",
+		Value:  halib.DefaultProxyMultiMaxTargets,
+		Usage:  "Max number of targets in one /proxy/multi request(when 0, unlimited).",
+		EnvVar: "HAPPO_AGENT_PROXY_MULTI_MAX_TARGETS",
+	},
+	cli.StringFlag{
+		Name:   "proxy-allowed-routes",
+		Value:  halib.DefaultProxyAllowedRoutes,
+		Usage:  "Routes(`<method> <path glob>`, comma separated) forwardable by /proxy with path.",
+		EnvVar: "HAPPO_AGENT_PROXY_ALLOWED_ROUTES",
+	},
+	cli.StringFlag{
+		Name:   "proxy-max-response-bytes",
+		Value:  halib.DefaultProxyMaxResponseBytes,
+		Usage:  "Max bytes of response relayed by /proxy for each request_type(comma separated `<request_type>=<bytes>`, `*` is for others. 0 is unlimited).",
+		EnvVar: "HAPPO_AGENT_PROXY_MAX_RESPONSE_BYTES",
+	},
+	cli.StringFlag{
+		Name:   "tunnel-tokens",
+		Value:  "",
+		Usage:  "Token of each host id allowed to connect reverse-connect tunnel to this bastion(comma separated `<host id>=<token>`. when empty, tunnel is not accepted).",
+		EnvVar: "HAPPO_AGENT_TUNNEL_TOKENS",
+	},
+	cli.StringFlag{
+		Name:   "tunnel-bastion-endpoint",
+		Value:  "",
+		Usage:  "Bastion endpoint(e.g. https://192.0.2.1:6777) to keep reverse-connect tunnel(when empty, tunnel is disabled).",
+		EnvVar: "HAPPO_AGENT_TUNNEL_BASTION_ENDPOINT",
+	},
+	cli.StringFlag{
+		Name:   "tunnel-bastion-token",
+		Value:  "",
+		Usage:  "Token of reverse-connect tunnel(token of --tunnel-host-id in --tunnel-tokens of bastion).",
+		EnvVar: "HAPPO_AGENT_TUNNEL_BASTION_TOKEN",
+	},
+	cli.StringFlag{
+		Name:   "tunnel-bastion-ca-file",
+		Value:  "",
+		Usage:  "CA certificates(PEM) to verify bastion of reverse-connect tunnel(this or --tunnel-bastion-cert-sha256 is required).",
+		EnvVar: "HAPPO_AGENT_TUNNEL_BASTION_CA_FILE",
+	},
+	cli.StringFlag{
+		Name:   "tunnel-bastion-cert-sha256",
+		Value:  "",
+		Usage:  "SHA-256 fingerprint(hex) of bastion certificate pinned in reverse-connect tunnel(this or --tunnel-bastion-ca-file is required).",
+		EnvVar: "HAPPO_AGENT_TUNNEL_BASTION_CERT_SHA256",
+	},
+	cli.StringFlag{
+		Name:   "tunnel-host-id",
+		Value:  "",
+		Usage:  "Host id of this happo-agent in reverse-connect tunnel, used as proxy_hostport tunnel:<host id> at bastion(when empty, hostname).",
+		EnvVar: "HAPPO_AGENT_TUNNEL_HOST_ID",
+	},
+	cli.Int64Flag{
+		Name:   "tunnel-reconnect-seconds",
+		Value:  halib.DefaultTunnelReconnectSeconds,
+		Usage:  "Seconds to wait before reconnecting reverse-connect tunnel.",
+		EnvVar: "HAPPO_AGENT_TUNNEL_RECONNECT_SECONDS",
+	},
 	cli.Int64Flag{
 		Name:   "error-log-interval-seconds",
 		Value:  halib.DefaultErrorLogIntervalSeconds,
@@ -131,6 +375,11 @@ var daemonFlags = []cli.Flag{
 		Usage:  "enable util.MartiniRequestStatus middleware(if enable, restart happo-agent at least once a day)",
 		EnvVar: "HAPPO_AGENT_ENABLE_REQUESTSTATUS_MIDDLEWARE",
 	},
+	cli.BoolFlag{
+		Name:   "enable-gzip-middleware",
+		Usage:  "enable util.Gzip middleware(compress response when client accepts gzip, e.g. between happo-agent hops)",
+		EnvVar: "HAPPO_AGENT_ENABLE_GZIP_MIDDLEWARE",
+	},
 	cli.BoolFlag{
 		Name:   "disable-collect-metrics",
 		Usage:  "disable collect metrics ( if true, metrics.yaml has no meaning )",
@@ -381,6 +630,50 @@ var Commands = []cli.Command{
 			},
 		},
 	},
+	{
+		Name:  "metric",
+		Usage: "Metric operations.",
+		Subcommands: []cli.Command{
+			{
+				Name:   "query",
+				Usage:  "Query buffered metrics without deleting them.",
+				Action: command.CmdMetricQuery,
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:   "bastion-endpoint, b",
+						Value:  "https://127.0.0.1:6777",
+						Usage:  "Bastion (Nearby happo-agent) endpoint address",
+						EnvVar: "HAPPO_AGENT_BASTION_ENDPOINT",
+					},
+					cli.StringFlag{
+						Name:  "hostname, H",
+						Usage: "Hostname",
+					},
+					cli.StringFlag{
+						Name:  "key, k",
+						Usage: "Metric key (glob pattern. e.g. linux.cpu.*)",
+					},
+					cli.Int64Flag{
+						Name:  "from",
+						Usage: "Unix time of oldest metrics",
+					},
+					cli.Int64Flag{
+						Name:  "to",
+						Usage: "Unix time of newest metrics",
+					},
+					cli.Int64Flag{
+						Name:  "limit, l",
+						Value: halib.DefaultMetricQueryLimit,
+						Usage: "Max number of metrics data",
+					},
+					cli.BoolFlag{
+						Name:  "json",
+						Usage: "Output in JSON",
+					},
+				},
+			},
+		},
+	},
 	{
 		Name:   "leave",
 		Usage:  "Leave from autoscaling.",
@@ -405,5 +698,5 @@ func CommandNotFound(c *cli.Context, command string) {
 // CommandBefore implements action before run command
 func CommandBefore(c *cli.Context) error {
 	util.SetLogLevel(c.GlobalString("log-level"))
-	return nil
+	return util.SetOutboundProxy(c.GlobalString("outbound-proxy"), c.GlobalString("outbound-proxy-rules"), c.GlobalString("outbound-no-proxy"))
 }
@@ -10,12 +10,18 @@ var (
 	DB *leveldb.DB
 	// MetricsMaxLifetimeSeconds is as variable name
 	MetricsMaxLifetimeSeconds int64
+	// MetricsMaxBufferBytes is max total bytes of buffered metrics. when exceeded, oldest metrics are evicted
+	MetricsMaxBufferBytes int64
+	// MetricsCompactionMinPurgedKeys is min number of purged metrics keys to run leveldb compaction
+	MetricsCompactionMinPurgedKeys int
 	// MachineStateMaxLifetimeSeconds is as variable name
 	MachineStateMaxLifetimeSeconds int64
 )
 
 func init() {
 	MetricsMaxLifetimeSeconds = 7 * 86400      //default is 7 days
+	MetricsMaxBufferBytes = 0                  //default is unlimited
+	MetricsCompactionMinPurgedKeys = 0         //default is disabled
 	MachineStateMaxLifetimeSeconds = 3 * 86400 //default is 3 days
 }
 
@@ -11,6 +11,36 @@ type MetricConfig struct {
 			PluginOption string `yaml:"plugin_option" json:"Plugin_Option"`
 		} `yaml:"plugins" json:"Plugins"`
 	} `yaml:"metrics" json:"Metrics"`
+	Transforms []MetricTransformConfig `yaml:"transforms,omitempty" json:"Transforms,omitempty"`
+}
+
+// MetricTransformConfig is transform rules of metrics collected by plugin.
+// rules are applied in order of drop, rate, scale, rename, prefix
+type MetricTransformConfig struct {
+	PluginName string `yaml:"plugin_name" json:"Plugin_Name"`
+	// Hostname is target hostname(when empty, all hosts)
+	Hostname string `yaml:"hostname,omitempty" json:"Hostname,omitempty"`
+	// Drop is regexps of keys to drop
+	Drop []string `yaml:"drop,omitempty" json:"Drop,omitempty"`
+	// Rate is regexps of counter keys to convert to rate per second
+	Rate []string `yaml:"rate,omitempty" json:"Rate,omitempty"`
+	// CounterBits is bits of counters(32 or 64). when 0, decreased counter is handled as reset, not wrap
+	CounterBits int                     `yaml:"counter_bits,omitempty" json:"Counter_Bits,omitempty"`
+	Scale       []MetricTransformScale  `yaml:"scale,omitempty" json:"Scale,omitempty"`
+	Rename      []MetricTransformRename `yaml:"rename,omitempty" json:"Rename,omitempty"`
+	Prefix      string                  `yaml:"prefix,omitempty" json:"Prefix,omitempty"`
+}
+
+// MetricTransformScale multiplies values of keys matched with Match by Factor
+type MetricTransformScale struct {
+	Match  string  `yaml:"match" json:"Match"`
+	Factor float64 `yaml:"factor" json:"Factor"`
+}
+
+// MetricTransformRename replaces keys matched with Match by Replace(`$1` is expanded)
+type MetricTransformRename struct {
+	Match   string `yaml:"match" json:"Match"`
+	Replace string `yaml:"replace" json:"Replace"`
 }
 
 // CrawlConfigAgent is struct of actual crawl operation
@@ -28,3 +58,8 @@ type CrawlConfigAgent struct {
 type AutoScalingConfig struct {
 	AutoScalings []AutoScalingConfigData `yaml:"autoscalings" json:"autoscalings"`
 }
+
+// MetricSinkConfig is struct of metric sink config yaml file
+type MetricSinkConfig struct {
+	Sinks []MetricSinkConfigData `yaml:"sinks" json:"sinks"`
+}
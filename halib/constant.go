@@ -10,6 +10,54 @@ const DefaultAgentPort = 6777
 // DefaultServerHTTPTimeout happo-agent http.Server ReadTimeout,WriteTimeout seconds
 const DefaultServerHTTPTimeout = 60
 
+// TimeoutHeader is request header of /proxy and /monitor which has remaining milliseconds until deadline of caller
+const TimeoutHeader = "X-Happo-Timeout-Ms"
+
+// ProxyTraceHeader is response header of /proxy which has trace of hops(JSON array of ProxyTraceHop)
+const ProxyTraceHeader = "X-Happo-Proxy-Trace"
+
+// TunnelHostIDHeader is request header of /tunnel which has host id of agent
+const TunnelHostIDHeader = "X-Happo-Tunnel-Host-Id"
+
+// TunnelTokenHeader is request header of /tunnel which has token of host id
+const TunnelTokenHeader = "X-Happo-Tunnel-Token"
+
+// TunnelProtocol is Upgrade protocol of /tunnel. after upgrade, bastion speaks HTTP/2 as client and agent as server
+const TunnelProtocol = "happo-tunnel"
+
+// TunnelHopPrefix is prefix of proxy_hostport(`tunnel:<host id>`) routed over reverse-connect tunnel
+const TunnelHopPrefix = "tunnel:"
+
+// DefaultProxyMaxIdleConnsPerHost is default max idle (keep-alive) connections kept for each next hop of /proxy
+const DefaultProxyMaxIdleConnsPerHost = 16
+
+// DefaultProxyIdleConnTimeoutSeconds is default seconds of idle connection to next hop of /proxy kept before closed
+const DefaultProxyIdleConnTimeoutSeconds = 90
+
+// DefaultProxyBreakerFailures is default number of consecutive failures to next hop of /proxy which opens circuit
+const DefaultProxyBreakerFailures = 5
+
+// DefaultProxyBreakerOpenSeconds is default seconds of open circuit until half-open probe is allowed
+const DefaultProxyBreakerOpenSeconds = 30
+
+// DefaultProxyAllowedRoutes is default routes(`<method> <path glob>`) forwardable by /proxy with path
+const DefaultProxyAllowedRoutes = "GET /status,GET /status/memory,GET /status/request,GET /status/autoscaling,GET /machine-state,GET /machine-state/*,GET /autoscaling,GET /autoscaling/resolve/*,GET /autoscaling/health/*,GET /metric/status,GET /metric/config,GET /metric/query"
+
+// DefaultProxyMultiConcurrency is default max number of targets requested at once by /proxy/multi
+const DefaultProxyMultiConcurrency = 16
+
+// DefaultProxyMultiMaxTargets is default max number of targets in one /proxy/multi request
+const DefaultProxyMultiMaxTargets = 1000
+
+// DefaultAutoScalingConfigReloadSeconds is default interval seconds to check change of autoscaling config
+const DefaultAutoScalingConfigReloadSeconds = 10
+
+// DefaultProxyMaxResponseBytes is default max bytes of response relayed by /proxy for each request_type(`<request_type>=<bytes>`, `*` is for others)
+const DefaultProxyMaxResponseBytes = "*=67108864"
+
+// DefaultTunnelReconnectSeconds is default seconds to wait before reconnecting tunnel to bastion
+const DefaultTunnelReconnectSeconds = 10
+
 // DefaultAPIEndpoint is default API endpoint of happo backend
 const DefaultAPIEndpoint = "http://YOUR_MANAGEMENT_SERVER_HERE"
 
@@ -58,6 +106,24 @@ const DefaultSensuPluginPaths = "/usr/local/hb-agent/bin,/usr/local/bin"
 // DefaultMetricsConfigPath is default metric collection config path
 const DefaultMetricsConfigPath = "./metrics.yaml"
 
+// MetricConfigDirName is name of drop-in directory of metric config. placed next to metric config file
+const MetricConfigDirName = "metrics.d"
+
+// MetricConfigAPIFileName is file name in MetricConfigDirName saved by /metric/config/update
+const MetricConfigAPIFileName = "api.yaml"
+
+// MetricConfigSourceFile is source type of metric config file
+const MetricConfigSourceFile = "file"
+
+// MetricConfigSourceDropIn is source type of metric config in metrics.d
+const MetricConfigSourceDropIn = "drop-in"
+
+// MetricConfigSourceAPI is source type of metric config saved by /metric/config/update
+const MetricConfigSourceAPI = "api"
+
+// MetricConfigSourceAutoScaling is source type of metric config of autoscaling instance held by bastion
+const MetricConfigSourceAutoScaling = "autoscaling"
+
 // DefaultAutoScalingConfigPath is default autoscaling config path
 const DefaultAutoScalingConfigPath = "./autoscaling.yaml"
 
@@ -66,3 +132,72 @@ const DefaultRefreshAutoScalingIntervalSeconds = 60
 
 // DefaultAutoScalingJoinWaitSeconds is seconds of until join request to bastion endpoint
 const DefaultAutoScalingJoinWaitSeconds = 60
+
+// DefaultMetricsRetentionIntervalSeconds is default interval seconds of retiring/evicting buffered metrics
+const DefaultMetricsRetentionIntervalSeconds = 60
+
+// DefaultMetricBatchLimit is default number of buffered keys(m-<timestamp>) returned by /metric at once. 60 times = 1hour
+const DefaultMetricBatchLimit = 60
+
+// DefaultMetricQueryLimit is default number of MetricsData returned by /metric/query at once
+const DefaultMetricQueryLimit = 1000
+
+// DefaultMetricAppendMaxSamples is default max number of MetricsData in one /metric/append request
+const DefaultMetricAppendMaxSamples = 10000
+
+// DefaultMetricAppendMaxKeys is default max number of metric keys in one /metric/append request
+const DefaultMetricAppendMaxKeys = 100000
+
+// DefaultMetricSeriesCacheSeconds is default seconds of recent metrics kept in memory for metric threshold check
+const DefaultMetricSeriesCacheSeconds = 3600
+
+// DefaultMetricThresholdWindowSeconds is default window seconds of metric threshold check
+const DefaultMetricThresholdWindowSeconds = 300
+
+// DefaultMetricTextfileStaleSeconds is default seconds since last modified, after that metric text file is flagged as stale
+const DefaultMetricTextfileStaleSeconds = 3600
+
+// MetricTextfileExtPrometheus is extension of metric text file in prometheus text format
+const MetricTextfileExtPrometheus = ".prom"
+
+// MetricTextfileExtSensu is extension of metric text file in sensu style format
+const MetricTextfileExtSensu = ".sensu"
+
+// MetricTextfileExtGraphite is extension of metric text file in graphite plaintext format
+const MetricTextfileExtGraphite = ".graphite"
+
+// DefaultMetricsMaxFutureSeconds is default max seconds of sample timestamp ahead of saved time
+const DefaultMetricsMaxFutureSeconds = 300
+
+// MetricsTimestampPolicyClamp replaces timestamp out of range with saved time
+const MetricsTimestampPolicyClamp = "clamp"
+
+// MetricsTimestampPolicyReject drops sample with timestamp out of range
+const MetricsTimestampPolicyReject = "reject"
+
+// DefaultStatsDFlushIntervalSeconds is default interval seconds of StatsD listener to save aggregated metrics
+const DefaultStatsDFlushIntervalSeconds = 60
+
+// DefaultStatsDPercentiles is default percentiles of StatsD timers
+const DefaultStatsDPercentiles = "90"
+
+// StatsDMaxPacketBytes is max bytes of StatsD packet
+const StatsDMaxPacketBytes = 65535
+
+// DefaultMetricAckLeaseSeconds is default seconds until metrics returned by /metric with require_ack are returned again if not acked
+const DefaultMetricAckLeaseSeconds = 300
+
+// DefaultMetricSinkConfigPath is default metric sink config path
+const DefaultMetricSinkConfigPath = "./metric_sinks.yaml"
+
+// DefaultMetricSinkIntervalSeconds is default interval seconds of forwarding metrics to sink
+const DefaultMetricSinkIntervalSeconds = 60
+
+// DefaultMetricSinkBatchSize is default number of buffered keys(m-<timestamp>) forwarded to sink at once
+const DefaultMetricSinkBatchSize = 60
+
+// DefaultMetricSinkTimeoutSeconds is default timeout seconds of sending metrics to sink
+const DefaultMetricSinkTimeoutSeconds = 10
+
+// DefaultMetricSinkMaxBackoffSeconds is max seconds of backoff after failed to send metrics to sink
+const DefaultMetricSinkMaxBackoffSeconds = 600
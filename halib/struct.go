@@ -7,6 +7,15 @@ type MetricsData struct {
 	HostName  string             `json:"hostname"`
 	Timestamp int64              `json:"timestamp"`
 	Metrics   map[string]float64 `json:"metrics"`
+	Rollup    *MetricsRollup     `json:"rollup,omitempty"`
+}
+
+// MetricsRollup is summary of rolled up metrics. when rolled up, MetricsData.Metrics is average of each key
+type MetricsRollup struct {
+	Interval int64              `json:"interval"`
+	Count    map[string]int64   `json:"count"`
+	Min      map[string]float64 `json:"min"`
+	Max      map[string]float64 `json:"max"`
 }
 
 // InventoryData is actual inventory
@@ -43,6 +52,22 @@ type AutoScalingConfigData struct {
 	HostPrefix           string `yaml:"host_prefix" json:"host_prefix"`
 }
 
+// MetricSinkConfigData is actual metric sink config data
+type MetricSinkConfigData struct {
+	Name               string            `yaml:"name" json:"name"`
+	Type               string            `yaml:"type" json:"type"`
+	Address            string            `yaml:"address,omitempty" json:"address,omitempty"`
+	URL                string            `yaml:"url,omitempty" json:"url,omitempty"`
+	Prefix             string            `yaml:"prefix,omitempty" json:"prefix,omitempty"`
+	APIKey             string            `yaml:"apikey,omitempty" json:"apikey,omitempty"`
+	Headers            map[string]string `yaml:"headers,omitempty" json:"headers,omitempty"`
+	InsecureSkipVerify bool              `yaml:"insecure_skip_verify,omitempty" json:"insecure_skip_verify,omitempty"`
+	IntervalSeconds    int               `yaml:"interval_seconds,omitempty" json:"interval_seconds,omitempty"`
+	BatchSize          int               `yaml:"batch_size,omitempty" json:"batch_size,omitempty"`
+	TimeoutSeconds     int               `yaml:"timeout_seconds,omitempty" json:"timeout_seconds,omitempty"`
+	MaxBackoffSeconds  int               `yaml:"max_backoff_seconds,omitempty" json:"max_backoff_seconds,omitempty"`
+}
+
 // AutoScalingNodeConfigParameters is struct of parameters for autoscaling node
 type AutoScalingNodeConfigParameters struct {
 	BastionEndpoint string
@@ -63,6 +88,53 @@ type ProxyRequest struct {
 	ProxyHostPort []string `json:"proxy_hostport"`
 	RequestType   string   `json:"request_type"`
 	RequestJSON   []byte   `json:"request_json"`
+	// TraceInMessage appends trace of hops to message of monitor response
+	TraceInMessage bool `json:"trace_in_message,omitempty"`
+	// AlternativeProxyHostPort is routes tried in order when next hop of ProxyHostPort is open-circuited
+	AlternativeProxyHostPort [][]string `json:"alternative_proxy_hostport,omitempty"`
+	// Method, Path, Query and Headers are request to destination host instead of RequestType(POST /<request_type>).
+	// Method(default: GET) and Path must be allowed by --proxy-allowed-routes
+	Method  string            `json:"method,omitempty"`
+	Path    string            `json:"path,omitempty"`
+	Query   string            `json:"query,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// ProxyTraceHop is each hop of trace returned in X-Happo-Proxy-Trace header of /proxy API
+type ProxyTraceHop struct {
+	Hop        string `json:"hop"`
+	Next       string `json:"next"`
+	LatencyMs  int64  `json:"latency_ms"`
+	StatusCode int    `json:"status_code"`
+	Error      string `json:"error,omitempty"`
+}
+
+// ProxyMultiRequest is /proxy/multi API
+type ProxyMultiRequest struct {
+	// Targets is list of proxy_hostport(chain of bastion_ip:port) of each target
+	Targets     [][]string `json:"targets"`
+	RequestType string     `json:"request_type"`
+	RequestJSON []byte     `json:"request_json"`
+	// Concurrency is max number of targets requested at once(when 0, --proxy-multi-concurrency)
+	Concurrency int `json:"concurrency"`
+	// TimeoutSeconds is timeout of each target(when 0, --proxy-timeout-seconds)
+	TimeoutSeconds int64 `json:"timeout_seconds"`
+	// TraceInMessage appends trace of hops to message of each monitor response
+	TraceInMessage bool `json:"trace_in_message,omitempty"`
+}
+
+// ProxyMultiResponse is /proxy/multi API
+type ProxyMultiResponse struct {
+	Message string             `json:"message"`
+	Results []ProxyMultiResult `json:"results"`
+}
+
+// ProxyMultiResult is result of each target of /proxy/multi API
+type ProxyMultiResult struct {
+	ProxyHostPort []string        `json:"proxy_hostport"`
+	StatusCode    int             `json:"status_code"`
+	Response      string          `json:"response"`
+	Trace         []ProxyTraceHop `json:"trace"`
 }
 
 // MonitorRequest is /monitor API
@@ -74,7 +146,15 @@ type MonitorRequest struct {
 
 // MetricRequest is /metric API
 type MetricRequest struct {
-	APIKey string `json:"apikey"`
+	APIKey     string `json:"apikey"`
+	Limit      int    `json:"limit"`
+	RequireAck bool   `json:"require_ack"`
+}
+
+// MetricAckRequest is /metric/ack API
+type MetricAckRequest struct {
+	APIKey  string `json:"apikey"`
+	BatchID string `json:"batch_id"`
 }
 
 // MetricAppendRequest is /metric/append API
@@ -87,6 +167,16 @@ type MetricAppendRequest struct {
 type MetricConfigUpdateRequest struct {
 	APIKey string       `json:"apikey"`
 	Config MetricConfig `json:"config"`
+	// Force saves config even if validation failed
+	Force bool `json:"force"`
+}
+
+// MetricConfigValidateRequest is /metric/config/validate API
+type MetricConfigValidateRequest struct {
+	APIKey string       `json:"apikey"`
+	Config MetricConfig `json:"config"`
+	// Execute executes each plugin once
+	Execute bool `json:"execute"`
 }
 
 // InventoryRequest is /inventory API
@@ -150,19 +240,102 @@ type MonitorResponse struct {
 // MetricResponse is /metric API
 type MetricResponse struct {
 	MetricData []MetricsData `json:"metric_data"`
+	BatchID    string        `json:"batch_id,omitempty"`
 	Message    string        `json:"message"`
 }
 
-// MetricAppendResponse is /metric/append API
-type MetricAppendResponse struct {
+// MetricQueryResponse is /metric/query API
+type MetricQueryResponse struct {
+	MetricData []MetricsData `json:"metric_data"`
+	Message    string        `json:"message"`
+}
+
+// MetricAckResponse is /metric/ack API
+type MetricAckResponse struct {
 	Status  string `json:"status"`
 	Message string `json:"message"`
 }
 
+// MetricAppendResponse is /metric/append API
+type MetricAppendResponse struct {
+	Status   string                  `json:"status"`
+	Message  string                  `json:"message"`
+	Accepted int                     `json:"accepted"`
+	Rejected []MetricAppendRejection `json:"rejected,omitempty"`
+}
+
+// MetricAppendRejection is MetricsData rejected by /metric/append API
+type MetricAppendRejection struct {
+	Index     int    `json:"index"`
+	HostName  string `json:"hostname"`
+	Timestamp int64  `json:"timestamp"`
+	Reason    string `json:"reason"`
+}
+
 // MetricConfigUpdateResponse is /metric/config/update API
 type MetricConfigUpdateResponse struct {
-	Status  string `json:"status"`
-	Message string `json:"message"`
+	Status     string                  `json:"status"`
+	Message    string                  `json:"message"`
+	Validation *MetricConfigValidation `json:"validation,omitempty"`
+}
+
+// MetricConfigRequest is /metric/config API(POST. e.g. via /proxy)
+type MetricConfigRequest struct {
+	APIKey string `json:"apikey"`
+}
+
+// MetricConfigResponse is /metric/config API
+type MetricConfigResponse struct {
+	Status  string                    `json:"status"`
+	Message string                    `json:"message"`
+	Config  MetricConfig              `json:"config"`
+	Sources []MetricConfigSource      `json:"sources"`
+	Entries []MetricConfigEntrySource `json:"entries"`
+}
+
+// MetricConfigSource is file(or dbms entry on autoscaling bastion) of metric config
+type MetricConfigSource struct {
+	Path string `json:"path"`
+	// Type is `file`, `drop-in`, `api` or `autoscaling`
+	Type     string `json:"type"`
+	Checksum string `json:"checksum"`
+	ModTime  int64  `json:"mtime"`
+}
+
+// MetricConfigEntrySource is source of each plugin entry of metric config
+type MetricConfigEntrySource struct {
+	Hostname     string `json:"hostname"`
+	PluginName   string `json:"plugin_name"`
+	PluginOption string `json:"plugin_option"`
+	Source       string `json:"source"`
+}
+
+// MetricConfigValidateResponse is /metric/config/validate API
+type MetricConfigValidateResponse struct {
+	Status     string                  `json:"status"`
+	Message    string                  `json:"message"`
+	Validation *MetricConfigValidation `json:"validation"`
+}
+
+// MetricConfigValidation is result of metric config validation
+type MetricConfigValidation struct {
+	Valid bool `json:"valid"`
+	// Errors is errors not related to plugins(e.g. transforms)
+	Errors  []string                 `json:"errors,omitempty"`
+	Plugins []MetricPluginValidation `json:"plugins"`
+}
+
+// MetricPluginValidation is validation result of each plugin in metric config
+type MetricPluginValidation struct {
+	Hostname     string `json:"hostname"`
+	PluginName   string `json:"plugin_name"`
+	PluginOption string `json:"plugin_option"`
+	// Path is resolved path of plugin. `builtin` for builtin plugins
+	Path     string   `json:"path"`
+	Executed bool     `json:"executed"`
+	ExitCode int      `json:"exit_code"`
+	Keys     []string `json:"keys,omitempty"`
+	Error    string   `json:"error,omitempty"`
 }
 
 // InventoryResponse is /inventory API
@@ -235,13 +408,20 @@ type AutoScalingHealthResponse struct {
 
 // StatusResponse is /status API
 type StatusResponse struct {
-	AppVersion            string            `json:"app_version"`
-	UptimeSeconds         int64             `json:"uptime_seconds"`
-	DisableCollectMetrics bool              `json:"disable_collect_metrics"`
-	NumGoroutine          int               `json:"num_goroutine"`
-	MetricBufferStatus    map[string]int64  `json:"metric_buffer_status"`
-	Callers               []string          `json:"callers"`
-	LevelDBProperties     map[string]string `json:"leveldb_properties"`
+	AppVersion            string                      `json:"app_version"`
+	UptimeSeconds         int64                       `json:"uptime_seconds"`
+	DisableCollectMetrics bool                        `json:"disable_collect_metrics"`
+	NumGoroutine          int                         `json:"num_goroutine"`
+	MetricBufferStatus    map[string]int64            `json:"metric_buffer_status"`
+	MetricRetentionStatus map[string]int64            `json:"metric_retention_status"`
+	MetricTextfileStatus  map[string]int64            `json:"metric_textfile_status"`
+	MetricTimestampStatus map[string]int64            `json:"metric_timestamp_status"`
+	MetricSinkStatus      map[string]map[string]int64 `json:"metric_sink_status"`
+	ProxyPoolStatus       map[string]map[string]int64 `json:"proxy_pool_status"`
+	ProxyBreakerStatus    map[string]map[string]int64 `json:"proxy_breaker_status"`
+	TunnelStatus          map[string]map[string]int64 `json:"tunnel_status"`
+	Callers               []string                    `json:"callers"`
+	LevelDBProperties     map[string]string           `json:"leveldb_properties"`
 }
 
 // RequestStatusResponse is /status/request API
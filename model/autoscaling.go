@@ -65,6 +65,7 @@ func AutoScalingConfigUpdate(autoScalingRequest halib.AutoScalingConfigUpdateReq
 		autoScalingResponse.Status = "NG"
 	} else {
 		autoScalingResponse.Status = "OK"
+		ReloadAutoScalingConfig()
 	}
 
 	r.JSON(http.StatusOK, autoScalingResponse)
@@ -0,0 +1,170 @@
+package model
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/autoscaling"
+	"github.com/heartbeatsjp/happo-agent/db"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+)
+
+var autoScalingRoutes = &autoScalingRouteTable{}
+
+// autoScalingRouteTable is autoscaling config loaded from AutoScalingConfigFile, for routing of /proxy
+type autoScalingRouteTable struct {
+	mu      sync.RWMutex
+	loaded  bool
+	path    string
+	modTime time.Time
+	size    int64
+	// groups is config by autoscaling group name
+	groups map[string]halib.AutoScalingConfigData
+	// aliasPrefixes is configs by prefix of alias(`<autoscaling_group_name>-<host_prefix>-`)
+	aliasPrefixes map[string][]halib.AutoScalingConfigData
+}
+
+// reload loads AutoScalingConfigFile. when not exist, no autoscaling group is routed.
+// when failed to parse, previous config is kept and reloaded again by next check
+func (t *autoScalingRouteTable) reload() {
+	log := util.HappoAgentLogger()
+
+	path := AutoScalingConfigFile
+	groups := map[string]halib.AutoScalingConfigData{}
+	aliasPrefixes := map[string][]halib.AutoScalingConfigData{}
+	var modTime time.Time
+	var size int64
+
+	if fi, err := os.Stat(path); err != nil {
+		log.Info(err)
+	} else {
+		autoScalingList, err := autoscaling.GetAutoScalingConfig(path)
+		if err != nil {
+			log.Errorf("failed to get autoscaling config: %s", err.Error())
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if t.path != path {
+				t.groups = groups
+				t.aliasPrefixes = aliasPrefixes
+			}
+			t.loaded = true
+			t.path = path
+			t.modTime = time.Time{}
+			t.size = 0
+			return
+		}
+		modTime, size = fi.ModTime(), fi.Size()
+		for _, a := range autoScalingList.AutoScalings {
+			config := halib.AutoScalingConfigData{
+				AutoScalingGroupName: a.AutoScalingGroupName,
+				HostPrefix:           a.HostPrefix,
+				AutoScalingCount:     a.AutoScalingCount,
+			}
+			groups[a.AutoScalingGroupName] = config
+			prefix := fmt.Sprintf("%s-%s-", a.AutoScalingGroupName, a.HostPrefix)
+			aliasPrefixes[prefix] = append(aliasPrefixes[prefix], config)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.loaded = true
+	t.path = path
+	t.modTime = modTime
+	t.size = size
+	t.groups = groups
+	t.aliasPrefixes = aliasPrefixes
+}
+
+// changed returns true when AutoScalingConfigFile has been changed since loaded
+func (t *autoScalingRouteTable) changed() bool {
+	t.mu.RLock()
+	loaded, path, modTime, size := t.loaded, t.path, t.modTime, t.size
+	t.mu.RUnlock()
+
+	if !loaded || path != AutoScalingConfigFile {
+		return true
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return !modTime.IsZero()
+	}
+	return !fi.ModTime().Equal(modTime) || fi.Size() != size
+}
+
+// lookup returns autoscaling group config of host.
+// host is autoscaling group name or alias(`<autoscaling_group_name>-<host_prefix>-<number>`).
+// returns empty config when host is not autoscaling
+func (t *autoScalingRouteTable) lookup(host string) (halib.AutoScalingConfigData, error) {
+	t.mu.RLock()
+	if !t.loaded || t.path != AutoScalingConfigFile {
+		t.mu.RUnlock()
+		t.reload()
+		t.mu.RLock()
+	}
+	defer t.mu.RUnlock()
+
+	if config, ok := t.groups[host]; ok {
+		return config, nil
+	}
+	if i := strings.LastIndex(host, "-"); i >= 0 && isAliasNumber(host[i+1:]) {
+		configs := t.aliasPrefixes[host[:i+1]]
+		switch len(configs) {
+		case 0:
+		case 1:
+			return configs[0], nil
+		default:
+			var names []string
+			for _, config := range configs {
+				names = append(names, config.AutoScalingGroupName)
+			}
+			return halib.AutoScalingConfigData{}, fmt.Errorf("ambiguous alias %s: matches autoscaling groups %s", host, strings.Join(names, ", "))
+		}
+	}
+
+	// alias registered but its autoscaling group is not configured
+	if net.ParseIP(host) == nil && db.DB != nil {
+		if ok, _ := db.DB.Has([]byte(fmt.Sprintf("ag-%s", host)), nil); ok {
+			return halib.AutoScalingConfigData{}, fmt.Errorf("autoscaling group of alias %s is not configured in %s", host, AutoScalingConfigFile)
+		}
+	}
+	return halib.AutoScalingConfigData{}, nil
+}
+
+func isAliasNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// ReloadAutoScalingConfig reloads AutoScalingConfigFile for routing of /proxy
+func ReloadAutoScalingConfig() {
+	autoScalingRoutes.reload()
+}
+
+// WatchAutoScalingConfig reloads AutoScalingConfigFile when changed, checking every interval(when 0, disabled)
+func WatchAutoScalingConfig(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	log := util.HappoAgentLogger()
+	go func() {
+		for range time.Tick(interval) {
+			if autoScalingRoutes.changed() {
+				log.Info(fmt.Sprintf("reload autoscaling config: %s", AutoScalingConfigFile))
+				autoScalingRoutes.reload()
+			}
+		}
+	}()
+}
@@ -0,0 +1,193 @@
+package model
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/autoscaling"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeAutoScalingConfig writes autoscaling config to temporary file and sets it to AutoScalingConfigFile
+func writeAutoScalingConfig(t *testing.T, dir, config string) {
+	path := filepath.Join(dir, "autoscaling.yaml")
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	AutoScalingConfigFile = path
+}
+
+func TestAutoScalingRoutesLookup1(t *testing.T) {
+	// exact match of overlapping autoscaling group names
+	origConfigFile := AutoScalingConfigFile
+	defer func() { AutoScalingConfigFile = origConfigFile }()
+	dir, err := ioutil.TempDir("", "happo-agent-autoscaling")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeAutoScalingConfig(t, dir, `autoscalings:
+- autoscaling_group_name: web
+  autoscaling_count: 4
+  host_prefix: app
+- autoscaling_group_name: web-admin
+  autoscaling_count: 2
+  host_prefix: app
+`)
+
+	var cases = []struct {
+		host     string
+		expected string
+	}{
+		{"web-admin-app-01", "web-admin"},
+		{"web-app-01", "web"},
+		{"web", "web"},
+		{"web-admin", "web-admin"},
+		{"web-admin-app-x", ""},
+		{"web-app-", ""},
+		{"192.0.2.1", ""},
+	}
+	for _, c := range cases {
+		config, err := autoScalingRoutes.lookup(c.host)
+		assert.Nil(t, err, c.host)
+		assert.Equal(t, c.expected, config.AutoScalingGroupName, c.host)
+	}
+}
+
+func TestAutoScalingRoutesLookup2(t *testing.T) {
+	// ambiguous alias
+	origConfigFile := AutoScalingConfigFile
+	defer func() { AutoScalingConfigFile = origConfigFile }()
+	dir, err := ioutil.TempDir("", "happo-agent-autoscaling")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeAutoScalingConfig(t, dir, `autoscalings:
+- autoscaling_group_name: a
+  autoscaling_count: 1
+  host_prefix: b-c
+- autoscaling_group_name: a-b
+  autoscaling_count: 1
+  host_prefix: c
+`)
+
+	_, err = autoScalingRoutes.lookup("a-b-c-01")
+	assert.EqualError(t, err, "ambiguous alias a-b-c-01: matches autoscaling groups a, a-b")
+}
+
+func TestAutoScalingRoutesReload1(t *testing.T) {
+	// reload when config file is changed
+	origConfigFile := AutoScalingConfigFile
+	defer func() { AutoScalingConfigFile = origConfigFile }()
+	dir, err := ioutil.TempDir("", "happo-agent-autoscaling")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeAutoScalingConfig(t, dir, `autoscalings:
+- autoscaling_group_name: web
+  autoscaling_count: 4
+  host_prefix: app
+`)
+	autoScalingRoutes.reload()
+	assert.False(t, autoScalingRoutes.changed())
+	config, _ := autoScalingRoutes.lookup("batch-app-1")
+	assert.Equal(t, "", config.AutoScalingGroupName)
+
+	writeAutoScalingConfig(t, dir, `autoscalings:
+- autoscaling_group_name: web
+  autoscaling_count: 4
+  host_prefix: app
+- autoscaling_group_name: batch
+  autoscaling_count: 2
+  host_prefix: app
+`)
+	os.Chtimes(AutoScalingConfigFile, time.Now(), time.Now().Add(time.Second))
+	assert.True(t, autoScalingRoutes.changed())
+	autoScalingRoutes.reload()
+	assert.False(t, autoScalingRoutes.changed())
+	config, _ = autoScalingRoutes.lookup("batch-app-1")
+	assert.Equal(t, halib.AutoScalingConfigData{AutoScalingGroupName: "batch", HostPrefix: "app", AutoScalingCount: 2}, config)
+}
+
+func TestAutoScalingRoutesReload2(t *testing.T) {
+	// keep previous config when config file is broken
+	origConfigFile := AutoScalingConfigFile
+	defer func() { AutoScalingConfigFile = origConfigFile }()
+	dir, err := ioutil.TempDir("", "happo-agent-autoscaling")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeAutoScalingConfig(t, dir, `autoscalings:
+- autoscaling_group_name: web
+  autoscaling_count: 4
+  host_prefix: app
+`)
+	autoScalingRoutes.reload()
+
+	writeAutoScalingConfig(t, dir, `autoscalings:
+- autoscaling_group_name: web
+  autoscaling_count: [
+`)
+	os.Chtimes(AutoScalingConfigFile, time.Now(), time.Now().Add(time.Second))
+	assert.True(t, autoScalingRoutes.changed())
+	autoScalingRoutes.reload()
+	config, err := autoScalingRoutes.lookup("web-app-1")
+	assert.Nil(t, err)
+	assert.Equal(t, "web", config.AutoScalingGroupName)
+	// reloaded again by next check
+	assert.True(t, autoScalingRoutes.changed())
+
+	writeAutoScalingConfig(t, dir, `autoscalings:
+- autoscaling_group_name: batch
+  autoscaling_count: 2
+  host_prefix: app
+`)
+	autoScalingRoutes.reload()
+	assert.False(t, autoScalingRoutes.changed())
+	config, _ = autoScalingRoutes.lookup("web-app-1")
+	assert.Equal(t, "", config.AutoScalingGroupName)
+	config, _ = autoScalingRoutes.lookup("batch-app-1")
+	assert.Equal(t, "batch", config.AutoScalingGroupName)
+}
+
+func TestAutoScalingRoutesLookup3(t *testing.T) {
+	// alias registered but its autoscaling group is not configured
+	setup()
+	defer teardown()
+
+	origConfigFile := AutoScalingConfigFile
+	defer func() { AutoScalingConfigFile = origConfigFile }()
+	dir, err := ioutil.TempDir("", "happo-agent-autoscaling")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeAutoScalingConfig(t, dir, `autoscalings:
+- autoscaling_group_name: dummy-prod-ag
+  autoscaling_count: 10
+  host_prefix: dummy-prod-app
+`)
+
+	proxyRequest := halib.ProxyRequest{
+		ProxyHostPort: []string{"dummy-stg-ag-dummy-stg-app-1"},
+		RequestType:   "monitor",
+		RequestJSON:   []byte("{}"),
+	}
+	statusCode, response, _ := proxy(context.Background(), proxyRequest, &autoscaling.AWSClient{})
+	assert.Equal(t, http.StatusNotFound, statusCode)
+	assert.Contains(t, response, "autoscaling group of alias dummy-stg-ag-dummy-stg-app-1 is not configured")
+}
@@ -0,0 +1,44 @@
+package model
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+)
+
+// requestContext returns context of req, with deadline by X-Happo-Timeout-Ms header(remaining milliseconds of caller).
+// the context is done when client has gone
+func requestContext(req *http.Request) (context.Context, context.CancelFunc) {
+	if req == nil {
+		return context.WithCancel(context.Background())
+	}
+	value := req.Header.Get(halib.TimeoutHeader)
+	if value == "" {
+		return context.WithCancel(req.Context())
+	}
+	remaining, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		util.HappoAgentLogger().Warnf("invalid %s header: %s", halib.TimeoutHeader, value)
+		return context.WithCancel(req.Context())
+	}
+	return context.WithTimeout(req.Context(), time.Duration(remaining)*time.Millisecond)
+}
+
+// setTimeoutHeader sets remaining milliseconds until deadline of ctx to X-Happo-Timeout-Ms header.
+// without deadline, --proxy-timeout-seconds is used so that following hops finish before this hop gives up
+func setTimeoutHeader(ctx context.Context, header http.Header) {
+	remaining := _httpClient.Timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining == 0 || time.Until(deadline) < remaining {
+			remaining = time.Until(deadline)
+		}
+	}
+	if remaining <= 0 {
+		return
+	}
+	header.Set(halib.TimeoutHeader, strconv.FormatInt(int64(remaining/time.Millisecond), 10))
+}
@@ -0,0 +1,98 @@
+package model
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/martini-contrib/render"
+	"github.com/go-martini/martini"
+	"github.com/heartbeatsjp/happo-agent/autoscaling"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/martini-contrib/binding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeadline1(t *testing.T) {
+	// remaining time is propagated to next hop
+	m := martini.Classic()
+	m.Use(render.Renderer())
+	m.Post("/proxy", binding.Json(halib.ProxyRequest{}), Proxy)
+	m.Map(&autoscaling.AWSClient{})
+
+	received := make(chan string, 1)
+	ts := httptest.NewTLSServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				received <- r.Header.Get(halib.TimeoutHeader)
+				fmt.Fprint(w, `{"return_value":0,"message":"ok"}`)
+			}))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		header string
+		max    int64
+	}{
+		{"5000", 5000},
+		{"", int64(_httpClient.Timeout / time.Millisecond)},
+	} {
+		requestJSON := fmt.Sprintf(`{
+			"proxy_hostport": ["%s"],
+			"request_type": "monitor",
+			"request_json": "e30="
+		}`, strings.TrimPrefix(ts.URL, "https://"))
+		req, _ := http.NewRequest("POST", "/proxy", bytes.NewReader([]byte(requestJSON)))
+		req.Header.Set("Content-Type", "application/json")
+		if tc.header != "" {
+			req.Header.Set(halib.TimeoutHeader, tc.header)
+		}
+		res := httptest.NewRecorder()
+		m.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusOK, res.Code)
+
+		remaining, err := strconv.ParseInt(<-received, 10, 64)
+		if tc.max == 0 {
+			// no timeout
+			assert.NotNil(t, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.True(t, remaining > 0 && remaining <= tc.max, "%d", remaining)
+	}
+}
+
+func TestDeadline2(t *testing.T) {
+	// plugin is killed at deadline of caller
+	m := martini.Classic()
+	m.Use(render.Renderer())
+	m.Post("/monitor", binding.Json(halib.MonitorRequest{}), Monitor)
+
+	reader := bytes.NewReader([]byte(`{
+		"apikey": "",
+		"plugin_name": "monitor_test_sleep",
+		"plugin_option": "10"
+	}`))
+	req, _ := http.NewRequest("POST", "/monitor", reader)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(halib.TimeoutHeader, "300")
+
+	res := httptest.NewRecorder()
+
+	startAt := time.Now()
+	lastRunned = time.Now().Unix() //avoid saveMachineState
+	m.ServeHTTP(res, req)
+
+	// sleep is killed within CommandKillAfterSeconds after deadline
+	assert.True(t, time.Since(startAt) < 6*time.Second)
+	assert.Equal(t, http.StatusInternalServerError, res.Code)
+	assert.Regexp(t,
+		regexp.MustCompile(`^{"return_value":2,"message":"Exec timeout: .*monitor_test_sleep 10"}$`),
+		res.Body.String(),
+	)
+}
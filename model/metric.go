@@ -1,13 +1,20 @@
 package model
 
 import (
+	"fmt"
+	"math"
 	"net/http"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/codegangsta/martini-contrib/render"
+	"github.com/heartbeatsjp/happo-agent/autoscaling"
 	"github.com/heartbeatsjp/happo-agent/collect"
 	"github.com/heartbeatsjp/happo-agent/halib"
 	"github.com/heartbeatsjp/happo-agent/util"
+	"github.com/syndtr/goleveldb/leveldb"
 )
 
 // --- Package Variables
@@ -15,24 +22,178 @@ import (
 // MetricConfigFile is filepath of metric config file
 var MetricConfigFile string
 
-// Metric returns collected metrics
+var (
+	// MetricAppendAllowedHostnames is glob patterns of hostnames accepted by /metric/append(when empty, all hostnames).
+	// aliases of autoscaling instances are also accepted
+	MetricAppendAllowedHostnames []string
+	// MetricAppendMaxSamples is max number of MetricsData in one /metric/append request(when 0, unlimited)
+	MetricAppendMaxSamples = halib.DefaultMetricAppendMaxSamples
+	// MetricAppendMaxKeys is max number of metric keys in one /metric/append request(when 0, unlimited)
+	MetricAppendMaxKeys = halib.DefaultMetricAppendMaxKeys
+)
+
+// Metric returns collected metrics.
+// with require_ack, returned metrics are kept until /metric/ack with batch_id
 func Metric(metricRequest halib.MetricRequest, r render.Render) {
 	var metricResponse halib.MetricResponse
 
-	metricResponse.MetricData = collect.GetCollectedMetricsWithLimit(60) // FIXME to prefer value. now 60 times = 1hour
+	limit := metricRequest.Limit
+	if limit <= 0 {
+		limit = halib.DefaultMetricBatchLimit
+	}
+
+	if !metricRequest.RequireAck {
+		metricResponse.MetricData = collect.GetCollectedMetricsWithLimit(limit)
+		r.JSON(http.StatusOK, metricResponse)
+		return
+	}
+
+	metricData, batchID, err := collect.GetCollectedMetricsWithLease(time.Now(), limit)
+	if err != nil {
+		util.HappoAgentLogger().Error(err)
+		metricResponse.Message = err.Error()
+		r.JSON(http.StatusInternalServerError, metricResponse)
+		return
+	}
+	metricResponse.MetricData = metricData
+	metricResponse.BatchID = batchID
 
 	r.JSON(http.StatusOK, metricResponse)
 }
 
+// MetricAck deletes metrics returned by /metric with require_ack
+func MetricAck(request halib.MetricAckRequest, r render.Render) {
+	var response halib.MetricAckResponse
+
+	if request.BatchID == "" {
+		response.Status = "error"
+		response.Message = "batch_id required"
+		r.JSON(http.StatusBadRequest, response)
+		return
+	}
+
+	err := collect.AckCollectedMetrics(request.BatchID)
+	if err == leveldb.ErrNotFound {
+		response.Status = "error"
+		response.Message = "batch_id not found (or lease expired): " + request.BatchID
+		r.JSON(http.StatusNotFound, response)
+		return
+	} else if err != nil {
+		response.Status = "error"
+		response.Message = err.Error()
+		r.JSON(http.StatusInternalServerError, response)
+		return
+	}
+
+	response.Status = "OK"
+	r.JSON(http.StatusOK, response)
+}
+
+// MetricQuery returns buffered metrics filtered by hostname, key(glob), from and to, without deleting them
+func MetricQuery(req *http.Request, r render.Render) {
+	var response halib.MetricQueryResponse
+
+	params := req.URL.Query()
+	query := collect.MetricQuery{
+		HostName: params.Get("hostname"),
+		Key:      params.Get("key"),
+		Limit:    halib.DefaultMetricQueryLimit,
+	}
+	for name, p := range map[string]*int64{"from": &query.From, "to": &query.To} {
+		if params.Get(name) == "" {
+			continue
+		}
+		v, err := strconv.ParseInt(params.Get(name), 10, 64)
+		if err != nil {
+			response.Message = fmt.Sprintf("invalid %s: %s", name, params.Get(name))
+			r.JSON(http.StatusBadRequest, response)
+			return
+		}
+		*p = v
+	}
+	if params.Get("limit") != "" {
+		limit, err := strconv.Atoi(params.Get("limit"))
+		if err != nil || limit <= 0 {
+			response.Message = fmt.Sprintf("invalid limit: %s", params.Get("limit"))
+			r.JSON(http.StatusBadRequest, response)
+			return
+		}
+		query.Limit = limit
+	}
+
+	metricData, err := collect.QueryMetrics(query)
+	if err == path.ErrBadPattern {
+		response.Message = fmt.Sprintf("invalid key: %s", query.Key)
+		r.JSON(http.StatusBadRequest, response)
+		return
+	} else if err != nil {
+		util.HappoAgentLogger().Error(err)
+		response.Message = err.Error()
+		r.JSON(http.StatusInternalServerError, response)
+		return
+	}
+
+	response.MetricData = metricData
+	r.JSON(http.StatusOK, response)
+}
+
 // MetricAppend store metrics to local dbms
 func MetricAppend(request halib.MetricAppendRequest, r render.Render) {
 	var response halib.MetricAppendResponse
 
-	err := collect.SaveMetrics(time.Now(), request.MetricData)
-	if err != nil {
+	numKeys := 0
+	for _, m := range request.MetricData {
+		numKeys += len(m.Metrics)
+	}
+	if MetricAppendMaxSamples > 0 && len(request.MetricData) > MetricAppendMaxSamples {
 		response.Status = "error"
-		response.Message = err.Error()
-		r.JSON(http.StatusInternalServerError, response)
+		response.Message = fmt.Sprintf("too many metric_data: %d > %d", len(request.MetricData), MetricAppendMaxSamples)
+		r.JSON(http.StatusRequestEntityTooLarge, response)
+		return
+	}
+	if MetricAppendMaxKeys > 0 && numKeys > MetricAppendMaxKeys {
+		response.Status = "error"
+		response.Message = fmt.Sprintf("too many metric keys: %d > %d", numKeys, MetricAppendMaxKeys)
+		r.JSON(http.StatusRequestEntityTooLarge, response)
+		return
+	}
+
+	var accepted []halib.MetricsData
+	for i, m := range request.MetricData {
+		if reason := validateAppendedMetricsData(m); reason != "" {
+			response.Rejected = append(response.Rejected, halib.MetricAppendRejection{
+				Index:     i,
+				HostName:  m.HostName,
+				Timestamp: m.Timestamp,
+				Reason:    reason,
+			})
+			continue
+		}
+		accepted = append(accepted, m)
+	}
+	response.Accepted = len(accepted)
+
+	if len(accepted) > 0 {
+		err := collect.SaveMetrics(time.Now(), accepted)
+		if err != nil {
+			response.Status = "error"
+			response.Message = err.Error()
+			r.JSON(http.StatusInternalServerError, response)
+			return
+		}
+	}
+
+	if len(response.Rejected) > 0 {
+		util.HappoAgentLogger().Warnf("/metric/append: %d metric_data rejected", len(response.Rejected))
+		if len(accepted) == 0 {
+			response.Status = "error"
+			response.Message = "all metric_data rejected"
+			r.JSON(http.StatusBadRequest, response)
+			return
+		}
+		response.Status = "partial"
+		response.Message = fmt.Sprintf("%d metric_data rejected", len(response.Rejected))
+		r.JSON(http.StatusOK, response)
 		return
 	}
 
@@ -40,13 +201,68 @@ func MetricAppend(request halib.MetricAppendRequest, r render.Render) {
 	r.JSON(http.StatusOK, response)
 }
 
-// MetricConfigUpdate save metric collect config
+// validateAppendedMetricsData returns reason why m is rejected. returns "" if m is valid
+func validateAppendedMetricsData(m halib.MetricsData) string {
+	if m.HostName == "" {
+		return "hostname is empty"
+	}
+	if !isAllowedAppendHostname(m.HostName) {
+		return fmt.Sprintf("hostname is not allowed: %s", m.HostName)
+	}
+	if m.Timestamp <= 0 {
+		return fmt.Sprintf("invalid timestamp: %d", m.Timestamp)
+	}
+	if len(m.Metrics) == 0 {
+		return "metrics is empty"
+	}
+	for key, value := range m.Metrics {
+		if key == "" || strings.ContainsAny(key, " \t\r\n") {
+			return fmt.Sprintf("invalid metric key: %q", key)
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return fmt.Sprintf("invalid metric value: %s=%v", key, value)
+		}
+	}
+	return ""
+}
+
+// isAllowedAppendHostname returns true if hostname matches MetricAppendAllowedHostnames or is alias of autoscaling instance
+func isAllowedAppendHostname(hostname string) bool {
+	if len(MetricAppendAllowedHostnames) == 0 {
+		return true
+	}
+	for _, pattern := range MetricAppendAllowedHostnames {
+		if matched, _ := path.Match(pattern, hostname); matched {
+			return true
+		}
+	}
+	_, err := autoscaling.AliasToIP(hostname)
+	return err == nil
+}
+
+// MetricConfigUpdate save metric collect config.
+// config failed validation(without executing plugins) is refused unless force
 func MetricConfigUpdate(metricRequest halib.MetricConfigUpdateRequest, r render.Render) {
 	var metricResponse halib.MetricConfigUpdateResponse
 
+	validation := collect.ValidateMetricConfig(metricRequest.Config, false)
+	if !validation.Valid {
+		if !metricRequest.Force {
+			metricResponse.Status = "NG"
+			metricResponse.Message = "validation failed"
+			metricResponse.Validation = validation
+			r.JSON(http.StatusBadRequest, metricResponse)
+			return
+		}
+		util.HappoAgentLogger().Warn("/metric/config/update: save config failed validation by force")
+		metricResponse.Validation = validation
+	}
+
 	err := collect.SaveMetricConfig(metricRequest.Config, MetricConfigFile)
 	if err != nil {
+		util.HappoAgentLogger().Error(err)
 		metricResponse.Status = "NG"
+		metricResponse.Message = err.Error()
 	} else {
 		metricResponse.Status = "OK"
 	}
@@ -54,6 +270,41 @@ func MetricConfigUpdate(metricRequest halib.MetricConfigUpdateRequest, r render.
 	r.JSON(http.StatusOK, metricResponse)
 }
 
+// MetricConfig returns active metric collect config, with checksum and mtime of each file and source of each entry
+func MetricConfig(r render.Render) {
+	var response halib.MetricConfigResponse
+
+	config, sources, entries, err := collect.GetMetricConfigWithSources(MetricConfigFile)
+	if err != nil {
+		util.HappoAgentLogger().Error(err)
+		response.Status = "NG"
+		response.Message = err.Error()
+		r.JSON(http.StatusInternalServerError, response)
+		return
+	}
+
+	response.Status = "OK"
+	response.Config = config
+	response.Sources = sources
+	response.Entries = entries
+	r.JSON(http.StatusOK, response)
+}
+
+// MetricConfigValidate validates metric collect config without saving. with execute, each plugin is executed once
+func MetricConfigValidate(request halib.MetricConfigValidateRequest, r render.Render) {
+	var response halib.MetricConfigValidateResponse
+
+	response.Validation = collect.ValidateMetricConfig(request.Config, request.Execute)
+	if response.Validation.Valid {
+		response.Status = "OK"
+	} else {
+		response.Status = "NG"
+		response.Message = "validation failed"
+	}
+
+	r.JSON(http.StatusOK, response)
+}
+
 // MetricDataBufferStatus is obsoluted.
 func MetricDataBufferStatus(r render.Render) {
 	util.HappoAgentLogger().Warn("/metric/status is obsoluted. use /status")
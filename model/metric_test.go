@@ -0,0 +1,190 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/codegangsta/martini-contrib/render"
+	"github.com/go-martini/martini"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/martini-contrib/binding"
+	"github.com/stretchr/testify/assert"
+)
+
+func requestMetricAppend(t *testing.T, body string) (int, halib.MetricAppendResponse) {
+	m := martini.Classic()
+	m.Use(render.Renderer())
+	m.Post("/metric/append", binding.Json(halib.MetricAppendRequest{}), MetricAppend)
+
+	req, _ := http.NewRequest("POST", "/metric/append", bytes.NewReader([]byte(body)))
+	req.Header.Set("Content-Type", "application/json")
+	res := httptest.NewRecorder()
+	m.ServeHTTP(res, req)
+
+	var response halib.MetricAppendResponse
+	assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &response))
+	return res.Code, response
+}
+
+func TestMetricAppend1(t *testing.T) {
+	// validation
+	setup()
+	defer teardown()
+
+	origHostnames := MetricAppendAllowedHostnames
+	defer func() { MetricAppendAllowedHostnames = origHostnames }()
+	MetricAppendAllowedHostnames = []string{"web*"}
+
+	code, response := requestMetricAppend(t, `{"apikey": "", "metric_data": [
+		{"hostname": "web01", "timestamp": 1000, "metrics": {"val1": 1}},
+		{"hostname": "dummy-prod-ag-dummy-prod-app-1", "timestamp": 1000, "metrics": {"val1": 1}},
+		{"hostname": "wbe01", "timestamp": 1000, "metrics": {"val1": 1}},
+		{"hostname": "", "timestamp": 1000, "metrics": {"val1": 1}},
+		{"hostname": "web02", "timestamp": 0, "metrics": {"val1": 1}},
+		{"hostname": "web03", "timestamp": 1000, "metrics": {}},
+		{"hostname": "web04", "timestamp": 1000, "metrics": {"val 1": 1}}
+	]}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "partial", response.Status)
+	assert.Equal(t, 2, response.Accepted)
+	assert.Equal(t, []halib.MetricAppendRejection{
+		{Index: 2, HostName: "wbe01", Timestamp: 1000, Reason: "hostname is not allowed: wbe01"},
+		{Index: 3, HostName: "", Timestamp: 1000, Reason: "hostname is empty"},
+		{Index: 4, HostName: "web02", Timestamp: 0, Reason: "invalid timestamp: 0"},
+		{Index: 5, HostName: "web03", Timestamp: 1000, Reason: "metrics is empty"},
+		{Index: 6, HostName: "web04", Timestamp: 1000, Reason: `invalid metric key: "val 1"`},
+	}, response.Rejected)
+
+	code, response = requestMetricAppend(t, `{"apikey": "", "metric_data": [
+		{"hostname": "wbe01", "timestamp": 1000, "metrics": {"val1": 1}}
+	]}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "error", response.Status)
+	assert.Equal(t, 0, response.Accepted)
+	assert.Equal(t, 1, len(response.Rejected))
+}
+
+func TestMetricAppend2(t *testing.T) {
+	// limits
+	setup()
+	defer teardown()
+
+	origSamples, origKeys := MetricAppendMaxSamples, MetricAppendMaxKeys
+	defer func() { MetricAppendMaxSamples, MetricAppendMaxKeys = origSamples, origKeys }()
+	MetricAppendMaxSamples = 1
+	MetricAppendMaxKeys = 2
+
+	code, response := requestMetricAppend(t, `{"apikey": "", "metric_data": [
+		{"hostname": "web01", "timestamp": 1000, "metrics": {"val1": 1}},
+		{"hostname": "web01", "timestamp": 1001, "metrics": {"val1": 1}}
+	]}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, code)
+	assert.Equal(t, "too many metric_data: 2 > 1", response.Message)
+
+	code, response = requestMetricAppend(t, `{"apikey": "", "metric_data": [
+		{"hostname": "web01", "timestamp": 1000, "metrics": {"val1": 1, "val2": 2, "val3": 3}}
+	]}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, code)
+	assert.Equal(t, "too many metric keys: 3 > 2", response.Message)
+
+	code, response = requestMetricAppend(t, `{"apikey": "", "metric_data": [
+		{"hostname": "web01", "timestamp": 1000, "metrics": {"val1": 1, "val2": 2}}
+	]}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", response.Status)
+	assert.Equal(t, 1, response.Accepted)
+}
+
+func TestMetricConfigUpdate1(t *testing.T) {
+	// refused by validation unless force
+	f, err := ioutil.TempFile("", "happo-agent-metrics")
+	assert.Nil(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+	origConfigFile := MetricConfigFile
+	MetricConfigFile = f.Name()
+	defer func() { MetricConfigFile = origConfigFile }()
+
+	m := martini.Classic()
+	m.Use(render.Renderer())
+	m.Post("/metric/config/update", binding.Json(halib.MetricConfigUpdateRequest{}), MetricConfigUpdate)
+	m.Post("/metric/config/validate", binding.Json(halib.MetricConfigValidateRequest{}), MetricConfigValidate)
+
+	const config = `{"Metrics": [{"Hostname": "localhost", "Plugins": [{"Plugin_Name": "notfound_plugin", "Plugin_Option": ""}]}]}`
+	for _, tc := range []struct {
+		path     string
+		body     string
+		code     int
+		status   string
+		saved    bool
+		response interface{}
+	}{
+		{"/metric/config/validate", `{"apikey": "", "config": ` + config + `}`, http.StatusOK, "NG", false, &halib.MetricConfigValidateResponse{}},
+		{"/metric/config/update", `{"apikey": "", "config": ` + config + `}`, http.StatusBadRequest, "NG", false, &halib.MetricConfigUpdateResponse{}},
+		{"/metric/config/update", `{"apikey": "", "force": true, "config": ` + config + `}`, http.StatusOK, "OK", true, &halib.MetricConfigUpdateResponse{}},
+	} {
+		req, _ := http.NewRequest("POST", tc.path, bytes.NewReader([]byte(tc.body)))
+		req.Header.Set("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		m.ServeHTTP(res, req)
+
+		assert.Equal(t, tc.code, res.Code, tc.path)
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), tc.response))
+		var validation *halib.MetricConfigValidation
+		switch response := tc.response.(type) {
+		case *halib.MetricConfigValidateResponse:
+			assert.Equal(t, tc.status, response.Status)
+			validation = response.Validation
+		case *halib.MetricConfigUpdateResponse:
+			assert.Equal(t, tc.status, response.Status)
+			validation = response.Validation
+		}
+		assert.Equal(t, "plugin not found: notfound_plugin", validation.Plugins[0].Error)
+
+		saved, err := ioutil.ReadFile(f.Name())
+		assert.Nil(t, err)
+		assert.Equal(t, tc.saved, len(saved) > 0, tc.path)
+	}
+}
+
+func TestMetricConfig1(t *testing.T) {
+	f, err := ioutil.TempFile("", "happo-agent-metrics")
+	assert.Nil(t, err)
+	f.WriteString("metrics:\n- hostname: localhost\n  plugins:\n  - plugin_name: metric_test_plugin\n    plugin_option: \"\"\n")
+	f.Close()
+	defer os.Remove(f.Name())
+	origConfigFile := MetricConfigFile
+	MetricConfigFile = f.Name()
+	defer func() { MetricConfigFile = origConfigFile }()
+
+	m := martini.Classic()
+	m.Use(render.Renderer())
+	m.Get("/metric/config", MetricConfig)
+
+	req, _ := http.NewRequest("GET", "/metric/config", nil)
+	res := httptest.NewRecorder()
+	m.ServeHTTP(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	var response halib.MetricConfigResponse
+	assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &response))
+	assert.Equal(t, "OK", response.Status)
+	assert.Equal(t, "localhost", response.Config.Metrics[0].Hostname)
+	assert.Equal(t, 1, len(response.Sources))
+	assert.Equal(t, halib.MetricConfigSourceFile, response.Sources[0].Type)
+	assert.Equal(t, 64, len(response.Sources[0].Checksum))
+	assert.Equal(t, []halib.MetricConfigEntrySource{
+		{Hostname: "localhost", PluginName: "metric_test_plugin", PluginOption: "", Source: f.Name()},
+	}, response.Entries)
+
+	// config file not found
+	MetricConfigFile = f.Name() + ".notfound"
+	res = httptest.NewRecorder()
+	m.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusInternalServerError, res.Code)
+}
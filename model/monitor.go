@@ -1,6 +1,7 @@
 package model
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"github.com/codegangsta/martini-contrib/render"
+	"github.com/heartbeatsjp/happo-agent/collect"
 	"github.com/heartbeatsjp/happo-agent/db"
 	"github.com/heartbeatsjp/happo-agent/halib"
 	"github.com/heartbeatsjp/happo-agent/util"
@@ -56,15 +58,26 @@ func init() {
 	}()
 }
 
-// Monitor execute monitor command and returns result
-func Monitor(monitorRequest halib.MonitorRequest, r render.Render) {
+// Monitor execute monitor command and returns result.
+// plugin is killed when deadline of caller(X-Happo-Timeout-Ms header) reached or client has gone
+func Monitor(monitorRequest halib.MonitorRequest, r render.Render, req *http.Request) {
 	log := util.HappoAgentLogger()
 	var monitorResponse halib.MonitorResponse
 
+	ctx, cancel := requestContext(req)
+	defer cancel()
+
 	if !util.Production {
 		log.Println(fmt.Sprintf("Plugin Name: %s, Option: %s", monitorRequest.PluginName, monitorRequest.PluginOption))
 	}
-	ret, message, err := execPluginCommand(monitorRequest.PluginName, monitorRequest.PluginOption)
+	var ret int
+	var message string
+	var err error
+	if monitorRequest.PluginName == collect.MetricThresholdPluginName {
+		ret, message = collect.CheckMetricThreshold(monitorRequest.PluginOption, time.Now())
+	} else {
+		ret, message, err = execPluginCommand(ctx, monitorRequest.PluginName, monitorRequest.PluginOption)
+	}
 	if err != nil {
 		monitorResponse.ReturnValue = halib.MonitorError
 		monitorResponse.Message = err.Error()
@@ -85,7 +98,7 @@ func Monitor(monitorRequest halib.MonitorRequest, r render.Render) {
 	r.JSON(http.StatusOK, monitorResponse)
 }
 
-func execPluginCommand(pluginName string, pluginOption string) (int, string, error) {
+func execPluginCommand(ctx context.Context, pluginName string, pluginOption string) (int, string, error) {
 	log := util.HappoAgentLogger()
 	var plugin string
 
@@ -100,7 +113,7 @@ func execPluginCommand(pluginName string, pluginOption string) (int, string, err
 		}
 	}
 
-	exitstatus, stdout, stderr, err := util.ExecCommand(plugin, pluginOption)
+	exitstatus, stdout, stderr, err := util.ExecCommandContext(ctx, plugin, pluginOption)
 
 	out := stdout
 	if stdout == "" {
@@ -177,3 +177,30 @@ func TestMonitor6(t *testing.T) {
 		res.Body.String(),
 	)
 }
+
+func TestMonitor7(t *testing.T) {
+	// metric threshold, no data
+
+	m := martini.Classic()
+	m.Use(render.Renderer())
+	m.Post("/monitor", binding.Json(halib.MonitorRequest{}), Monitor)
+
+	reader := bytes.NewReader([]byte(`{
+		"apikey": "",
+		"plugin_name": "happo-agent:metric-threshold",
+		"plugin_option": "-H notfound -k linux.load.one -w 5 -c 10"
+	}`))
+	req, _ := http.NewRequest("POST", "/monitor", reader)
+	req.Header.Set("Content-Type", "application/json")
+
+	res := httptest.NewRecorder()
+
+	lastRunned = time.Now().Unix() //avoid saveMachineState
+	m.ServeHTTP(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t,
+		`{"return_value":3,"message":"METRIC-THRESHOLD UNKNOWN - notfound linux.load.one: no data in window"}`,
+		res.Body.String(),
+	)
+}
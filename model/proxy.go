@@ -2,13 +2,14 @@ package model
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -24,8 +25,7 @@ import (
 // --- Global Variables
 var (
 	// See http://golang.org/pkg/net/http/#Client
-	tr          = http.DefaultTransport.(*http.Transport)
-	_httpClient = http.DefaultClient
+	_httpClient = &http.Client{Transport: proxyTransports}
 
 	refreshAutoScalingChan = make(chan struct {
 		config halib.AutoScalingConfigData
@@ -37,9 +37,6 @@ var (
 )
 
 func init() {
-	tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-	_httpClient.Transport = tr
-
 	go func() {
 		for {
 			select {
@@ -57,49 +54,131 @@ func init() {
 	}()
 }
 
-// Proxy do http reqest to next happo-agent
-func Proxy(proxyRequest halib.ProxyRequest, r render.Render, client *autoscaling.AWSClient) (int, string) {
-	var nextHostport string
-	var requestType string
-	var requestJSON []byte
-	var err error
+// Proxy do http reqest to next happo-agent.
+// response of next hop is streamed to caller unless it needs to be rewritten, up to ProxyMaxResponseBytes of request_type.
+// trace of hops is returned in X-Happo-Proxy-Trace header.
+// deadline of caller(X-Happo-Timeout-Ms header) is propagated to next hop
+func Proxy(proxyRequest halib.ProxyRequest, r render.Render, client *autoscaling.AWSClient, w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := requestContext(req)
+	defer cancel()
+
+	call, failedHop := newProxyCall(proxyRequest)
+	if failedHop == nil && call.streamable() {
+		call.stream(ctx, w)
+		return
+	}
 
-	nextHostport = proxyRequest.ProxyHostPort[0]
+	var respCode int
+	var response string
+	var trace []halib.ProxyTraceHop
+	if failedHop != nil {
+		respCode, response, trace = failedHop.StatusCode, makeProxyErrorResponse(*failedHop), []halib.ProxyTraceHop{*failedHop}
+	} else {
+		respCode, response, trace = call.exchange(ctx, client)
+	}
+	setProxyTraceHeader(w.Header(), trace)
+	w.WriteHeader(respCode)
+	io.WriteString(w, response)
+}
+
+func proxy(ctx context.Context, proxyRequest halib.ProxyRequest, client *autoscaling.AWSClient) (int, string, []halib.ProxyTraceHop) {
+	call, failedHop := newProxyCall(proxyRequest)
+	if failedHop != nil {
+		return failedHop.StatusCode, makeProxyErrorResponse(*failedHop), []halib.ProxyTraceHop{*failedHop}
+	}
+	return call.exchange(ctx, client)
+}
+
+// proxyCall is request to next hop built from ProxyRequest
+type proxyCall struct {
+	// proxyRequest has selected route. for more proxies, ProxyHostPort is following hops
+	proxyRequest   halib.ProxyRequest
+	nextHost       string
+	nextPort       int
+	requestType    string
+	requestJSON    []byte
+	lastHop        bool
+	traceInMessage bool
+	config         halib.AutoScalingConfigData
+	startAt        time.Time
+}
 
-	if len(proxyRequest.ProxyHostPort) == 1 {
+// newProxyCall selects route and builds request to next hop. returns failed hop when request can not be sent
+func newProxyCall(proxyRequest halib.ProxyRequest) (*proxyCall, *halib.ProxyTraceHop) {
+	startAt := time.Now()
+	route, ok := selectProxyRoute(proxyRequest, startAt)
+	if !ok {
+		// all routes are open-circuited
+		nextHost, nextPort := splitProxyHostPort(proxyRequest.ProxyHostPort[0])
+		hop := newProxyTraceHop(fmt.Sprintf("%s:%d", nextHost, nextPort), startAt, http.StatusServiceUnavailable, errors.New("circuit open"))
+		return nil, &hop
+	}
+	proxyRequest.ProxyHostPort = route
+	// alternative routes are for this hop only
+	proxyRequest.AlternativeProxyHostPort = nil
+
+	call := &proxyCall{
+		traceInMessage: proxyRequest.TraceInMessage,
+		startAt:        startAt,
+	}
+	call.nextHost, call.nextPort = splitProxyHostPort(proxyRequest.ProxyHostPort[0])
+
+	if proxyRequest.Path != "" {
+		if err := validateProxyRoute(proxyRequest); err != nil {
+			hop := newProxyTraceHop(fmt.Sprintf("%s:%d", call.nextHost, call.nextPort), startAt, http.StatusForbidden, err)
+			proxyBreakers.release(hop.Next)
+			return nil, &hop
+		}
+	}
+
+	call.lastHop = len(proxyRequest.ProxyHostPort) == 1
+	if call.lastHop {
 		// last proxy
-		requestType = proxyRequest.RequestType
-		requestJSON = proxyRequest.RequestJSON
+		call.requestType = proxyRequest.RequestType
+		call.requestJSON = proxyRequest.RequestJSON
 	} else {
 		// more proxies
 		proxyRequest.ProxyHostPort = proxyRequest.ProxyHostPort[1:]
-		requestType = "proxy"
-		requestJSON, _ = json.Marshal(proxyRequest) // ここではエラーは出ない(出るとしたら上位でずっこけている
+		// only first hop adds trace to message
+		proxyRequest.TraceInMessage = false
+		call.requestType = "proxy"
+		call.requestJSON, _ = json.Marshal(proxyRequest) // ここではエラーは出ない(出るとしたら上位でずっこけている
 	}
-	nextHostdata := strings.Split(nextHostport, ":")
-	nextHost := nextHostdata[0]
-	nextPort := halib.DefaultAgentPort
-	if len(nextHostdata) == 2 {
-		nextPort, err = strconv.Atoi(nextHostdata[1])
-		if err != nil {
-			nextPort = halib.DefaultAgentPort
-		}
+	call.proxyRequest = proxyRequest
+	config, err := getAutoScalingInfo(call.nextHost)
+	if err != nil {
+		hop := newProxyTraceHop(fmt.Sprintf("%s:%d", call.nextHost, call.nextPort), startAt, http.StatusNotFound, err)
+		proxyBreakers.release(hop.Next)
+		return nil, &hop
 	}
+	call.config = config
+	return call, nil
+}
 
-	config := getAutoScalingInfo(nextHost)
+// exchange sends request to next hop and returns whole response
+func (call *proxyCall) exchange(ctx context.Context, client *autoscaling.AWSClient) (int, string, []halib.ProxyTraceHop) {
+	nextHost, nextPort := call.nextHost, call.nextPort
+	requestType, requestJSON := call.requestType, call.requestJSON
+	proxyRequest, config := call.proxyRequest, call.config
+	ctx = withProxyMaxResponseBytes(ctx, proxyMaxResponseBytes(proxyRequest.RequestType))
 
 	var respCode int
 	var response string
-	if config.AutoScalingGroupName == "" {
-		respCode, response, err = postToAgent(nextHost, nextPort, requestType, requestJSON)
-		if err != nil {
-			response = makeMonitorResponse(halib.MonitorUnknown, err.Error())
+	var downstreamTrace []halib.ProxyTraceHop
+	var err error
+	if call.lastHop && proxyRequest.Path != "" {
+		// last proxy to route other than request_type
+		if config.AutoScalingGroupName != "" {
+			respCode, response, err = routeAutoScaling(ctx, nextHost, nextPort, proxyRequest)
+		} else {
+			respCode, response, _, err = requestToAgent(ctx, nextHost, nextPort, proxyRequest.Method, proxyRequest.Path, proxyRequest.Query, proxyRequest.Headers, requestJSON)
 		}
+	} else if config.AutoScalingGroupName == "" {
+		var header http.Header
+		respCode, response, header, err = postToAgentWithHeader(ctx, nextHost, nextPort, requestType, requestJSON)
+		downstreamTrace = getProxyTraceHeader(header)
 	} else {
-		respCode, response, err = postToAutoScalingAgent(nextHost, nextPort, requestType, requestJSON, config.AutoScalingGroupName)
-		if err != nil {
-			response = makeMonitorResponse(halib.MonitorUnknown, err.Error())
-		}
+		respCode, response, err = postToAutoScalingAgent(ctx, nextHost, nextPort, requestType, requestJSON, config.AutoScalingGroupName)
 		if requestType == "monitor" && respCode != http.StatusOK {
 			refreshAutoScalingChan <- struct {
 				config halib.AutoScalingConfigData
@@ -111,61 +190,138 @@ func Proxy(proxyRequest halib.ProxyRequest, r render.Render, client *autoscaling
 		}
 	}
 
-	return respCode, response
+	hop := newProxyTraceHop(fmt.Sprintf("%s:%d", nextHost, nextPort), call.startAt, respCode, err)
+	reportProxyResult(ctx, hop.Next, err)
+	if err != nil {
+		response = makeProxyErrorResponse(hop)
+	}
+	trace := append([]halib.ProxyTraceHop{hop}, downstreamTrace...)
+	if call.traceInMessage && proxyRequest.RequestType == "monitor" {
+		response = addProxyTraceToMonitorResponse(response, trace)
+	}
+
+	return respCode, response, trace
 }
 
-func getAutoScalingInfo(nextHost string) halib.AutoScalingConfigData {
+// selectProxyRoute returns first route(proxy_hostport) whose next hop is not open-circuited, from primary and alternatives
+func selectProxyRoute(proxyRequest halib.ProxyRequest, now time.Time) ([]string, bool) {
 	log := util.HappoAgentLogger()
 
-	if _, err := os.Stat(AutoScalingConfigFile); os.IsNotExist(err) {
-		log.Info(err)
-		return halib.AutoScalingConfigData{}
+	routes := append([][]string{proxyRequest.ProxyHostPort}, proxyRequest.AlternativeProxyHostPort...)
+	for i, route := range routes {
+		if len(route) == 0 {
+			continue
+		}
+		nextHost, nextPort := splitProxyHostPort(route[0])
+		if proxyBreakers.allow(fmt.Sprintf("%s:%d", nextHost, nextPort), now) {
+			if i > 0 {
+				log.Warnf("circuit open for %s, use alternative route: %v", proxyRequest.ProxyHostPort[0], route)
+			}
+			return route, true
+		}
 	}
+	return nil, false
+}
 
-	var autoScalingConfigData halib.AutoScalingConfigData
-	autoScalingList, err := autoscaling.GetAutoScalingConfig(AutoScalingConfigFile)
-	if err != nil {
-		log.Errorf("failed to get autoscaling config: %s", err.Error())
-		return autoScalingConfigData
+// splitProxyHostPort returns host and port of hostport(host[:port]). port is DefaultAgentPort if omitted or invalid.
+// host of tunnel hop(`tunnel:<host id>[:port]`) keeps the prefix
+func splitProxyHostPort(hostport string) (string, int) {
+	prefix := ""
+	if strings.HasPrefix(hostport, halib.TunnelHopPrefix) {
+		prefix = halib.TunnelHopPrefix
+		hostport = strings.TrimPrefix(hostport, halib.TunnelHopPrefix)
+	}
+	nextHostdata := strings.Split(hostport, ":")
+	nextHost := prefix + nextHostdata[0]
+	nextPort := halib.DefaultAgentPort
+	if len(nextHostdata) == 2 {
+		port, err := strconv.Atoi(nextHostdata[1])
+		if err == nil {
+			nextPort = port
+		}
 	}
+	return nextHost, nextPort
+}
 
-	for _, a := range autoScalingList.AutoScalings {
-		if strings.HasPrefix(nextHost, a.AutoScalingGroupName) {
-			autoScalingConfigData.AutoScalingGroupName = a.AutoScalingGroupName
-			autoScalingConfigData.HostPrefix = a.HostPrefix
-			autoScalingConfigData.AutoScalingCount = a.AutoScalingCount
-			return autoScalingConfigData
+// getAutoScalingInfo returns autoscaling group config of nextHost(autoscaling group name or alias)
+func getAutoScalingInfo(nextHost string) (halib.AutoScalingConfigData, error) {
+	return autoScalingRoutes.lookup(nextHost)
+}
+
+func postToAgent(ctx context.Context, host string, port int, requestType string, jsonData []byte) (int, string, error) {
+	statusCode, body, _, err := postToAgentWithHeader(ctx, host, port, requestType, jsonData)
+	return statusCode, body, err
+}
+
+// postToAgentWithHeader is postToAgent which also returns response header
+func postToAgentWithHeader(ctx context.Context, host string, port int, requestType string, jsonData []byte) (int, string, http.Header, error) {
+	return requestToAgent(ctx, host, port, "POST", "/"+requestType, "", map[string]string{"Content-Type": "application/json"}, jsonData)
+}
+
+// requestToAgent sends request of method to path?query of host:port. body is not sent by GET.
+// response body is read up to ProxyMaxResponseBytes set to ctx
+func requestToAgent(ctx context.Context, host string, port int, method, requestPath, query string, headers map[string]string, body []byte) (int, string, http.Header, error) {
+	resp, statusCode, err := openAgentRequest(ctx, host, port, method, requestPath, query, headers, body)
+	if err != nil {
+		return statusCode, "", nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := readProxyResponseBody(ctx, resp)
+	if err != nil {
+		// drain rest of body so that connection can be reused
+		io.Copy(ioutil.Discard, resp.Body)
+		if isResponseTooLarge(err) {
+			return http.StatusBadGateway, "", nil, err
 		}
+		return http.StatusInternalServerError, "", nil, err
 	}
-	return autoScalingConfigData
+	return resp.StatusCode, string(respBody[:]), resp.Header, nil
 }
 
-func postToAgent(host string, port int, requestType string, jsonData []byte) (int, string, error) {
+// openAgentRequest sends request of method to path?query of host:port and returns response whose body is not read yet.
+// when error, returns status code for caller instead of response
+func openAgentRequest(ctx context.Context, host string, port int, method, requestPath, query string, headers map[string]string, body []byte) (*http.Response, int, error) {
 	log := util.HappoAgentLogger()
-	uri := fmt.Sprintf("https://%s:%d/%s", host, port, requestType)
-	log.Printf("Proxy to: %s", uri)
-	req, err := http.NewRequest("POST", uri, bytes.NewBuffer(jsonData))
-	req.Header.Set("Content-Type", "application/json")
+	if method == "" {
+		method = "GET"
+	}
+	if hostID, ok := tunnelHostID(host); ok {
+		ctx = withTunnelHostID(ctx, hostID)
+		host = hostID
+	}
+	uri := fmt.Sprintf("https://%s:%d%s", host, port, requestPath)
+	if query != "" {
+		uri += "?" + query
+	}
+	log.Printf("Proxy to: %s %s", method, uri)
+	var reqBody io.Reader
+	if method != "GET" {
+		reqBody = bytes.NewBuffer(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, uri, reqBody)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	setTimeoutHeader(ctx, req.Header)
 
 	resp, err := _httpClient.Do(req)
 	if err != nil {
 		if errTimeout, ok := err.(net.Error); ok && errTimeout.Timeout() {
-			return http.StatusGatewayTimeout, "", errTimeout
+			return nil, http.StatusGatewayTimeout, errTimeout
 		}
 		if resp != nil {
+			resp.Body.Close()
 			if resp.StatusCode == http.StatusInternalServerError || resp.StatusCode == 0 {
-				return http.StatusServiceUnavailable, "", err
+				return nil, http.StatusServiceUnavailable, err
 			}
-			return resp.StatusCode, "", err
+			return nil, resp.StatusCode, err
 		}
-		return http.StatusInternalServerError, "", err
-	}
-	body, err := ioutil.ReadAll(resp.Body)
-	defer resp.Body.Close()
-	if err != nil {
-		return http.StatusInternalServerError, "", err
+		return nil, http.StatusInternalServerError, err
 	}
-	return resp.StatusCode, string(body[:]), nil
+	return resp, resp.StatusCode, nil
 }
 
 func makeMonitorResponse(returnValue int, message string) string {
@@ -180,7 +336,7 @@ func makeMonitorResponse(returnValue int, message string) string {
 	return string(jsonData)
 }
 
-func monitorAutoScaling(host string, port int, requestType string, jsonData []byte, autoScalingGroupName string) (int, string, error) {
+func monitorAutoScaling(ctx context.Context, host string, port int, requestType string, jsonData []byte, autoScalingGroupName string) (int, string, error) {
 	ip, err := autoscaling.AliasToIP(host)
 	if err != nil {
 		var message string
@@ -197,7 +353,7 @@ func monitorAutoScaling(host string, port int, requestType string, jsonData []by
 		return http.StatusOK, makeMonitorResponse(halib.MonitorOK, message), nil
 	}
 
-	statusCode, jsonStr, perr := postToAgent(ip, port, requestType, jsonData)
+	statusCode, jsonStr, perr := postToAgent(ctx, ip, port, requestType, jsonData)
 
 	var m halib.MonitorResponse
 	if err := json.Unmarshal([]byte(jsonStr), &m); err != nil {
@@ -208,7 +364,24 @@ func monitorAutoScaling(host string, port int, requestType string, jsonData []by
 	return statusCode, makeMonitorResponse(m.ReturnValue, message), perr
 }
 
-func metricAutoScaling(host string, port int, requestType string, jsonData []byte) (int, string, error) {
+func metricAutoScaling(ctx context.Context, host string, port int, requestType string, jsonData []byte) (int, string, error) {
+	ip, err := autoscaling.AliasToIP(host)
+	if err != nil {
+		if err == leveldb.ErrNotFound {
+			return http.StatusNotFound, fmt.Sprintf("alias not found: %s\n", host), nil
+		}
+		return http.StatusInternalServerError, err.Error(), nil
+	}
+
+	if ip == "" {
+		return http.StatusServiceUnavailable, fmt.Sprintf("%s has not been assigned instance\n", host), nil
+	}
+
+	return postToAgent(ctx, ip, port, requestType, jsonData)
+}
+
+// routeAutoScaling sends request of proxyRequest.Method and proxyRequest.Path to instance assigned to alias
+func routeAutoScaling(ctx context.Context, host string, port int, proxyRequest halib.ProxyRequest) (int, string, error) {
 	ip, err := autoscaling.AliasToIP(host)
 	if err != nil {
 		if err == leveldb.ErrNotFound {
@@ -221,7 +394,8 @@ func metricAutoScaling(host string, port int, requestType string, jsonData []byt
 		return http.StatusServiceUnavailable, fmt.Sprintf("%s has not been assigned instance\n", host), nil
 	}
 
-	return postToAgent(ip, port, requestType, jsonData)
+	statusCode, body, _, err := requestToAgent(ctx, ip, port, proxyRequest.Method, proxyRequest.Path, proxyRequest.Query, proxyRequest.Headers, proxyRequest.RequestJSON)
+	return statusCode, body, err
 }
 
 func makeMetricConfigUpdateResponse(status, message string) string {
@@ -236,7 +410,7 @@ func makeMetricConfigUpdateResponse(status, message string) string {
 	return string(jsonData)
 }
 
-func metricConfigUpdateAutoScaling(autoScalingGroupName string, port int, requestType string, jsonData []byte) (int, string, error) {
+func metricConfigUpdateAutoScaling(ctx context.Context, autoScalingGroupName string, port int, requestType string, jsonData []byte) (int, string, error) {
 	log := util.HappoAgentLogger()
 
 	autoScaling, err := autoscaling.AutoScaling(AutoScalingConfigFile)
@@ -291,7 +465,7 @@ func metricConfigUpdateAutoScaling(autoScalingGroupName string, port int, reques
 			continue
 		}
 
-		_, _, err = postToAgent(instance.InstanceData.IP, port, requestType, jsonData)
+		_, _, err = postToAgent(ctx, instance.InstanceData.IP, port, requestType, jsonData)
 		if err != nil {
 			message := fmt.Sprintf("failed to post request at %s: %s", instance.Alias, err.Error())
 			log.Error(message)
@@ -309,7 +483,47 @@ func metricConfigUpdateAutoScaling(autoScalingGroupName string, port int, reques
 	return http.StatusOK, makeMetricConfigUpdateResponse("OK", ""), nil
 }
 
-func inventoryAutoScaling(autoScalingGroupName string, port int, requestType string, jsonData []byte) (int, string, error) {
+// metricConfigAutoScaling returns metric config of alias held by bastion, without posting to instance
+func metricConfigAutoScaling(alias string) (int, string, error) {
+	var response halib.MetricConfigResponse
+
+	instanceData, err := autoscaling.AliasToInstanceData(alias)
+	if err != nil {
+		response.Status = "NG"
+		response.Message = err.Error()
+		statusCode := http.StatusInternalServerError
+		if err == leveldb.ErrNotFound {
+			response.Message = fmt.Sprintf("alias not found: %s", alias)
+			statusCode = http.StatusNotFound
+		}
+		jsonData, _ := json.Marshal(&response)
+		return statusCode, string(jsonData), nil
+	}
+
+	response.Status = "OK"
+	response.Config = instanceData.MetricConfig
+	response.Sources = []halib.MetricConfigSource{
+		{Path: fmt.Sprintf("ag-%s", alias), Type: halib.MetricConfigSourceAutoScaling},
+	}
+	for _, metricHostList := range instanceData.MetricConfig.Metrics {
+		for _, metricPlugin := range metricHostList.Plugins {
+			response.Entries = append(response.Entries, halib.MetricConfigEntrySource{
+				Hostname:     metricHostList.Hostname,
+				PluginName:   metricPlugin.PluginName,
+				PluginOption: metricPlugin.PluginOption,
+				Source:       fmt.Sprintf("ag-%s", alias),
+			})
+		}
+	}
+
+	jsonData, err := json.Marshal(&response)
+	if err != nil {
+		return http.StatusInternalServerError, err.Error(), nil
+	}
+	return http.StatusOK, string(jsonData), nil
+}
+
+func inventoryAutoScaling(ctx context.Context, autoScalingGroupName string, port int, requestType string, jsonData []byte) (int, string, error) {
 	log := util.HappoAgentLogger()
 
 	autoScaling, err := autoscaling.AutoScaling(AutoScalingConfigFile)
@@ -340,19 +554,21 @@ func inventoryAutoScaling(autoScalingGroupName string, port int, requestType str
 		return http.StatusServiceUnavailable, "", err
 	}
 
-	return postToAgent(ip, port, requestType, jsonData)
+	return postToAgent(ctx, ip, port, requestType, jsonData)
 }
 
-func postToAutoScalingAgent(host string, port int, requestType string, jsonData []byte, autoScalingGroupName string) (int, string, error) {
+func postToAutoScalingAgent(ctx context.Context, host string, port int, requestType string, jsonData []byte, autoScalingGroupName string) (int, string, error) {
 	switch requestType {
 	case "monitor":
-		return monitorAutoScaling(host, port, requestType, jsonData, autoScalingGroupName)
-	case "metric":
-		return metricAutoScaling(host, port, requestType, jsonData)
+		return monitorAutoScaling(ctx, host, port, requestType, jsonData, autoScalingGroupName)
+	case "metric", "metric/ack":
+		return metricAutoScaling(ctx, host, port, requestType, jsonData)
 	case "metric/config/update":
-		return metricConfigUpdateAutoScaling(host, port, requestType, jsonData)
+		return metricConfigUpdateAutoScaling(ctx, host, port, requestType, jsonData)
+	case "metric/config":
+		return metricConfigAutoScaling(host)
 	case "inventory":
-		return inventoryAutoScaling(host, port, requestType, jsonData)
+		return inventoryAutoScaling(ctx, host, port, requestType, jsonData)
 	default:
 		return http.StatusBadRequest, "request_type unsupported", nil
 	}
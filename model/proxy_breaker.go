@@ -0,0 +1,115 @@
+package model
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+)
+
+var (
+	// ProxyBreakerFailures is number of consecutive failures to next hop which opens circuit(when 0, disable)
+	ProxyBreakerFailures = halib.DefaultProxyBreakerFailures
+	// ProxyBreakerOpenSeconds is seconds of open circuit until half-open probe is allowed
+	ProxyBreakerOpenSeconds int64 = halib.DefaultProxyBreakerOpenSeconds
+
+	proxyBreakers = &breakers{hops: map[string]*breaker{}}
+)
+
+type breakers struct {
+	mu   sync.Mutex
+	hops map[string]*breaker
+}
+
+// breaker is circuit breaker of a next hop.
+// closed(failures < ProxyBreakerFailures) -> open(openedAt is set) -> half-open(one probe is allowed) -> closed or open
+type breaker struct {
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// allow returns false if circuit of hostport is open. in half-open, only one probe is allowed until report
+func (b *breakers) allow(hostport string, now time.Time) bool {
+	if ProxyBreakerFailures <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	hop, ok := b.hops[hostport]
+	if !ok || hop.openedAt.IsZero() {
+		return true
+	}
+	if now.Sub(hop.openedAt) < time.Duration(ProxyBreakerOpenSeconds)*time.Second || hop.probing {
+		return false
+	}
+	hop.probing = true
+	return true
+}
+
+// report records result of request to hostport
+func (b *breakers) report(hostport string, success bool, now time.Time) {
+	if ProxyBreakerFailures <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if success {
+		delete(b.hops, hostport)
+		return
+	}
+	hop, ok := b.hops[hostport]
+	if !ok {
+		hop = &breaker{}
+		b.hops[hostport] = hop
+	}
+	hop.failures++
+	if hop.probing || hop.failures >= ProxyBreakerFailures {
+		hop.openedAt = now
+	}
+	hop.probing = false
+}
+
+// release ends half-open probe of hostport without result, e.g. when request was not sent to hostport
+func (b *breakers) release(hostport string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if hop, ok := b.hops[hostport]; ok {
+		hop.probing = false
+	}
+}
+
+// reportProxyResult records result of request to hostport, unless deadline or cancel of caller(ctx) ended it,
+// which is not failure of hostport
+func reportProxyResult(ctx context.Context, hostport string, err error) {
+	if ctx.Err() != nil {
+		proxyBreakers.release(hostport)
+		return
+	}
+	proxyBreakers.report(hostport, err == nil || isResponseTooLarge(err), time.Now())
+}
+
+// GetProxyBreakerStatus returns circuit breaker of next hops(host:port) which have failures
+func GetProxyBreakerStatus() map[string]map[string]int64 {
+	proxyBreakers.mu.Lock()
+	defer proxyBreakers.mu.Unlock()
+
+	status := map[string]map[string]int64{}
+	for hostport, hop := range proxyBreakers.hops {
+		openedAt := int64(0)
+		if !hop.openedAt.IsZero() {
+			openedAt = hop.openedAt.Unix()
+		}
+		status[hostport] = map[string]int64{
+			"consecutive_failures": int64(hop.failures),
+			"opened_at":            openedAt,
+		}
+	}
+	return status
+}
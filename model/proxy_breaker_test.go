@@ -0,0 +1,155 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/autoscaling"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreakers1(t *testing.T) {
+	origFailures := ProxyBreakerFailures
+	ProxyBreakerFailures = 2
+	defer func() { ProxyBreakerFailures = origFailures }()
+
+	b := &breakers{hops: map[string]*breaker{}}
+	now := time.Unix(1500000000, 0)
+	const hostport = "192.0.2.1:6777"
+
+	// closed
+	assert.True(t, b.allow(hostport, now))
+	b.report(hostport, false, now)
+	assert.True(t, b.allow(hostport, now))
+	b.report(hostport, false, now)
+
+	// open
+	assert.False(t, b.allow(hostport, now.Add(29*time.Second)))
+	assert.Equal(t, 2, b.hops[hostport].failures)
+
+	// half-open. only one probe is allowed
+	assert.True(t, b.allow(hostport, now.Add(30*time.Second)))
+	assert.False(t, b.allow(hostport, now.Add(30*time.Second)))
+	b.report(hostport, false, now.Add(31*time.Second))
+	assert.False(t, b.allow(hostport, now.Add(60*time.Second)))
+
+	// closed by successful probe
+	assert.True(t, b.allow(hostport, now.Add(61*time.Second)))
+	b.report(hostport, true, now.Add(61*time.Second))
+	assert.True(t, b.allow(hostport, now.Add(61*time.Second)))
+	assert.Equal(t, 0, len(b.hops))
+
+	// probe released without result
+	b.report(hostport, false, now.Add(62*time.Second))
+	b.report(hostport, false, now.Add(62*time.Second))
+	assert.True(t, b.allow(hostport, now.Add(92*time.Second)))
+	assert.False(t, b.allow(hostport, now.Add(92*time.Second)))
+	b.release(hostport)
+	assert.True(t, b.allow(hostport, now.Add(92*time.Second)))
+	b.report(hostport, true, now.Add(92*time.Second))
+
+	// disabled
+	ProxyBreakerFailures = 0
+	b.report(hostport, false, now)
+	assert.Equal(t, 0, len(b.hops))
+}
+
+func TestProxyBreaker1(t *testing.T) {
+	// fail fast and use alternative route when circuit open
+	origFailures := ProxyBreakerFailures
+	ProxyBreakerFailures = 1
+	defer func() { ProxyBreakerFailures = origFailures }()
+
+	//dead edge
+	dead := httptest.NewTLSServer(http.NotFoundHandler())
+	deadHostport := strings.TrimPrefix(dead.URL, "https://")
+	dead.Close()
+	defer delete(proxyBreakers.hops, deadHostport)
+
+	//alternative edge
+	ts := httptest.NewTLSServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, `{"return_value":0,"message":"ok"}`)
+			}))
+	defer ts.Close()
+	hostport := strings.TrimPrefix(ts.URL, "https://")
+
+	proxyRequest := halib.ProxyRequest{
+		ProxyHostPort: []string{deadHostport},
+		RequestType:   "monitor",
+		RequestJSON:   []byte("{}"),
+	}
+	statusCode, _, trace := proxy(context.Background(), proxyRequest, &autoscaling.AWSClient{})
+	assert.NotEqual(t, http.StatusOK, statusCode)
+	assert.NotEqual(t, "circuit open", trace[0].Error)
+
+	// circuit open
+	statusCode, response, trace := proxy(context.Background(), proxyRequest, &autoscaling.AWSClient{})
+	assert.Equal(t, http.StatusServiceUnavailable, statusCode)
+	assert.Equal(t, "circuit open", trace[0].Error)
+	assert.Contains(t, response, fmt.Sprintf("failed to proxy to %s: circuit open", deadHostport))
+	assert.Equal(t, int64(1), GetProxyBreakerStatus()[deadHostport]["consecutive_failures"])
+
+	// alternative route
+	proxyRequest.AlternativeProxyHostPort = [][]string{{hostport}}
+	statusCode, response, trace = proxy(context.Background(), proxyRequest, &autoscaling.AWSClient{})
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, `{"return_value":0,"message":"ok"}`, response)
+	assert.Equal(t, hostport, trace[0].Next)
+}
+
+func TestProxyBreaker2(t *testing.T) {
+	// half-open probe is released when request is rejected before sent
+	origFailures := ProxyBreakerFailures
+	ProxyBreakerFailures = 1
+	defer func() { ProxyBreakerFailures = origFailures }()
+
+	const hostport = "192.0.2.1:6777"
+	now := time.Now()
+	proxyBreakers.report(hostport, false, now.Add(-1*time.Duration(ProxyBreakerOpenSeconds)*time.Second))
+	defer proxyBreakers.report(hostport, true, now)
+
+	proxyRequest := halib.ProxyRequest{
+		ProxyHostPort: []string{hostport},
+		RequestType:   "monitor",
+		Method:        "DELETE",
+		Path:          "/metric",
+	}
+	statusCode, _, _ := proxy(context.Background(), proxyRequest, &autoscaling.AWSClient{})
+	assert.Equal(t, http.StatusForbidden, statusCode)
+	assert.True(t, proxyBreakers.allow(hostport, now))
+}
+
+func TestProxyBreaker3(t *testing.T) {
+	// deadline of caller is not failure of next hop
+	origFailures := ProxyBreakerFailures
+	ProxyBreakerFailures = 1
+	defer func() { ProxyBreakerFailures = origFailures }()
+
+	ts := httptest.NewTLSServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(200 * time.Millisecond)
+				fmt.Fprint(w, `{"return_value":0,"message":"ok"}`)
+			}))
+	defer ts.Close()
+	hostport := strings.TrimPrefix(ts.URL, "https://")
+
+	proxyRequest := halib.ProxyRequest{
+		ProxyHostPort: []string{hostport},
+		RequestType:   "monitor",
+		RequestJSON:   []byte("{}"),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	statusCode, _, _ := proxy(ctx, proxyRequest, &autoscaling.AWSClient{})
+	assert.Equal(t, http.StatusGatewayTimeout, statusCode)
+	assert.NotContains(t, GetProxyBreakerStatus(), hostport)
+}
@@ -0,0 +1,97 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/codegangsta/martini-contrib/render"
+	"github.com/heartbeatsjp/happo-agent/autoscaling"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+)
+
+var (
+	// ProxyMultiConcurrency is max number of targets requested at once by /proxy/multi
+	ProxyMultiConcurrency = halib.DefaultProxyMultiConcurrency
+	// ProxyMultiMaxTargets is max number of targets in one /proxy/multi request(when 0, unlimited)
+	ProxyMultiMaxTargets = halib.DefaultProxyMultiMaxTargets
+)
+
+// ProxyMulti sends one request to many targets via Proxy, with bounded concurrency and timeout of each target.
+// deadline of caller(X-Happo-Timeout-Ms header) is applied to all targets.
+// results are returned in order of targets
+func ProxyMulti(request halib.ProxyMultiRequest, r render.Render, client *autoscaling.AWSClient, req *http.Request) {
+	log := util.HappoAgentLogger()
+	var response halib.ProxyMultiResponse
+
+	ctx, cancel := requestContext(req)
+	defer cancel()
+
+	if len(request.Targets) == 0 {
+		response.Message = "targets required"
+		r.JSON(http.StatusBadRequest, response)
+		return
+	}
+	if ProxyMultiMaxTargets > 0 && len(request.Targets) > ProxyMultiMaxTargets {
+		response.Message = fmt.Sprintf("too many targets: %d > %d", len(request.Targets), ProxyMultiMaxTargets)
+		r.JSON(http.StatusRequestEntityTooLarge, response)
+		return
+	}
+	for i, target := range request.Targets {
+		if len(target) == 0 {
+			response.Message = fmt.Sprintf("targets[%d] is empty", i)
+			r.JSON(http.StatusBadRequest, response)
+			return
+		}
+	}
+
+	concurrency := ProxyMultiConcurrency
+	if request.Concurrency > 0 && request.Concurrency < concurrency {
+		concurrency = request.Concurrency
+	}
+	timeout := _httpClient.Timeout
+	if request.TimeoutSeconds > 0 && (timeout == 0 || time.Duration(request.TimeoutSeconds)*time.Second < timeout) {
+		timeout = time.Duration(request.TimeoutSeconds) * time.Second
+	}
+	log.Debugf("/proxy/multi: %d targets, concurrency %d, timeout %s", len(request.Targets), concurrency, timeout)
+
+	response.Results = make([]halib.ProxyMultiResult, len(request.Targets))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, target := range request.Targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, target []string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			statusCode, body, trace := proxyWithTimeout(ctx, halib.ProxyRequest{
+				ProxyHostPort:  target,
+				RequestType:    request.RequestType,
+				RequestJSON:    request.RequestJSON,
+				TraceInMessage: request.TraceInMessage,
+			}, client, timeout)
+			response.Results[i] = halib.ProxyMultiResult{
+				ProxyHostPort: target,
+				StatusCode:    statusCode,
+				Response:      body,
+				Trace:         trace,
+			}
+		}(i, target)
+	}
+	wg.Wait()
+
+	r.JSON(http.StatusOK, response)
+}
+
+// proxyWithTimeout is proxy which is canceled in timeout(when 0, no timeout)
+func proxyWithTimeout(ctx context.Context, proxyRequest halib.ProxyRequest, client *autoscaling.AWSClient, timeout time.Duration) (int, string, []halib.ProxyTraceHop) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return proxy(ctx, proxyRequest, client)
+}
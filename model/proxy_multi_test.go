@@ -0,0 +1,93 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/martini-contrib/render"
+	"github.com/go-martini/martini"
+	"github.com/heartbeatsjp/happo-agent/autoscaling"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/martini-contrib/binding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyMulti1(t *testing.T) {
+	//bastion
+	m := martini.Classic()
+	m.Use(render.Renderer())
+	m.Post("/proxy/multi", binding.Json(halib.ProxyMultiRequest{}), ProxyMulti)
+	m.Map(&autoscaling.AWSClient{})
+
+	//edges
+	newEdge := func(sleep time.Duration, body string) (*httptest.Server, string) {
+		ts := httptest.NewTLSServer(
+			http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					time.Sleep(sleep)
+					fmt.Fprint(w, body)
+				}))
+		host, port, _ := net.SplitHostPort(strings.TrimPrefix(ts.URL, "https://"))
+		return ts, fmt.Sprintf("%s:%s", host, port)
+	}
+	ts1, edge1 := newEdge(0, `{"return_value":0,"message":"edge1"}`)
+	defer ts1.Close()
+	ts2, edge2 := newEdge(1500*time.Millisecond, `{"return_value":0,"message":"edge2"}`)
+	defer ts2.Close()
+
+	requestJSON := fmt.Sprintf(`{
+		"targets": [["%s"], ["%s"], ["%s"]],
+		"request_type": "monitor",
+		"request_json": "e30=",
+		"concurrency": 2,
+		"timeout_seconds": 1
+	}`, edge1, edge2, edge1)
+	req, _ := http.NewRequest("POST", "/proxy/multi", bytes.NewReader([]byte(requestJSON)))
+	req.Header.Set("Content-Type", "application/json")
+	res := httptest.NewRecorder()
+	m.ServeHTTP(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	var response halib.ProxyMultiResponse
+	assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &response))
+	assert.Equal(t, 3, len(response.Results))
+	assert.Equal(t, []string{edge1}, response.Results[0].ProxyHostPort)
+	assert.Equal(t, http.StatusOK, response.Results[0].StatusCode)
+	assert.Equal(t, `{"return_value":0,"message":"edge1"}`, response.Results[0].Response)
+	assert.Equal(t, []string{edge2}, response.Results[1].ProxyHostPort)
+	assert.Equal(t, http.StatusGatewayTimeout, response.Results[1].StatusCode)
+	assert.Equal(t, http.StatusOK, response.Results[2].StatusCode)
+}
+
+func TestProxyMulti2(t *testing.T) {
+	m := martini.Classic()
+	m.Use(render.Renderer())
+	m.Post("/proxy/multi", binding.Json(halib.ProxyMultiRequest{}), ProxyMulti)
+	m.Map(&autoscaling.AWSClient{})
+
+	origMaxTargets := ProxyMultiMaxTargets
+	ProxyMultiMaxTargets = 2
+	defer func() { ProxyMultiMaxTargets = origMaxTargets }()
+
+	for _, tc := range []struct {
+		requestJSON string
+		code        int
+	}{
+		{`{"targets": [], "request_type": "monitor"}`, http.StatusBadRequest},
+		{`{"targets": [["192.0.2.1:6777"], []], "request_type": "monitor"}`, http.StatusBadRequest},
+		{`{"targets": [["192.0.2.1:6777"], ["192.0.2.2:6777"], ["192.0.2.3:6777"]], "request_type": "monitor"}`, http.StatusRequestEntityTooLarge},
+	} {
+		req, _ := http.NewRequest("POST", "/proxy/multi", bytes.NewReader([]byte(tc.requestJSON)))
+		req.Header.Set("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		m.ServeHTTP(res, req)
+		assert.Equal(t, tc.code, res.Code, tc.requestJSON)
+	}
+}
@@ -0,0 +1,55 @@
+package model
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+)
+
+// ProxyAllowedRoutes is routes(`<method> <path glob>`) forwardable by /proxy with path
+var ProxyAllowedRoutes = strings.Split(halib.DefaultProxyAllowedRoutes, ",")
+
+// reservedProxyHeaders are headers which can not be set by /proxy with path.
+// Accept-Encoding is reserved because Content-Encoding of response is not relayed to caller
+var reservedProxyHeaders = []string{"Host", "Content-Length", "Connection", "Transfer-Encoding", "Upgrade", "Accept-Encoding"}
+
+// validateProxyRoute returns error if method, path, query or headers of proxyRequest is not allowed
+func validateProxyRoute(proxyRequest halib.ProxyRequest) error {
+	method := proxyRequest.Method
+	if method == "" {
+		method = "GET"
+	}
+	requestPath := proxyRequest.Path
+	if !strings.HasPrefix(requestPath, "/") || path.Clean(requestPath) != requestPath {
+		return fmt.Errorf("invalid path: %s", requestPath)
+	}
+	if _, err := url.ParseQuery(proxyRequest.Query); err != nil {
+		return fmt.Errorf("invalid query: %s", proxyRequest.Query)
+	}
+	for name := range proxyRequest.Headers {
+		name = http.CanonicalHeaderKey(name)
+		if strings.HasPrefix(name, "X-Happo-") {
+			return fmt.Errorf("header not allowed: %s", name)
+		}
+		for _, reserved := range reservedProxyHeaders {
+			if name == reserved {
+				return fmt.Errorf("header not allowed: %s", name)
+			}
+		}
+	}
+
+	for _, route := range ProxyAllowedRoutes {
+		fields := strings.Fields(route)
+		if len(fields) != 2 || fields[0] != method {
+			continue
+		}
+		if matched, _ := path.Match(fields[1], requestPath); matched {
+			return nil
+		}
+	}
+	return fmt.Errorf("route not allowed: %s %s", method, requestPath)
+}
@@ -0,0 +1,90 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/heartbeatsjp/happo-agent/autoscaling"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyRoute1(t *testing.T) {
+	// GET route via proxy
+	//edge
+	ts := httptest.NewTLSServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "GET", r.Method)
+				assert.Equal(t, "/status/memory", r.URL.Path)
+				assert.Equal(t, "verbose=1", r.URL.RawQuery)
+				assert.Equal(t, "ja", r.Header.Get("Accept-Language"))
+				fmt.Fprint(w, `{"runtime_mem_stats":{}}`)
+			}))
+	defer ts.Close()
+	hostport := strings.TrimPrefix(ts.URL, "https://")
+
+	proxyRequest := halib.ProxyRequest{
+		ProxyHostPort: []string{hostport},
+		Path:          "/status/memory",
+		Query:         "verbose=1",
+		Headers:       map[string]string{"Accept-Language": "ja"},
+	}
+	statusCode, response, _ := proxy(context.Background(), proxyRequest, &autoscaling.AWSClient{})
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, `{"runtime_mem_stats":{}}`, response)
+}
+
+func TestProxyRoute2(t *testing.T) {
+	// route not allowed
+	ts := httptest.NewTLSServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			}))
+	defer ts.Close()
+	hostport := strings.TrimPrefix(ts.URL, "https://")
+
+	proxyRequest := halib.ProxyRequest{
+		ProxyHostPort: []string{hostport},
+		Method:        "POST",
+		Path:          "/status",
+	}
+	statusCode, response, trace := proxy(context.Background(), proxyRequest, &autoscaling.AWSClient{})
+	assert.Equal(t, http.StatusForbidden, statusCode)
+	assert.Contains(t, response, "route not allowed: POST /status")
+	assert.Equal(t, http.StatusForbidden, trace[0].StatusCode)
+}
+
+func TestValidateProxyRoute1(t *testing.T) {
+	var cases = []struct {
+		name         string
+		proxyRequest halib.ProxyRequest
+		expected     string
+	}{
+		{"default method", halib.ProxyRequest{Path: "/status"}, ""},
+		{"glob", halib.ProxyRequest{Method: "GET", Path: "/machine-state/1500000000_0"}, ""},
+		{"not allowed", halib.ProxyRequest{Path: "/metric/config/update"}, "route not allowed: GET /metric/config/update"},
+		{"unclean path", halib.ProxyRequest{Path: "/machine-state/../metric/config/update"}, "invalid path: /machine-state/../metric/config/update"},
+		{"relative path", halib.ProxyRequest{Path: "status"}, "invalid path: status"},
+		{"invalid query", halib.ProxyRequest{Path: "/status", Query: "a=%zz"}, "invalid query: a=%zz"},
+		{"reserved header", halib.ProxyRequest{Path: "/status", Headers: map[string]string{"host": "example.com"}}, "header not allowed: Host"},
+		{"encoding header", halib.ProxyRequest{Path: "/status", Headers: map[string]string{"accept-encoding": "gzip"}}, "header not allowed: Accept-Encoding"},
+		{"happo header", halib.ProxyRequest{Path: "/status", Headers: map[string]string{"X-Happo-Timeout-Ms": "1"}}, "header not allowed: X-Happo-Timeout-Ms"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := validateProxyRoute(c.proxyRequest)
+			if c.expected == "" {
+				assert.Nil(t, err)
+			} else {
+				assert.EqualError(t, err, c.expected)
+			}
+		})
+	}
+}
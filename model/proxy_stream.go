@@ -0,0 +1,159 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+)
+
+// ProxyMaxResponseBytes is max bytes of response relayed by /proxy for each request_type. `*` is for other request_type(when 0 or missing, unlimited)
+var ProxyMaxResponseBytes, _ = ParseProxyMaxResponseBytes(halib.DefaultProxyMaxResponseBytes)
+
+// ParseProxyMaxResponseBytes parses comma separated `<request_type>=<bytes>`
+func ParseProxyMaxResponseBytes(value string) (map[string]int64, error) {
+	limits := map[string]int64{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid proxy max response bytes: %s", entry)
+		}
+		limit, err := strconv.ParseInt(strings.TrimSpace(kv[1]), 10, 64)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid proxy max response bytes: %s", entry)
+		}
+		limits[strings.TrimSpace(kv[0])] = limit
+	}
+	return limits, nil
+}
+
+// proxyResponseLimit is max bytes of response for request_type
+type proxyResponseLimit struct {
+	requestType string
+	bytes       int64
+}
+
+type proxyResponseLimitKey struct{}
+
+func proxyMaxResponseBytes(requestType string) proxyResponseLimit {
+	limit, ok := ProxyMaxResponseBytes[requestType]
+	if !ok {
+		limit = ProxyMaxResponseBytes["*"]
+	}
+	return proxyResponseLimit{requestType: requestType, bytes: limit}
+}
+
+func withProxyMaxResponseBytes(ctx context.Context, limit proxyResponseLimit) context.Context {
+	return context.WithValue(ctx, proxyResponseLimitKey{}, limit)
+}
+
+// responseTooLargeError is error of response exceeding ProxyMaxResponseBytes
+type responseTooLargeError struct {
+	limit proxyResponseLimit
+}
+
+func (e *responseTooLargeError) Error() string {
+	return fmt.Sprintf("response too large: exceeds %d bytes of request_type %q", e.limit.bytes, e.limit.requestType)
+}
+
+func isResponseTooLarge(err error) bool {
+	_, ok := err.(*responseTooLargeError)
+	return ok
+}
+
+// readProxyResponseBody reads body of resp up to limit set to ctx by withProxyMaxResponseBytes
+func readProxyResponseBody(ctx context.Context, resp *http.Response) ([]byte, error) {
+	limit, _ := ctx.Value(proxyResponseLimitKey{}).(proxyResponseLimit)
+	if limit.bytes <= 0 {
+		return ioutil.ReadAll(resp.Body)
+	}
+	if resp.ContentLength > limit.bytes {
+		return nil, &responseTooLargeError{limit: limit}
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit.bytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit.bytes {
+		return nil, &responseTooLargeError{limit: limit}
+	}
+	return body, nil
+}
+
+// streamable returns true when response of next hop can be relayed without rewriting
+func (call *proxyCall) streamable() bool {
+	return call.config.AutoScalingGroupName == "" && !(call.traceInMessage && call.proxyRequest.RequestType == "monitor")
+}
+
+// stream sends request to next hop and relays response body to w as it arrives, without buffering whole body
+func (call *proxyCall) stream(ctx context.Context, w http.ResponseWriter) {
+	log := util.HappoAgentLogger()
+	proxyRequest := call.proxyRequest
+	limit := proxyMaxResponseBytes(proxyRequest.RequestType)
+
+	var resp *http.Response
+	var respCode int
+	var err error
+	if call.lastHop && proxyRequest.Path != "" {
+		// last proxy to route other than request_type
+		resp, respCode, err = openAgentRequest(ctx, call.nextHost, call.nextPort, proxyRequest.Method, proxyRequest.Path, proxyRequest.Query, proxyRequest.Headers, call.requestJSON)
+	} else {
+		resp, respCode, err = openAgentRequest(ctx, call.nextHost, call.nextPort, "POST", "/"+call.requestType, "", map[string]string{"Content-Type": "application/json"}, call.requestJSON)
+	}
+	if err == nil && limit.bytes > 0 && resp.ContentLength > limit.bytes {
+		resp.Body.Close()
+		respCode, err = http.StatusBadGateway, &responseTooLargeError{limit: limit}
+	}
+
+	hop := newProxyTraceHop(fmt.Sprintf("%s:%d", call.nextHost, call.nextPort), call.startAt, respCode, err)
+	reportProxyResult(ctx, hop.Next, err)
+	if err != nil {
+		setProxyTraceHeader(w.Header(), []halib.ProxyTraceHop{hop})
+		w.WriteHeader(respCode)
+		io.WriteString(w, makeProxyErrorResponse(hop))
+		return
+	}
+	defer resp.Body.Close()
+
+	setProxyTraceHeader(w.Header(), append([]halib.ProxyTraceHop{hop}, getProxyTraceHeader(resp.Header)...))
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	body := io.Reader(resp.Body)
+	if limit.bytes > 0 {
+		body = io.LimitReader(resp.Body, limit.bytes+1)
+	}
+	n, err := io.Copy(w, body)
+	if err == nil && limit.bytes > 0 && n > limit.bytes {
+		err = &responseTooLargeError{limit: limit}
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf("%s: failed to relay response of %s: %s", hop.Hop, hop.Next, err.Error()))
+		abortProxyResponse(w)
+	}
+}
+
+// abortProxyResponse closes connection to caller, so that caller can detect incomplete response after status code has been sent
+func abortProxyResponse(w http.ResponseWriter) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	conn.Close()
+}
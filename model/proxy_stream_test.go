@@ -0,0 +1,162 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/codegangsta/martini-contrib/render"
+	"github.com/go-martini/martini"
+	"github.com/heartbeatsjp/happo-agent/autoscaling"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+	"github.com/martini-contrib/binding"
+	"github.com/stretchr/testify/assert"
+)
+
+func newStreamBastion(gzip bool) *martini.ClassicMartini {
+	m := martini.Classic()
+	if gzip {
+		m.Use(util.Gzip())
+	}
+	m.Use(render.Renderer())
+	m.Post("/proxy", binding.Json(halib.ProxyRequest{}), Proxy)
+	m.Map(&autoscaling.AWSClient{})
+	return m
+}
+
+// newStreamEdge returns edge which returns size bytes of inventory. when chunked, Content-Length is not sent
+func newStreamEdge(size int, chunked bool) *httptest.Server {
+	return httptest.NewTLSServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				if !chunked {
+					w.Header().Set("Content-Length", fmt.Sprint(size))
+				}
+				for i := 0; i < size; i += 100 {
+					fmt.Fprint(w, strings.Repeat("x", 100))
+					w.(http.Flusher).Flush()
+				}
+			}))
+}
+
+func TestProxyStream1(t *testing.T) {
+	// streamed up to limit
+	origLimits := ProxyMaxResponseBytes
+	ProxyMaxResponseBytes = map[string]int64{"inventory": 1000, "*": 0}
+	defer func() { ProxyMaxResponseBytes = origLimits }()
+
+	edge := newStreamEdge(1000, true)
+	defer edge.Close()
+
+	requestJSON := fmt.Sprintf(`{"proxy_hostport": ["%s"], "request_type": "inventory", "request_json": "e30="}`, strings.TrimPrefix(edge.URL, "https://"))
+	req, _ := http.NewRequest("POST", "/proxy", bytes.NewReader([]byte(requestJSON)))
+	req.Header.Set("Content-Type", "application/json")
+	res := httptest.NewRecorder()
+	newStreamBastion(false).ServeHTTP(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "application/json", res.Header().Get("Content-Type"))
+	assert.NotEmpty(t, res.Header().Get(halib.ProxyTraceHeader))
+	assert.Equal(t, 1000, res.Body.Len())
+}
+
+func TestProxyStream2(t *testing.T) {
+	// Content-Length exceeds limit
+	origLimits := ProxyMaxResponseBytes
+	ProxyMaxResponseBytes = map[string]int64{"inventory": 1000, "*": 0}
+	defer func() { ProxyMaxResponseBytes = origLimits }()
+
+	edge := newStreamEdge(1100, false)
+	defer edge.Close()
+
+	requestJSON := fmt.Sprintf(`{"proxy_hostport": ["%s"], "request_type": "inventory", "request_json": "e30="}`, strings.TrimPrefix(edge.URL, "https://"))
+	req, _ := http.NewRequest("POST", "/proxy", bytes.NewReader([]byte(requestJSON)))
+	req.Header.Set("Content-Type", "application/json")
+	res := httptest.NewRecorder()
+	newStreamBastion(false).ServeHTTP(res, req)
+
+	assert.Equal(t, http.StatusBadGateway, res.Code)
+	assert.Contains(t, res.Body.String(), `response too large: exceeds 1000 bytes of request_type \"inventory\"`)
+}
+
+func TestProxyStream3(t *testing.T) {
+	// chunked response exceeds limit while streaming. connection to caller is aborted
+	origLimits := ProxyMaxResponseBytes
+	ProxyMaxResponseBytes = map[string]int64{"inventory": 1000, "*": 0}
+	defer func() { ProxyMaxResponseBytes = origLimits }()
+
+	edge := newStreamEdge(5000, true)
+	defer edge.Close()
+	bastion := httptest.NewTLSServer(newStreamBastion(false))
+	defer bastion.Close()
+
+	requestJSON := fmt.Sprintf(`{"proxy_hostport": ["%s"], "request_type": "inventory", "request_json": "e30="}`, strings.TrimPrefix(edge.URL, "https://"))
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Post(bastion.URL+"/proxy", "application/json", bytes.NewReader([]byte(requestJSON)))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = ioutil.ReadAll(resp.Body)
+	assert.NotNil(t, err)
+}
+
+func TestProxyStream4(t *testing.T) {
+	// limit of buffered response (e.g. /proxy/multi)
+	origLimits := ProxyMaxResponseBytes
+	ProxyMaxResponseBytes = map[string]int64{"*": 1000}
+	defer func() { ProxyMaxResponseBytes = origLimits }()
+
+	edge := newStreamEdge(1100, true)
+	defer edge.Close()
+	hostport := strings.TrimPrefix(edge.URL, "https://")
+
+	proxyRequest := halib.ProxyRequest{
+		ProxyHostPort: []string{hostport},
+		RequestType:   "metric",
+		RequestJSON:   []byte("{}"),
+	}
+	statusCode, response, trace := proxy(context.Background(), proxyRequest, &autoscaling.AWSClient{})
+	assert.Equal(t, http.StatusBadGateway, statusCode)
+	assert.Contains(t, response, `response too large: exceeds 1000 bytes of request_type \"metric\"`)
+	// too large response is not failure of next hop
+	assert.NotContains(t, GetProxyBreakerStatus(), trace[0].Next)
+}
+
+func TestProxyStream5(t *testing.T) {
+	// gzip between hops
+	edge := newStreamEdge(1000, true)
+	defer edge.Close()
+	bastion := httptest.NewTLSServer(newStreamBastion(true))
+	defer bastion.Close()
+
+	requestJSON := fmt.Sprintf(`{"proxy_hostport": ["%s", "%s"], "request_type": "inventory", "request_json": "e30="}`,
+		strings.TrimPrefix(bastion.URL, "https://"), strings.TrimPrefix(edge.URL, "https://"))
+	req, _ := http.NewRequest("POST", "/proxy", bytes.NewReader([]byte(requestJSON)))
+	req.Header.Set("Content-Type", "application/json")
+	res := httptest.NewRecorder()
+	newStreamBastion(false).ServeHTTP(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, strings.Repeat("x", 1000), res.Body.String())
+}
+
+func TestParseProxyMaxResponseBytes1(t *testing.T) {
+	limits, err := ParseProxyMaxResponseBytes("*=67108864, inventory=0,monitor=1048576")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int64{"*": 67108864, "inventory": 0, "monitor": 1048576}, limits)
+
+	_, err = ParseProxyMaxResponseBytes("monitor")
+	assert.EqualError(t, err, "invalid proxy max response bytes: monitor")
+	_, err = ParseProxyMaxResponseBytes("monitor=-1")
+	assert.EqualError(t, err, "invalid proxy max response bytes: monitor=-1")
+}
@@ -2,6 +2,7 @@ package model
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/gob"
 	"encoding/json"
@@ -85,7 +86,7 @@ func TestPostToAgent1(t *testing.T) {
 	port, _ := strconv.Atoi(found[3])
 
 	jsonData := []byte("{}")
-	statusCode, response, err := postToAgent(host, port, "test", jsonData)
+	statusCode, response, err := postToAgent(context.Background(), host, port, "test", jsonData)
 	assert.EqualValues(t, http.StatusOK, statusCode)
 	assert.Contains(t, response, stubResponse)
 	assert.Nil(t, err)
@@ -107,7 +108,7 @@ func TestPostToAgent2(t *testing.T) {
 
 	timeout := _httpClient.Timeout
 	_httpClient.Timeout = 1 * time.Millisecond
-	statusCode, response, err := postToAgent(host, port, "test", []byte("{}"))
+	statusCode, response, err := postToAgent(context.Background(), host, port, "test", []byte("{}"))
 	_httpClient.Timeout = timeout
 
 	assert.EqualValues(t, http.StatusGatewayTimeout, statusCode)
@@ -131,7 +132,7 @@ func TestPostToAgent3(t *testing.T) {
 		found := re.FindStringSubmatch(ts.URL)
 		host := found[2]
 		port, _ := strconv.Atoi(found[3])
-		status_code, response, err := postToAgent(host, port, "test", []byte("{}"))
+		status_code, response, err := postToAgent(context.Background(), host, port, "test", []byte("{}"))
 
 		assert.EqualValues(t, status_code, http.StatusBadGateway)
 		assert.Contains(t, response, "")
@@ -152,7 +153,7 @@ func TestPostToAgent4(t *testing.T) {
 	found := re.FindStringSubmatch(ts.URL)
 	host := found[2]
 	port, _ := strconv.Atoi(found[3])
-	statusCode, response, err := postToAgent(host, port, "test", []byte("{}"))
+	statusCode, response, err := postToAgent(context.Background(), host, port, "test", []byte("{}"))
 
 	assert.EqualValues(t, http.StatusServiceUnavailable, statusCode)
 	assert.Contains(t, response, "error response")
@@ -263,7 +264,7 @@ func TestProxy2(t *testing.T) {
 	assert.Equal(t, http.StatusGatewayTimeout, res.Code)
 	assert.Regexp(t,
 		regexp.MustCompile(
-			fmt.Sprintf(`"return_value":3,"message":"Post https://%s:%d/monitor: net/http: request canceled .*(Client.Timeout exceeded while awaiting headers)`, host, port)),
+			fmt.Sprintf(`"return_value":3,"message":"%s: failed to proxy to %s:%d: Post \\?"?https://%s:%d/monitor\\?"?: net/http: request canceled .*\(Client.Timeout exceeded while awaiting headers\)`, proxyTraceName(), host, port, host, port)),
 		res.Body.String(),
 	)
 }
@@ -357,8 +358,9 @@ func TestProxy4(t *testing.T) {
 	_httpClient.Timeout = timeout
 
 	assert.Equal(t, http.StatusGatewayTimeout, res.Code)
-	assert.Equal(t,
-		fmt.Sprintf(`{"return_value":3,"message":"Post https://%s:%d/proxy: net/http: request canceled while waiting for connection (Client.Timeout exceeded while awaiting headers)"}`, host, port),
+	assert.Regexp(t,
+		regexp.MustCompile(
+			fmt.Sprintf(`^\{"return_value":3,"message":"%s: failed to proxy to %s:%d: Post \\?"?https://%s:%d/proxy\\?"?: net/http: request canceled while waiting for connection \(Client.Timeout exceeded while awaiting headers\)"\}$`, proxyTraceName(), host, port, host, port)),
 		res.Body.String(),
 	)
 }
@@ -1035,6 +1037,48 @@ func TestProxy18(t *testing.T) {
 	assert.Equal(t, "", res.Body.String())
 }
 
+func TestProxyMetricConfig1(t *testing.T) {
+	//proxy metric config returns config held by bastion
+
+	setup()
+	defer teardown()
+
+	//bastion
+	m := martini.Classic()
+	m.Use(render.Renderer())
+	m.Post("/proxy", binding.Json(halib.ProxyRequest{}), Proxy)
+	m.Map(&autoscaling.AWSClient{})
+
+	for _, tc := range []struct {
+		alias  string
+		code   int
+		status string
+	}{
+		{"dummy-prod-ag-dummy-prod-app-1", http.StatusOK, "OK"},
+		{"dummy-prod-ag-dummy-prod-app-9", http.StatusNotFound, "NG"},
+	} {
+		requestJSON := fmt.Sprintf(`{
+			"proxy_hostport": ["%s:%d"],
+			"request_type": "metric/config",
+			"request_json": "{\"apikey\": \"\"}"
+		}`, tc.alias, 6777)
+		req, _ := http.NewRequest("POST", "/proxy", bytes.NewReader([]byte(requestJSON)))
+		req.Header.Set("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		m.ServeHTTP(res, req)
+
+		assert.Equal(t, tc.code, res.Code)
+		var response halib.MetricConfigResponse
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &response))
+		assert.Equal(t, tc.status, response.Status)
+		if tc.code == http.StatusOK {
+			assert.Equal(t, []halib.MetricConfigSource{
+				{Path: "ag-" + tc.alias, Type: halib.MetricConfigSourceAutoScaling},
+			}, response.Sources)
+		}
+	}
+}
+
 func TestMain(m *testing.M) {
 	AutoScalingConfigFile = "../autoscaling/testdata/autoscaling_test_multi.yaml"
 	os.Exit(m.Run())
@@ -0,0 +1,93 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+)
+
+// ProxyTraceName is identity of this happo-agent in trace of /proxy (when empty, hostname)
+var ProxyTraceName string
+
+func proxyTraceName() string {
+	if ProxyTraceName != "" {
+		return ProxyTraceName
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+func newProxyTraceHop(next string, startAt time.Time, statusCode int, err error) halib.ProxyTraceHop {
+	hop := halib.ProxyTraceHop{
+		Hop:        proxyTraceName(),
+		Next:       next,
+		LatencyMs:  int64(time.Since(startAt) / time.Millisecond),
+		StatusCode: statusCode,
+	}
+	if err != nil {
+		hop.Error = err.Error()
+	}
+	return hop
+}
+
+// makeProxyErrorResponse returns monitor response with message naming failed hop
+func makeProxyErrorResponse(hop halib.ProxyTraceHop) string {
+	return makeMonitorResponse(halib.MonitorUnknown, fmt.Sprintf("%s: failed to proxy to %s: %s", hop.Hop, hop.Next, hop.Error))
+}
+
+func setProxyTraceHeader(header http.Header, trace []halib.ProxyTraceHop) {
+	value, err := json.Marshal(trace)
+	if err != nil {
+		return
+	}
+	header.Set(halib.ProxyTraceHeader, string(value))
+}
+
+// getProxyTraceHeader returns trace returned by next hop. returns nil when next hop is not a bastion
+func getProxyTraceHeader(header http.Header) []halib.ProxyTraceHop {
+	value := header.Get(halib.ProxyTraceHeader)
+	if value == "" {
+		return nil
+	}
+	var trace []halib.ProxyTraceHop
+	if err := json.Unmarshal([]byte(value), &trace); err != nil {
+		util.HappoAgentLogger().Warnf("invalid %s header: %s", halib.ProxyTraceHeader, err.Error())
+		return nil
+	}
+	return trace
+}
+
+// formatProxyTrace returns trace for human. e.g. `via bastion-a (12ms) -> bastion-b (timeout)`
+func formatProxyTrace(trace []halib.ProxyTraceHop) string {
+	var hops []string
+	for _, hop := range trace {
+		switch {
+		case hop.StatusCode == http.StatusGatewayTimeout:
+			hops = append(hops, fmt.Sprintf("%s (timeout)", hop.Hop))
+		case hop.Error != "":
+			hops = append(hops, fmt.Sprintf("%s (error)", hop.Hop))
+		default:
+			hops = append(hops, fmt.Sprintf("%s (%dms)", hop.Hop, hop.LatencyMs))
+		}
+	}
+	return "via " + strings.Join(hops, " -> ")
+}
+
+// addProxyTraceToMonitorResponse appends formatted trace to message of MonitorResponse.
+// response not MonitorResponse is returned as is
+func addProxyTraceToMonitorResponse(response string, trace []halib.ProxyTraceHop) string {
+	var monitorResponse halib.MonitorResponse
+	if err := json.Unmarshal([]byte(response), &monitorResponse); err != nil {
+		return response
+	}
+	if monitorResponse.Message != "" && !strings.HasSuffix(monitorResponse.Message, "\n") {
+		monitorResponse.Message += "\n"
+	}
+	return makeMonitorResponse(monitorResponse.ReturnValue, monitorResponse.Message+formatProxyTrace(trace)+"\n")
+}
@@ -0,0 +1,84 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/codegangsta/martini-contrib/render"
+	"github.com/go-martini/martini"
+	"github.com/heartbeatsjp/happo-agent/autoscaling"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/martini-contrib/binding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyTrace1(t *testing.T) {
+	// trace of multi proxy
+	origTraceName := ProxyTraceName
+	ProxyTraceName = "bastion"
+	defer func() { ProxyTraceName = origTraceName }()
+
+	newBastion := func() *martini.ClassicMartini {
+		m := martini.Classic()
+		m.Use(render.Renderer())
+		m.Post("/proxy", binding.Json(halib.ProxyRequest{}), Proxy)
+		m.Map(&autoscaling.AWSClient{})
+		return m
+	}
+
+	//edge
+	edge := httptest.NewTLSServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, `{"return_value":0,"message":"ok"}`)
+			}))
+	defer edge.Close()
+	//second bastion
+	bastion := httptest.NewTLSServer(newBastion())
+	defer bastion.Close()
+
+	edgeHostport := strings.TrimPrefix(edge.URL, "https://")
+	bastionHostport := strings.TrimPrefix(bastion.URL, "https://")
+	requestJSON := fmt.Sprintf(`{
+		"proxy_hostport": ["%s", "%s"],
+		"request_type": "monitor",
+		"request_json": "e30=",
+		"trace_in_message": true
+	}`, bastionHostport, edgeHostport)
+	req, _ := http.NewRequest("POST", "/proxy", bytes.NewReader([]byte(requestJSON)))
+	req.Header.Set("Content-Type", "application/json")
+	res := httptest.NewRecorder()
+	newBastion().ServeHTTP(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	var trace []halib.ProxyTraceHop
+	assert.Nil(t, json.Unmarshal([]byte(res.Header().Get(halib.ProxyTraceHeader)), &trace))
+	assert.Equal(t, 2, len(trace))
+	assert.Equal(t, "bastion", trace[0].Hop)
+	assert.Equal(t, bastionHostport, trace[0].Next)
+	assert.Equal(t, http.StatusOK, trace[0].StatusCode)
+	assert.Equal(t, edgeHostport, trace[1].Next)
+	assert.Equal(t, http.StatusOK, trace[1].StatusCode)
+
+	var monitorResponse halib.MonitorResponse
+	assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &monitorResponse))
+	assert.Regexp(t, `^ok\nvia bastion \(\d+ms\) -> bastion \(\d+ms\)\n$`, monitorResponse.Message)
+}
+
+func TestFormatProxyTrace1(t *testing.T) {
+	trace := []halib.ProxyTraceHop{
+		{Hop: "bastion-a", Next: "192.0.2.2:6777", LatencyMs: 12, StatusCode: http.StatusGatewayTimeout},
+		{Hop: "bastion-b", Next: "192.0.2.3:6777", LatencyMs: 3, StatusCode: http.StatusGatewayTimeout, Error: "timeout"},
+	}
+	assert.Equal(t, "via bastion-a (timeout) -> bastion-b (timeout)", formatProxyTrace(trace))
+
+	trace[0].StatusCode = http.StatusOK
+	trace[1].StatusCode = http.StatusServiceUnavailable
+	trace[1].Error = "connection refused"
+	assert.Equal(t, "via bastion-a (12ms) -> bastion-b (error)", formatProxyTrace(trace))
+}
@@ -0,0 +1,145 @@
+package model
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+)
+
+var (
+	// ProxyMaxIdleConnsPerHost is max idle (keep-alive) connections kept for each next hop
+	ProxyMaxIdleConnsPerHost = halib.DefaultProxyMaxIdleConnsPerHost
+	// ProxyIdleConnTimeoutSeconds is seconds of idle connection kept before closed
+	ProxyIdleConnTimeoutSeconds int64 = halib.DefaultProxyIdleConnTimeoutSeconds
+	// ProxyEnableHTTP2 enables HTTP/2 to next hop (when next hop supports it)
+	ProxyEnableHTTP2 bool
+
+	proxyTransports = &hopTransports{hops: map[string]*hopTransport{}}
+)
+
+// hopTransports is http.RoundTripper which has dedicated connection pool for each next hop(host:port)
+type hopTransports struct {
+	mu   sync.Mutex
+	hops map[string]*hopTransport
+}
+
+// hopTransport is connection pool of a next hop and its statistics
+type hopTransport struct {
+	transport       *http.Transport
+	requests        int64
+	reusedRequests  int64
+	openConnections int64
+}
+
+// countingConn decrements open connections of hop when closed
+type countingConn struct {
+	net.Conn
+	hop       *hopTransport
+	closeOnce sync.Once
+}
+
+func (c *countingConn) Close() error {
+	c.closeOnce.Do(func() { atomic.AddInt64(&c.hop.openConnections, -1) })
+	return c.Conn.Close()
+}
+
+// RoundTrip sends req via connection pool of req.URL.Host, or via tunnel when req is marked by withTunnelHostID
+func (h *hopTransports) RoundTrip(req *http.Request) (*http.Response, error) {
+	if hostID, ok := req.Context().Value(tunnelHostIDKey{}).(string); ok {
+		tunnel := proxyTunnels.get(hostID)
+		if tunnel == nil {
+			return nil, fmt.Errorf("tunnel of %s is not connected", hostID)
+		}
+		return tunnel.roundTrip(req)
+	}
+
+	hop := h.get(req.URL.Host)
+
+	atomic.AddInt64(&hop.requests, 1)
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddInt64(&hop.reusedRequests, 1)
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	return hop.transport.RoundTrip(req)
+}
+
+func (h *hopTransports) get(hostport string) *hopTransport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if hop, ok := h.hops[hostport]; ok {
+		return hop
+	}
+	hop := newHopTransport()
+	h.hops[hostport] = hop
+	return hop
+}
+
+func newHopTransport() *hopTransport {
+	hop := &hopTransport{}
+	hop.transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := util.OutboundDialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			atomic.AddInt64(&hop.openConnections, 1)
+			return &countingConn{Conn: conn, hop: hop}, nil
+		},
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		MaxIdleConns:          ProxyMaxIdleConnsPerHost,
+		MaxIdleConnsPerHost:   ProxyMaxIdleConnsPerHost,
+		IdleConnTimeout:       time.Duration(ProxyIdleConnTimeoutSeconds) * time.Second,
+		// custom DialContext and TLSClientConfig disable HTTP/2 unless forced
+		ForceAttemptHTTP2: ProxyEnableHTTP2,
+	}
+	return hop
+}
+
+// CloseIdleConnections closes idle connections of all next hops
+func (h *hopTransports) CloseIdleConnections() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, hop := range h.hops {
+		hop.transport.CloseIdleConnections()
+	}
+}
+
+// GetProxyPoolStatus returns statistics of connection pool for each next hop(host:port)
+func GetProxyPoolStatus() map[string]map[string]int64 {
+	proxyTransports.mu.Lock()
+	defer proxyTransports.mu.Unlock()
+
+	status := map[string]map[string]int64{}
+	for hostport, hop := range proxyTransports.hops {
+		requests := atomic.LoadInt64(&hop.requests)
+		reusedRequests := atomic.LoadInt64(&hop.reusedRequests)
+		reuseRatio := int64(0)
+		if requests > 0 {
+			reuseRatio = reusedRequests * 100 / requests
+		}
+		status[hostport] = map[string]int64{
+			"requests":            requests,
+			"reused_requests":     reusedRequests,
+			"reuse_ratio_percent": reuseRatio,
+			"open_connections":    atomic.LoadInt64(&hop.openConnections),
+		}
+	}
+	return status
+}
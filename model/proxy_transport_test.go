@@ -0,0 +1,45 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyTransport1(t *testing.T) {
+	// connection to same next hop is reused
+	ts := httptest.NewTLSServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "OK")
+			}))
+	defer ts.Close()
+	hostport := strings.TrimPrefix(ts.URL, "https://")
+	host, portString, _ := net.SplitHostPort(hostport)
+	port, _ := strconv.Atoi(portString)
+
+	for i := 0; i < 3; i++ {
+		statusCode, response, err := postToAgent(context.Background(), host, port, "test", []byte("{}"))
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, statusCode)
+		assert.Equal(t, "OK", response)
+	}
+
+	status := GetProxyPoolStatus()[hostport]
+	assert.Equal(t, map[string]int64{
+		"requests":            3,
+		"reused_requests":     2,
+		"reuse_ratio_percent": 66,
+		"open_connections":    1,
+	}, status)
+
+	proxyTransports.CloseIdleConnections()
+	assert.Equal(t, int64(0), GetProxyPoolStatus()[hostport]["open_connections"])
+}
@@ -71,6 +71,13 @@ func Status(req *http.Request, r render.Render) {
 		DisableCollectMetrics: DisableCollectMetrics,
 		NumGoroutine:          runtime.NumGoroutine(),
 		MetricBufferStatus:    collect.GetMetricDataBufferStatus(false),
+		MetricRetentionStatus: collect.GetMetricRetentionStatus(),
+		MetricTextfileStatus:  collect.GetMetricTextfileStatus(),
+		MetricTimestampStatus: collect.GetMetricTimestampStatus(),
+		MetricSinkStatus:      collect.GetMetricSinkStatus(),
+		ProxyPoolStatus:       GetProxyPoolStatus(),
+		ProxyBreakerStatus:    GetProxyBreakerStatus(),
+		TunnelStatus:          GetTunnelStatus(),
 		Callers:               callers,
 		LevelDBProperties:     leveldbProperties,
 	}
@@ -0,0 +1,348 @@
+package model
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+	"golang.org/x/net/http2"
+)
+
+var (
+	// TunnelTokens is token of each host id allowed to connect reverse-connect tunnel to this bastion(when empty, tunnel is not accepted)
+	TunnelTokens = map[string]string{}
+	// TunnelReconnectSeconds is seconds to wait before reconnecting tunnel to bastion
+	TunnelReconnectSeconds int64 = halib.DefaultTunnelReconnectSeconds
+
+	proxyTunnels = &tunnels{hosts: map[string]*tunnel{}}
+)
+
+// tunnels is reverse-connect tunnels from agents, registered by host id
+type tunnels struct {
+	mu    sync.Mutex
+	hosts map[string]*tunnel
+}
+
+// tunnel is connection from agent. bastion speaks HTTP/2 as client on it
+type tunnel struct {
+	conn        net.Conn
+	token       string
+	client      *http2.ClientConn
+	connectedAt time.Time
+	requests    int64
+}
+
+func (t *tunnel) roundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&t.requests, 1)
+	return t.client.RoundTrip(req)
+}
+
+// register registers tunnel of hostID. previous tunnel of hostID is closed.
+// returns error when live tunnel of hostID has been registered by other token
+func (t *tunnels) register(hostID string, tun *tunnel) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if prev, ok := t.hosts[hostID]; ok {
+		if prev.client.CanTakeNewRequest() && subtle.ConstantTimeCompare([]byte(prev.token), []byte(tun.token)) != 1 {
+			return fmt.Errorf("tunnel of %s is already connected by other token", hostID)
+		}
+		prev.conn.Close()
+	}
+	t.hosts[hostID] = tun
+	return nil
+}
+
+// conflicts returns true when live tunnel of hostID has been registered by other token
+func (t *tunnels) conflicts(hostID, token string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	prev, ok := t.hosts[hostID]
+	return ok && prev.client.CanTakeNewRequest() && subtle.ConstantTimeCompare([]byte(prev.token), []byte(token)) != 1
+}
+
+// get returns tunnel of hostID. returns nil when not registered or closed
+func (t *tunnels) get(hostID string) *tunnel {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tun, ok := t.hosts[hostID]
+	if !ok {
+		return nil
+	}
+	if !tun.client.CanTakeNewRequest() {
+		tun.conn.Close()
+		delete(t.hosts, hostID)
+		return nil
+	}
+	return tun
+}
+
+type tunnelHostIDKey struct{}
+
+// tunnelHostID returns host id of next hop routed over tunnel(`tunnel:<host id>`)
+func tunnelHostID(host string) (string, bool) {
+	if !strings.HasPrefix(host, halib.TunnelHopPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(host, halib.TunnelHopPrefix), true
+}
+
+// withTunnelHostID marks request of ctx to be sent over tunnel of hostID
+func withTunnelHostID(ctx context.Context, hostID string) context.Context {
+	return context.WithValue(ctx, tunnelHostIDKey{}, hostID)
+}
+
+// validateTunnelHostID returns error when hostID can not be used as host id of tunnel.
+// IP address is rejected, so that tunnel is never mistaken for real host
+func validateTunnelHostID(hostID string) error {
+	if hostID == "" || strings.ContainsAny(hostID, ":/ ,=") || net.ParseIP(hostID) != nil {
+		return fmt.Errorf("invalid host id: %q", hostID)
+	}
+	return nil
+}
+
+// ParseTunnelTokens parses comma separated `<host id>=<token>`
+func ParseTunnelTokens(value string) (map[string]string, error) {
+	tokens := map[string]string{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[1]) == "" {
+			return nil, fmt.Errorf("invalid tunnel token: %s", strings.TrimSpace(kv[0]))
+		}
+		hostID := strings.TrimSpace(kv[0])
+		if err := validateTunnelHostID(hostID); err != nil {
+			return nil, err
+		}
+		tokens[hostID] = strings.TrimSpace(kv[1])
+	}
+	return tokens, nil
+}
+
+// bufferedConn is net.Conn which reads bytes buffered while upgrade first
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// tlsBufferedConn is bufferedConn of *tls.Conn. http2.Server uses its ConnectionState
+type tlsBufferedConn struct {
+	*tls.Conn
+	r *bufio.Reader
+}
+
+func (c *tlsBufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Tunnel implements /tunnel endpoint. accepts reverse-connect tunnel from agent and registers it by host id
+func Tunnel(w http.ResponseWriter, req *http.Request) {
+	log := util.HappoAgentLogger()
+
+	if len(TunnelTokens) == 0 {
+		http.Error(w, "tunnel is disabled", http.StatusNotFound)
+		return
+	}
+	hostID := req.Header.Get(halib.TunnelHostIDHeader)
+	if err := validateTunnelHostID(hostID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	token := req.Header.Get(halib.TunnelTokenHeader)
+	expected, ok := TunnelTokens[hostID]
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		http.Error(w, "invalid tunnel token", http.StatusForbidden)
+		return
+	}
+	if proxyTunnels.conflicts(hostID, token) {
+		http.Error(w, fmt.Sprintf("tunnel of %s is already connected by other token", hostID), http.StatusConflict)
+		return
+	}
+	if !strings.EqualFold(req.Header.Get("Upgrade"), halib.TunnelProtocol) {
+		http.Error(w, fmt.Sprintf("Upgrade: %s required", halib.TunnelProtocol), http.StatusBadRequest)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "tunnel is not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.Error(fmt.Sprintf("failed to hijack tunnel of %s: %s", hostID, err.Error()))
+		return
+	}
+	// clear read/write timeout of server. tunnel is kept until agent disconnects
+	conn.SetDeadline(time.Time{})
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", halib.TunnelProtocol)
+	if err := rw.Flush(); err != nil {
+		log.Error(fmt.Sprintf("failed to upgrade tunnel of %s: %s", hostID, err.Error()))
+		conn.Close()
+		return
+	}
+
+	client, err := (&http2.Transport{}).NewClientConn(&bufferedConn{Conn: conn, r: rw.Reader})
+	if err != nil {
+		log.Error(fmt.Sprintf("failed to start tunnel of %s: %s", hostID, err.Error()))
+		conn.Close()
+		return
+	}
+	if err := proxyTunnels.register(hostID, &tunnel{conn: conn, token: token, client: client, connectedAt: time.Now()}); err != nil {
+		log.Error(err.Error())
+		conn.Close()
+		return
+	}
+	log.Info(fmt.Sprintf("tunnel connected: %s from %s", hostID, req.RemoteAddr))
+}
+
+// NewTunnelTLSConfig returns TLS config verifying bastion by CA certificates of caFile(PEM) and/or SHA-256 fingerprint(hex) of bastion certificate.
+// either is required, because tunnel sends token and serves requests of bastion
+func NewTunnelTLSConfig(caFile, certSHA256 string) (*tls.Config, error) {
+	if caFile == "" && certSHA256 == "" {
+		return nil, fmt.Errorf("CA file or certificate SHA-256 of bastion is required for tunnel")
+	}
+	config := &tls.Config{}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+		config.RootCAs = pool
+	} else {
+		// pinned certificate is verified instead of chain
+		config.InsecureSkipVerify = true
+	}
+	if certSHA256 != "" {
+		pinned, err := hex.DecodeString(strings.Replace(strings.TrimSpace(certSHA256), ":", "", -1))
+		if err != nil || len(pinned) != sha256.Size {
+			return nil, fmt.Errorf("invalid certificate SHA-256: %s", certSHA256)
+		}
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("no certificate of bastion")
+			}
+			fingerprint := sha256.Sum256(rawCerts[0])
+			if subtle.ConstantTimeCompare(fingerprint[:], pinned) != 1 {
+				return fmt.Errorf("certificate of bastion does not match SHA-256 %x", pinned)
+			}
+			return nil
+		}
+	}
+	return config, nil
+}
+
+// ServeTunnel keeps reverse-connect tunnel to bastion endpoint(e.g. https://192.0.2.1:6777) and serves requests via tunnel by handler.
+// token is token of hostID at bastion, and bastion is verified by tlsConfig(see NewTunnelTLSConfig).
+// reconnects after TunnelReconnectSeconds when disconnected. never returns
+func ServeTunnel(endpoint, hostID, token string, tlsConfig *tls.Config, handler http.Handler) {
+	log := util.HappoAgentLogger()
+	for {
+		err := serveTunnel(endpoint, hostID, token, tlsConfig, handler)
+		log.Warn(fmt.Sprintf("tunnel to %s disconnected: %s", endpoint, err.Error()))
+		time.Sleep(time.Duration(TunnelReconnectSeconds) * time.Second)
+	}
+}
+
+// serveTunnel connects to bastion, upgrades connection and serves HTTP/2 on it until disconnected
+func serveTunnel(endpoint, hostID, token string, tlsConfig *tls.Config, handler http.Handler) error {
+	log := util.HappoAgentLogger()
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = fmt.Sprintf("%s:%d", u.Host, halib.DefaultAgentPort)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	rawConn, err := util.OutboundDialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	config := tlsConfig.Clone()
+	config.NextProtos = []string{"http/1.1"}
+	if config.ServerName == "" {
+		config.ServerName = u.Hostname()
+	}
+	conn := tls.Client(rawConn, config)
+	defer conn.Close()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://%s/tunnel", addr), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", halib.TunnelProtocol)
+	req.Header.Set(halib.TunnelHostIDHeader, hostID)
+	req.Header.Set(halib.TunnelTokenHeader, token)
+
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return fmt.Errorf("failed to upgrade: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	conn.SetDeadline(time.Time{})
+
+	log.Info(fmt.Sprintf("tunnel connected to %s as %s", endpoint, hostID))
+	(&http2.Server{}).ServeConn(&tlsBufferedConn{Conn: conn, r: br}, &http2.ServeConnOpts{Handler: handler})
+	return fmt.Errorf("connection closed")
+}
+
+// GetTunnelStatus returns reverse-connect tunnels registered by host id
+func GetTunnelStatus() map[string]map[string]int64 {
+	proxyTunnels.mu.Lock()
+	defer proxyTunnels.mu.Unlock()
+
+	status := map[string]map[string]int64{}
+	for hostID, tun := range proxyTunnels.hosts {
+		status[hostID] = map[string]int64{
+			"connected_at": tun.connectedAt.Unix(),
+			"requests":     atomic.LoadInt64(&tun.requests),
+		}
+	}
+	return status
+}
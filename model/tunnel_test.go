@@ -0,0 +1,220 @@
+package model
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/martini-contrib/render"
+	"github.com/go-martini/martini"
+	"github.com/heartbeatsjp/happo-agent/autoscaling"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+)
+
+func newTunnelBastion() *httptest.Server {
+	m := martini.Classic()
+	m.Use(render.Renderer())
+	m.Get("/tunnel", Tunnel)
+	return httptest.NewTLSServer(m)
+}
+
+// pinnedTunnelTLSConfig returns TLS config pinning certificate of bastion
+func pinnedTunnelTLSConfig(t *testing.T, bastion *httptest.Server) *tls.Config {
+	fingerprint := sha256.Sum256(bastion.Certificate().Raw)
+	config, err := NewTunnelTLSConfig("", hex.EncodeToString(fingerprint[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestTunnel1(t *testing.T) {
+	// proxy to agent via tunnel
+	origTokens := TunnelTokens
+	TunnelTokens = map[string]string{"nat-host": "secret"}
+	defer func() { TunnelTokens = origTokens }()
+
+	bastion := newTunnelBastion()
+	defer bastion.Close()
+
+	//agent behind NAT
+	agent := http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/monitor", r.URL.Path)
+			assert.NotNil(t, r.TLS)
+			fmt.Fprint(w, `{"return_value":0,"message":"ok via tunnel"}`)
+		})
+	go serveTunnel(bastion.URL, "nat-host", "secret", pinnedTunnelTLSConfig(t, bastion), agent)
+
+	var tun *tunnel
+	for i := 0; i < 50 && tun == nil; i++ {
+		time.Sleep(100 * time.Millisecond)
+		tun = proxyTunnels.get("nat-host")
+	}
+	if !assert.NotNil(t, tun) {
+		return
+	}
+	defer func() {
+		proxyTunnels.mu.Lock()
+		delete(proxyTunnels.hosts, "nat-host")
+		proxyTunnels.mu.Unlock()
+		tun.conn.Close()
+	}()
+	assert.Contains(t, GetTunnelStatus(), "nat-host")
+
+	proxyRequest := halib.ProxyRequest{
+		ProxyHostPort: []string{"tunnel:nat-host"},
+		RequestType:   "monitor",
+		RequestJSON:   []byte("{}"),
+	}
+	statusCode, response, _ := proxy(context.Background(), proxyRequest, &autoscaling.AWSClient{})
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, `{"return_value":0,"message":"ok via tunnel"}`, response)
+	assert.Equal(t, int64(1), GetTunnelStatus()["nat-host"]["requests"])
+}
+
+func TestTunnel2(t *testing.T) {
+	// invalid token
+	origTokens := TunnelTokens
+	TunnelTokens = map[string]string{"nat-host": "secret"}
+	defer func() { TunnelTokens = origTokens }()
+
+	bastion := newTunnelBastion()
+	defer bastion.Close()
+
+	err := serveTunnel(bastion.URL, "nat-host", "wrong", pinnedTunnelTLSConfig(t, bastion), http.NotFoundHandler())
+	assert.EqualError(t, err, "failed to upgrade: 403 Forbidden: invalid tunnel token")
+}
+
+func TestTunnel3(t *testing.T) {
+	// host id is bound to token. IP address can not be host id
+	origTokens := TunnelTokens
+	TunnelTokens = map[string]string{"nat-host": "secret", "other-host": "other"}
+	defer func() { TunnelTokens = origTokens }()
+
+	bastion := newTunnelBastion()
+	defer bastion.Close()
+
+	err := serveTunnel(bastion.URL, "nat-host", "other", pinnedTunnelTLSConfig(t, bastion), http.NotFoundHandler())
+	assert.EqualError(t, err, "failed to upgrade: 403 Forbidden: invalid tunnel token")
+	err = serveTunnel(bastion.URL, "unknown-host", "secret", pinnedTunnelTLSConfig(t, bastion), http.NotFoundHandler())
+	assert.EqualError(t, err, "failed to upgrade: 403 Forbidden: invalid tunnel token")
+	err = serveTunnel(bastion.URL, "10.0.0.5", "secret", pinnedTunnelTLSConfig(t, bastion), http.NotFoundHandler())
+	assert.EqualError(t, err, `failed to upgrade: 400 Bad Request: invalid host id: "10.0.0.5"`)
+}
+
+func TestTunnel4(t *testing.T) {
+	// only hop marked as tunnel is routed over tunnel
+	proxyRequest := halib.ProxyRequest{
+		ProxyHostPort: []string{"tunnel:not-connected"},
+		RequestType:   "monitor",
+		RequestJSON:   []byte("{}"),
+	}
+	statusCode, response, _ := proxy(context.Background(), proxyRequest, &autoscaling.AWSClient{})
+	assert.Equal(t, http.StatusInternalServerError, statusCode)
+	assert.Contains(t, response, "tunnel of not-connected is not connected")
+}
+
+func TestTunnelsRegister1(t *testing.T) {
+	// live tunnel is not replaced by other token
+	tunnels := &tunnels{hosts: map[string]*tunnel{}}
+	conn, agentConn := net.Pipe()
+	defer conn.Close()
+	go io.Copy(ioutil.Discard, agentConn)
+	client, err := (&http2.Transport{}).NewClientConn(conn)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, tunnels.register("nat-host", &tunnel{conn: conn, token: "secret", client: client}))
+
+	assert.True(t, tunnels.conflicts("nat-host", "other"))
+	assert.False(t, tunnels.conflicts("nat-host", "secret"))
+	assert.EqualError(t, tunnels.register("nat-host", &tunnel{conn: conn, token: "other", client: client}), "tunnel of nat-host is already connected by other token")
+}
+
+func TestParseTunnelTokens1(t *testing.T) {
+	tokens, err := ParseTunnelTokens("web01=secret1, web02=secret2")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"web01": "secret1", "web02": "secret2"}, tokens)
+
+	_, err = ParseTunnelTokens("web01")
+	assert.EqualError(t, err, "invalid tunnel token: web01")
+	_, err = ParseTunnelTokens("192.0.2.1=secret")
+	assert.EqualError(t, err, `invalid host id: "192.0.2.1"`)
+}
+
+func TestTunnel5(t *testing.T) {
+	// bastion not matching pinned certificate is not connected
+	origTokens := TunnelTokens
+	TunnelTokens = map[string]string{"nat-host": "secret"}
+	defer func() { TunnelTokens = origTokens }()
+
+	bastion := newTunnelBastion()
+	defer bastion.Close()
+
+	config, err := NewTunnelTLSConfig("", strings.Repeat("00", sha256.Size))
+	if !assert.Nil(t, err) {
+		return
+	}
+	err = serveTunnel(bastion.URL, "nat-host", "secret", config, http.NotFoundHandler())
+	assert.Contains(t, err.Error(), "certificate of bastion does not match SHA-256")
+	assert.Nil(t, proxyTunnels.get("nat-host"))
+}
+
+func TestTunnel6(t *testing.T) {
+	// bastion verified by CA file
+	origTokens := TunnelTokens
+	TunnelTokens = map[string]string{"ca-host": "secret"}
+	defer func() { TunnelTokens = origTokens }()
+
+	bastion := newTunnelBastion()
+	defer bastion.Close()
+
+	f, err := ioutil.TempFile("", "happo-agent-tunnel-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: bastion.Certificate().Raw})
+	f.Close()
+
+	config, err := NewTunnelTLSConfig(f.Name(), "")
+	if !assert.Nil(t, err) {
+		return
+	}
+	go serveTunnel(bastion.URL, "ca-host", "secret", config, http.NotFoundHandler())
+
+	var tun *tunnel
+	for i := 0; i < 50 && tun == nil; i++ {
+		time.Sleep(100 * time.Millisecond)
+		tun = proxyTunnels.get("ca-host")
+	}
+	if !assert.NotNil(t, tun) {
+		return
+	}
+	proxyTunnels.mu.Lock()
+	delete(proxyTunnels.hosts, "ca-host")
+	proxyTunnels.mu.Unlock()
+	tun.conn.Close()
+}
+
+func TestNewTunnelTLSConfig1(t *testing.T) {
+	_, err := NewTunnelTLSConfig("", "")
+	assert.EqualError(t, err, "CA file or certificate SHA-256 of bastion is required for tunnel")
+	_, err = NewTunnelTLSConfig("", "zz")
+	assert.EqualError(t, err, "invalid certificate SHA-256: zz")
+}
@@ -0,0 +1,62 @@
+package sink
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+)
+
+// graphiteSink sends metrics in Graphite plaintext protocol over TCP
+type graphiteSink struct {
+	config halib.MetricSinkConfigData
+}
+
+// Send implements Sink
+func (s *graphiteSink) Send(metricsData []halib.MetricsData) error {
+	timeout := time.Duration(s.config.TimeoutSeconds) * time.Second
+	conn, err := net.DialTimeout("tcp", s.config.Address, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	w := bufio.NewWriter(conn)
+	for _, m := range metricsData {
+		for _, key := range sortedKeys(m.Metrics) {
+			fmt.Fprintf(w, "%s %s %d\n",
+				s.path(m.HostName, key),
+				strconv.FormatFloat(m.Metrics[key], 'f', -1, 64),
+				m.Timestamp)
+		}
+	}
+	return w.Flush()
+}
+
+// path returns `<prefix>.<hostname>.<key>`. dots in hostname are replaced to `_`
+func (s *graphiteSink) path(hostname, key string) string {
+	var items []string
+	if s.config.Prefix != "" {
+		items = append(items, s.config.Prefix)
+	}
+	if hostname != "" {
+		items = append(items, strings.Replace(hostname, ".", "_", -1))
+	}
+	items = append(items, key)
+	return strings.Join(items, ".")
+}
+
+func sortedKeys(metrics map[string]float64) []string {
+	keys := make([]string, 0, len(metrics))
+	for key := range metrics {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
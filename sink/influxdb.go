@@ -0,0 +1,46 @@
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+)
+
+// influxDBSink sends metrics in InfluxDB line protocol over HTTP
+type influxDBSink struct {
+	config halib.MetricSinkConfigData
+	client *http.Client
+}
+
+var influxDBEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+
+// Send implements Sink
+func (s *influxDBSink) Send(metricsData []halib.MetricsData) error {
+	uri, err := url.Parse(s.config.URL)
+	if err != nil {
+		return err
+	}
+	query := uri.Query()
+	if query.Get("precision") == "" {
+		query.Set("precision", "s")
+	}
+	uri.RawQuery = query.Encode()
+
+	var b bytes.Buffer
+	for _, m := range metricsData {
+		for _, key := range sortedKeys(m.Metrics) {
+			fmt.Fprintf(&b, "%s,host=%s value=%s %d\n",
+				influxDBEscaper.Replace(s.config.Prefix+key),
+				influxDBEscaper.Replace(m.HostName),
+				strconv.FormatFloat(m.Metrics[key], 'f', -1, 64),
+				m.Timestamp)
+		}
+	}
+
+	return postToSink(s.client, uri.String(), "text/plain; charset=utf-8", s.config.Headers, b.Bytes())
+}
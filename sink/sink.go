@@ -0,0 +1,235 @@
+package sink
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/collect"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Sink is destination of push-mode metric forwarding
+type Sink interface {
+	Send(metricsData []halib.MetricsData) error
+}
+
+// Runner forwards buffered metrics to Sink.
+// each Runner has own cursor over `m-` keys, so it does not interfere with /metric
+type Runner struct {
+	Config halib.MetricSinkConfigData
+	Sink   Sink
+}
+
+// --- Function
+
+// GetMetricSinkConfig returns metric sink config file
+func GetMetricSinkConfig(configFile string) (halib.MetricSinkConfig, error) {
+	var metricSinkConfig halib.MetricSinkConfig
+
+	buf, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return metricSinkConfig, err
+	}
+	err = yaml.Unmarshal(buf, &metricSinkConfig)
+	if err != nil {
+		return metricSinkConfig, err
+	}
+
+	return metricSinkConfig, nil
+}
+
+// New returns Sink specified by config.Type
+func New(config halib.MetricSinkConfigData) (Sink, error) {
+	switch config.Type {
+	case "graphite":
+		if config.Address == "" {
+			return nil, fmt.Errorf("sink %s: address required", config.Name)
+		}
+		return &graphiteSink{config: config}, nil
+	case "influxdb":
+		if config.URL == "" {
+			return nil, fmt.Errorf("sink %s: url required", config.Name)
+		}
+		return &influxDBSink{config: config, client: newHTTPClient(config)}, nil
+	case "webhook":
+		if config.URL == "" {
+			return nil, fmt.Errorf("sink %s: url required", config.Name)
+		}
+		return &webhookSink{config: config, client: newHTTPClient(config)}, nil
+	default:
+		return nil, fmt.Errorf("sink %s: unsupported type: %s", config.Name, config.Type)
+	}
+}
+
+// NewRunner returns Runner. unspecified parameters are filled with default value
+func NewRunner(config halib.MetricSinkConfigData) (*Runner, error) {
+	if config.Name == "" {
+		return nil, errors.New("sink name required")
+	}
+	if config.IntervalSeconds <= 0 {
+		config.IntervalSeconds = halib.DefaultMetricSinkIntervalSeconds
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = halib.DefaultMetricSinkBatchSize
+	}
+	if config.TimeoutSeconds <= 0 {
+		config.TimeoutSeconds = halib.DefaultMetricSinkTimeoutSeconds
+	}
+	if config.MaxBackoffSeconds <= 0 {
+		config.MaxBackoffSeconds = halib.DefaultMetricSinkMaxBackoffSeconds
+	}
+
+	s, err := New(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Runner{Config: config, Sink: s}, nil
+}
+
+// Start starts Runner of each sinks in config file. if config file is not exist, do nothing
+func Start(configFile string) error {
+	log := util.HappoAgentLogger()
+
+	if _, err := os.Stat(configFile); os.IsNotExist(err) {
+		log.Info(err)
+		// forget cursors of sinks removed from config
+		return collect.RegisterSinkCursors(nil)
+	}
+
+	config, err := GetMetricSinkConfig(configFile)
+	if err != nil {
+		return err
+	}
+
+	var runners []*Runner
+	names := map[string]bool{}
+	for _, c := range config.Sinks {
+		if names[c.Name] {
+			return fmt.Errorf("duplicated sink name: %s", c.Name)
+		}
+		names[c.Name] = true
+
+		runner, err := NewRunner(c)
+		if err != nil {
+			return err
+		}
+		runners = append(runners, runner)
+	}
+
+	// buffered metrics are kept until all sinks have forwarded them
+	if err := collect.RegisterSinkCursors(sinkNames(runners)); err != nil {
+		return err
+	}
+
+	for _, runner := range runners {
+		log.Infof("start metric sink %s (type: %s)", runner.Config.Name, runner.Config.Type)
+		go runner.Run()
+	}
+	return nil
+}
+
+func sinkNames(runners []*Runner) []string {
+	var names []string
+	for _, runner := range runners {
+		names = append(names, runner.Config.Name)
+	}
+	return names
+}
+
+// Run forwards metrics every interval. when failed, retry with exponential backoff
+func (r *Runner) Run() {
+	log := util.HappoAgentLogger()
+
+	interval := time.Duration(r.Config.IntervalSeconds) * time.Second
+	maxBackoff := time.Duration(r.Config.MaxBackoffSeconds) * time.Second
+	wait := interval
+	for {
+		time.Sleep(wait)
+		if err := r.Flush(); err != nil {
+			wait = wait * 2
+			if wait > maxBackoff {
+				wait = maxBackoff
+			}
+			log.Errorf("sink %s: failed to send metrics, retry after %v: %s", r.Config.Name, wait, err.Error())
+			continue
+		}
+		wait = interval
+	}
+}
+
+// Flush forwards all metrics after cursor, by BatchSize keys.
+// cursor is advanced only when Sink.Send succeeded, and is rewound by collect.SaveMetrics when metrics are saved before cursor
+func (r *Runner) Flush() error {
+	for {
+		cursor, err := GetCursor(r.Config.Name)
+		if err != nil {
+			return err
+		}
+
+		metricsData, lastKey, err := collect.GetMetricsAfter(cursor, r.Config.BatchSize)
+		if err != nil {
+			return err
+		}
+		if lastKey == nil {
+			// caught up
+			return nil
+		}
+
+		if len(metricsData) > 0 {
+			if err := r.Sink.Send(metricsData); err != nil {
+				return err
+			}
+		}
+
+		if err := collect.AdvanceSinkCursor(r.Config.Name, cursor, lastKey); err != nil {
+			return err
+		}
+	}
+}
+
+// GetCursor returns last forwarded key of sink. returns nil if sink have never forwarded
+func GetCursor(name string) ([]byte, error) {
+	return collect.GetSinkCursor(name)
+}
+
+func newHTTPClient(config halib.MetricSinkConfigData) *http.Client {
+	return &http.Client{
+		Timeout: time.Duration(config.TimeoutSeconds) * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify},
+		},
+	}
+}
+
+func postToSink(client *http.Client, uri, contentType string, headers map[string]string, body []byte) error {
+	req, err := http.NewRequest("POST", uri, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returns status HTTP %d: %s", uri, resp.StatusCode, message)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
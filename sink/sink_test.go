@@ -0,0 +1,213 @@
+package sink
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/collect"
+	"github.com/heartbeatsjp/happo-agent/db"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+var testMetricsData1 = []halib.MetricsData{
+	{HostName: "host1", Timestamp: 1001, Metrics: map[string]float64{"val1": 111, "val2": 112}},
+}
+
+var testMetricsData2 = []halib.MetricsData{
+	{HostName: "host2", Timestamp: 1002, Metrics: map[string]float64{"val1": 211}},
+}
+
+func TestNew(t *testing.T) {
+	var cases = []struct {
+		name     string
+		input    halib.MetricSinkConfigData
+		isNormal bool
+	}{
+		{"graphite", halib.MetricSinkConfigData{Name: "g", Type: "graphite", Address: "127.0.0.1:2003"}, true},
+		{"graphite without address", halib.MetricSinkConfigData{Name: "g", Type: "graphite"}, false},
+		{"influxdb", halib.MetricSinkConfigData{Name: "i", Type: "influxdb", URL: "http://127.0.0.1:8086/write?db=happo"}, true},
+		{"webhook without url", halib.MetricSinkConfigData{Name: "w", Type: "webhook"}, false},
+		{"unsupported", halib.MetricSinkConfigData{Name: "x", Type: "xxx"}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s, err := New(c.input)
+			if c.isNormal {
+				assert.Nil(t, err)
+				assert.NotNil(t, s)
+			} else {
+				assert.NotNil(t, err)
+			}
+		})
+	}
+}
+
+func TestGetMetricSinkConfig(t *testing.T) {
+	config, err := GetMetricSinkConfig("./testdata/metric_sinks_test.yaml")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(config.Sinks))
+	assert.Equal(t, "graphite", config.Sinks[0].Type)
+	assert.Equal(t, "127.0.0.1:2003", config.Sinks[0].Address)
+	assert.Equal(t, "webhook", config.Sinks[1].Type)
+	assert.Equal(t, "secret", config.Sinks[1].Headers["X-Token"])
+
+	_, err = GetMetricSinkConfig("./testdata/missing.yaml")
+	assert.NotNil(t, err)
+}
+
+func TestRunnerFlush(t *testing.T) {
+	collect.GetCollectedMetrics() // cleanup
+
+	var received [][]halib.MetricsData
+	fail := false
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if fail {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				var request halib.MetricAppendRequest
+				body, _ := ioutil.ReadAll(r.Body)
+				json.Unmarshal(body, &request)
+				received = append(received, request.MetricData)
+			}))
+	defer ts.Close()
+
+	runner, err := NewRunner(halib.MetricSinkConfigData{Name: "test-flush", Type: "webhook", URL: ts.URL})
+	assert.Nil(t, err)
+	assert.Equal(t, halib.DefaultMetricSinkBatchSize, runner.Config.BatchSize)
+
+	assert.Nil(t, collect.SaveMetrics(time.Unix(1001, 0), testMetricsData1))
+	assert.Nil(t, runner.Flush())
+	assert.Equal(t, [][]halib.MetricsData{testMetricsData1}, received)
+
+	// nothing to send
+	assert.Nil(t, runner.Flush())
+	assert.Equal(t, 1, len(received))
+
+	// outage: cursor must not advance
+	assert.Nil(t, collect.SaveMetrics(time.Unix(1002, 0), testMetricsData2))
+	fail = true
+	assert.NotNil(t, runner.Flush())
+	cursor, err := GetCursor("test-flush")
+	assert.Nil(t, err)
+	assert.Equal(t, "m-1001", string(cursor))
+
+	// recovered
+	fail = false
+	assert.Nil(t, runner.Flush())
+	assert.Equal(t, [][]halib.MetricsData{testMetricsData1, testMetricsData2}, received)
+
+	// buffered metrics are still available for /metric
+	assert.Equal(t, append(testMetricsData1, testMetricsData2...), collect.GetCollectedMetrics())
+}
+
+func TestRunnerFlush2(t *testing.T) {
+	// metrics saved before cursor are forwarded
+	collect.GetCollectedMetrics() // cleanup
+
+	var received []halib.MetricsData
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				var request halib.MetricAppendRequest
+				body, _ := ioutil.ReadAll(r.Body)
+				json.Unmarshal(body, &request)
+				received = append(received, request.MetricData...)
+			}))
+	defer ts.Close()
+
+	runner, err := NewRunner(halib.MetricSinkConfigData{Name: "test-flush2", Type: "webhook", URL: ts.URL})
+	assert.Nil(t, err)
+
+	assert.Nil(t, collect.SaveMetrics(time.Unix(1002, 0), testMetricsData2))
+	assert.Nil(t, runner.Flush())
+	assert.Equal(t, testMetricsData2, received)
+
+	assert.Nil(t, collect.SaveMetrics(time.Unix(1002, 0), testMetricsData1))
+	assert.Nil(t, runner.Flush())
+	assert.Equal(t, append(testMetricsData2, append(testMetricsData1, testMetricsData2...)...), received)
+}
+
+func TestGraphiteSend(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	lines := make(chan string, 10)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	runner, err := NewRunner(halib.MetricSinkConfigData{Name: "g", Type: "graphite", Address: l.Addr().String(), Prefix: "happo"})
+	assert.Nil(t, err)
+	err = runner.Sink.Send([]halib.MetricsData{
+		{HostName: "web.example.com", Timestamp: 1001, Metrics: map[string]float64{"cpu.user": 1.5, "cpu.idle": 98}},
+	})
+	assert.Nil(t, err)
+
+	var got []string
+	for line := range lines {
+		got = append(got, line)
+	}
+	assert.Equal(t, []string{
+		"happo.web_example_com.cpu.idle 98 1001",
+		"happo.web_example_com.cpu.user 1.5 1001",
+	}, got)
+}
+
+func TestInfluxDBSend(t *testing.T) {
+	var body string
+	var query string
+	ts := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				b, _ := ioutil.ReadAll(r.Body)
+				body = string(b)
+				query = r.URL.RawQuery
+				w.WriteHeader(http.StatusNoContent)
+			}))
+	defer ts.Close()
+
+	runner, err := NewRunner(halib.MetricSinkConfigData{Name: "i", Type: "influxdb", URL: ts.URL + "/write?db=happo"})
+	assert.Nil(t, err)
+	err = runner.Sink.Send([]halib.MetricsData{
+		{HostName: "host 1", Timestamp: 1001, Metrics: map[string]float64{"disk,sda": 10}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "db=happo&precision=s", query)
+	assert.Equal(t, "disk\\,sda,host=host\\ 1 value=10 1001\n", body)
+}
+
+func TestMain(m *testing.M) {
+	//Mock
+	DB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		os.Exit(1)
+	}
+	db.DB = DB
+	os.Exit(m.Run())
+
+	db.DB.Close()
+}
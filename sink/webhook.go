@@ -0,0 +1,29 @@
+package sink
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+)
+
+// webhookSink posts metrics in JSON. payload is same as /metric/append,
+// so other happo-agent can receive it directly
+type webhookSink struct {
+	config halib.MetricSinkConfigData
+	client *http.Client
+}
+
+// Send implements Sink
+func (s *webhookSink) Send(metricsData []halib.MetricsData) error {
+	var request halib.MetricAppendRequest
+	request.APIKey = s.config.APIKey
+	request.MetricData = metricsData
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	return postToSink(s.client, s.config.URL, "application/json", s.config.Headers, data)
+}
@@ -0,0 +1,295 @@
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/collect"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+)
+
+// Config is config of StatsD listener
+type Config struct {
+	// Address is UDP address to listen(e.g. `:8125`. when empty, disable)
+	Address string
+	// Socket is unix datagram socket path to listen(when empty, disable)
+	Socket string
+	// Hostname is hostname of saved metrics(when empty, os.Hostname())
+	Hostname             string
+	FlushIntervalSeconds int64
+	// Percentiles is percentiles of timers(e.g. `90`, `99.9`)
+	Percentiles []float64
+}
+
+// Server aggregates StatsD metrics until Flush
+type Server struct {
+	Hostname    string
+	Percentiles []float64
+
+	mu          sync.Mutex
+	counters    map[string]float64
+	gauges      map[string]float64
+	timers      map[string][]float64
+	timerCounts map[string]float64
+	sets        map[string]map[string]bool
+	lastFlushAt time.Time
+}
+
+// NewServer returns Server
+func NewServer(hostname string, percentiles []float64, now time.Time) *Server {
+	return &Server{
+		Hostname:    hostname,
+		Percentiles: percentiles,
+		counters:    map[string]float64{},
+		gauges:      map[string]float64{},
+		timers:      map[string][]float64{},
+		timerCounts: map[string]float64{},
+		sets:        map[string]map[string]bool{},
+		lastFlushAt: now,
+	}
+}
+
+// ParsePercentiles parses comma separated percentiles(e.g. `90,99`)
+func ParsePercentiles(s string) ([]float64, error) {
+	var percentiles []float64
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		p, err := strconv.ParseFloat(item, 64)
+		if err != nil || p <= 0 || p > 100 {
+			return nil, fmt.Errorf("invalid percentile: %s", item)
+		}
+		percentiles = append(percentiles, p)
+	}
+	return percentiles, nil
+}
+
+// Start starts StatsD listeners and flush timer. when both of Address and Socket are empty, do nothing
+func Start(config Config) error {
+	log := util.HappoAgentLogger()
+
+	if config.Address == "" && config.Socket == "" {
+		return nil
+	}
+	if config.FlushIntervalSeconds <= 0 {
+		return fmt.Errorf("invalid flush interval: %d", config.FlushIntervalSeconds)
+	}
+	hostname := config.Hostname
+	if hostname == "" {
+		var err error
+		if hostname, err = os.Hostname(); err != nil {
+			return err
+		}
+	}
+
+	s := NewServer(hostname, config.Percentiles, time.Now())
+	if config.Address != "" {
+		conn, err := net.ListenPacket("udp", config.Address)
+		if err != nil {
+			return err
+		}
+		log.Infof("statsd: listen udp %s", conn.LocalAddr())
+		go s.Serve(conn)
+	}
+	if config.Socket != "" {
+		// remove socket file left by previous process
+		if fi, err := os.Stat(config.Socket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(config.Socket)
+		}
+		conn, err := net.ListenPacket("unixgram", config.Socket)
+		if err != nil {
+			return err
+		}
+		log.Infof("statsd: listen unixgram %s", config.Socket)
+		go s.Serve(conn)
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(config.FlushIntervalSeconds) * time.Second)
+		for now := range ticker.C {
+			metricsData := s.Flush(now)
+			if len(metricsData) == 0 {
+				continue
+			}
+			if err := collect.SaveMetrics(now, metricsData); err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Serve reads packets from conn until conn is closed
+func (s *Server) Serve(conn net.PacketConn) {
+	log := util.HappoAgentLogger()
+
+	buf := make([]byte, halib.StatsDMaxPacketBytes)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			log.Errorf("statsd: %s", err.Error())
+			return
+		}
+		s.Handle(buf[:n])
+	}
+}
+
+// Handle aggregates metrics in packet. one metric per line(`<name>:<value>|<type>[|@<sample rate>][|#<tags>]`)
+func (s *Server) Handle(packet []byte) {
+	log := util.HappoAgentLogger()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, line := range strings.Split(string(packet), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if err := s.handleLine(line); err != nil {
+			log.Debugf("statsd: %s: %s", err.Error(), line)
+		}
+	}
+}
+
+func (s *Server) handleLine(line string) error {
+	i := strings.Index(line, ":")
+	if i <= 0 {
+		return errors.New("invalid line")
+	}
+	name := line[:i]
+	fields := strings.Split(line[i+1:], "|")
+	if len(fields) < 2 {
+		return errors.New("invalid line")
+	}
+	rawValue, metricType := fields[0], fields[1]
+
+	sampleRate := float64(1)
+	for _, field := range fields[2:] {
+		if strings.HasPrefix(field, "@") {
+			rate, err := strconv.ParseFloat(field[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return errors.New("invalid sample rate")
+			}
+			sampleRate = rate
+		}
+	}
+
+	if metricType == "s" {
+		if s.sets[name] == nil {
+			s.sets[name] = map[string]bool{}
+		}
+		s.sets[name][rawValue] = true
+		return nil
+	}
+
+	value, err := strconv.ParseFloat(rawValue, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return errors.New("invalid value")
+	}
+
+	switch metricType {
+	case "c":
+		s.counters[name] += value / sampleRate
+	case "g":
+		// `+N` and `-N` are relative to current value
+		if strings.HasPrefix(rawValue, "+") || strings.HasPrefix(rawValue, "-") {
+			s.gauges[name] += value
+		} else {
+			s.gauges[name] = value
+		}
+	case "ms", "h":
+		s.timers[name] = append(s.timers[name], value)
+		s.timerCounts[name] += 1 / sampleRate
+	default:
+		return fmt.Errorf("unsupported type: %s", metricType)
+	}
+	return nil
+}
+
+// Flush returns metrics aggregated since last Flush, and resets counters, timers and sets.
+// gauges keep last value. keys are prefixed by type(`counters.`, `gauges.`, `timers.`, `sets.`), so that same name of other types does not collide
+func (s *Server) Flush(now time.Time) []halib.MetricsData {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	interval := now.Sub(s.lastFlushAt).Seconds()
+	s.lastFlushAt = now
+
+	metrics := map[string]float64{}
+	for name, value := range s.counters {
+		metrics["counters."+name+".count"] = value
+		if interval > 0 {
+			metrics["counters."+name+".rate"] = value / interval
+		}
+	}
+	for name, value := range s.gauges {
+		metrics["gauges."+name] = value
+	}
+	for name, values := range s.timers {
+		for key, value := range summarizeTimer(values, s.timerCounts[name], s.Percentiles) {
+			metrics["timers."+name+"."+key] = value
+		}
+	}
+	for name, set := range s.sets {
+		metrics["sets."+name+".count"] = float64(len(set))
+	}
+
+	s.counters = map[string]float64{}
+	s.timers = map[string][]float64{}
+	s.timerCounts = map[string]float64{}
+	s.sets = map[string]map[string]bool{}
+
+	if len(metrics) == 0 {
+		return nil
+	}
+	return []halib.MetricsData{
+		{
+			HostName:  s.Hostname,
+			Timestamp: now.Unix(),
+			Metrics:   metrics,
+		},
+	}
+}
+
+// summarizeTimer returns count, min, max, mean and upper_<percentile> of values.
+// count is number of values corrected by sample rate
+func summarizeTimer(values []float64, count float64, percentiles []float64) map[string]float64 {
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+
+	sum := float64(0)
+	for _, v := range sorted {
+		sum += v
+	}
+	summary := map[string]float64{
+		"count": count,
+		"min":   sorted[0],
+		"max":   sorted[len(sorted)-1],
+		"mean":  sum / float64(len(sorted)),
+	}
+	for _, p := range percentiles {
+		n := int(math.Ceil(p / 100 * float64(len(sorted))))
+		if n < 1 {
+			n = 1
+		}
+		key := "upper_" + strings.Replace(strconv.FormatFloat(p, 'f', -1, 64), ".", "_", -1)
+		summary[key] = sorted[n-1]
+	}
+	return summary
+}
@@ -0,0 +1,84 @@
+package statsd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleAndFlush(t *testing.T) {
+	start := time.Unix(1000, 0)
+	s := NewServer("statsd01", []float64{50, 99.9}, start)
+
+	s.Handle([]byte("requests:1|c\nrequests:1|c|@0.5\nqueue:10|g\nqueue:-3|g\n"))
+	s.Handle([]byte("latency:30|ms\nlatency:10|ms\nlatency:20|ms|@0.5|#env:prod\nusers:alice|s\nusers:bob|s\nusers:alice|s\n"))
+	// same name of other types
+	s.Handle([]byte("requests:5|g\nrequests:1|s\n"))
+	s.Handle([]byte("invalid\nbad:abc|c\nunknown:1|x\n"))
+
+	got := s.Flush(start.Add(10 * time.Second))
+	assert.Equal(t, 1, len(got))
+	assert.Equal(t, "statsd01", got[0].HostName)
+	assert.Equal(t, int64(1010), got[0].Timestamp)
+	assert.Equal(t, map[string]float64{
+		"counters.requests.count":   3,
+		"counters.requests.rate":    0.3,
+		"gauges.queue":              7,
+		"gauges.requests":           5,
+		"timers.latency.count":      4,
+		"timers.latency.min":        10,
+		"timers.latency.max":        30,
+		"timers.latency.mean":       20,
+		"timers.latency.upper_50":   20,
+		"timers.latency.upper_99_9": 30,
+		"sets.users.count":          2,
+		"sets.requests.count":       1,
+	}, got[0].Metrics)
+
+	// gauges keep last value
+	got = s.Flush(start.Add(20 * time.Second))
+	assert.Equal(t, map[string]float64{"gauges.queue": 7, "gauges.requests": 5}, got[0].Metrics)
+}
+
+func TestServe(t *testing.T) {
+	s := NewServer("statsd01", nil, time.Now())
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+	go s.Serve(conn)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	assert.Nil(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("hits:5|c"))
+	assert.Nil(t, err)
+
+	for i := 0; i < 50; i++ {
+		s.mu.Lock()
+		received := s.counters["hits"]
+		s.mu.Unlock()
+		if received > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	got := s.Flush(time.Now())
+	assert.Equal(t, float64(5), got[0].Metrics["counters.hits.count"])
+}
+
+func TestParsePercentiles(t *testing.T) {
+	got, err := ParsePercentiles("90, 99.9")
+	assert.Nil(t, err)
+	assert.Equal(t, []float64{90, 99.9}, got)
+
+	got, err = ParsePercentiles("")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(got))
+
+	_, err = ParsePercentiles("101")
+	assert.NotNil(t, err)
+	_, err = ParsePercentiles("abc")
+	assert.NotNil(t, err)
+}
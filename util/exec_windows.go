@@ -0,0 +1,11 @@
+package util
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup does nothing on windows
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup does nothing on windows
+func killProcessGroup(cmd *exec.Cmd) {}
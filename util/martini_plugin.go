@@ -1,11 +1,13 @@
 package util
 
 import (
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	stdlog "log"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -88,6 +90,46 @@ func MartiniCustomLogger() martini.Handler {
 	}
 }
 
+// Gzip compresses response by gzip when request accepts it (e.g. response to bastion)
+func Gzip() martini.Handler {
+	return func(res http.ResponseWriter, req *http.Request, c martini.Context) {
+		if !strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+			return
+		}
+
+		rw := res.(martini.ResponseWriter)
+		rw.Header().Set("Content-Encoding", "gzip")
+		rw.Header().Add("Vary", "Accept-Encoding")
+		rw.Before(func(martini.ResponseWriter) {
+			rw.Header().Del("Content-Length")
+		})
+		gz := gzip.NewWriter(rw)
+		defer gz.Close()
+		c.MapTo(&gzipResponseWriter{ResponseWriter: rw, gz: gz}, (*http.ResponseWriter)(nil))
+
+		c.Next()
+	}
+}
+
+// gzipResponseWriter is martini.ResponseWriter which writes body via gzip.Writer
+type gzipResponseWriter struct {
+	martini.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", http.DetectContentType(b))
+	}
+	return w.gz.Write(b)
+}
+
+// Flush flushes compressed data to client
+func (w *gzipResponseWriter) Flush() {
+	w.gz.Flush()
+	w.ResponseWriter.Flush()
+}
+
 // RequestStatusManager manages RequestStatus
 type RequestStatusManager struct {
 	RequestStatus []struct {
@@ -1,8 +1,10 @@
 package util
 
 import (
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -218,3 +220,34 @@ func TestRequestStatusManager(t *testing.T) {
 		`{"last1":[{"url":"/","counts":{"200":1}}],"last5":[{"url":"/","counts":{"200":2}}]}`,
 		string(j))
 }
+
+func TestGzip1(t *testing.T) {
+	const bodyStr = "success success success success"
+
+	m := martini.Classic()
+	m.Use(Gzip())
+	m.Get(("/test"), func() string {
+		return bodyStr
+	})
+
+	// accepts gzip
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/test", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	m.ServeHTTP(res, req)
+	assert.EqualValues(t, http.StatusOK, res.Code)
+	assert.Equal(t, "gzip", res.Header().Get("Content-Encoding"))
+	assert.Equal(t, "", res.Header().Get("Content-Length"))
+	gz, err := gzip.NewReader(res.Body)
+	if assert.Nil(t, err) {
+		body, _ := ioutil.ReadAll(gz)
+		assert.Equal(t, bodyStr, string(body))
+	}
+
+	// not accepts gzip
+	res = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/test", nil)
+	m.ServeHTTP(res, req)
+	assert.Equal(t, "", res.Header().Get("Content-Encoding"))
+	assert.Equal(t, bodyStr, res.Body.String())
+}
@@ -0,0 +1,280 @@
+package util
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// outboundProxyRule is destination pattern and proxy used for it(nil means direct)
+type outboundProxyRule struct {
+	pattern  string
+	ipNet    *net.IPNet
+	proxyURL *url.URL
+}
+
+var (
+	outboundProxyMu    sync.RWMutex
+	outboundProxyRules []outboundProxyRule
+)
+
+// SetOutboundProxy configures proxy of outbound connections.
+// defaultProxy is proxy URL(http://[user:pass@]host:port or socks5://[user:pass@]host:port) used for all destinations,
+// rules is comma separated `<destination>=<proxy URL>` and noProxy is comma separated `<destination>` connected directly.
+// destination is CIDR, IP address, hostname, `.domain` (domain and its subdomains) or `*`.
+// noProxy is checked first, then rules in order, then defaultProxy
+func SetOutboundProxy(defaultProxy, rules, noProxy string) error {
+	var parsed []outboundProxyRule
+
+	for _, pattern := range splitOutboundProxyList(noProxy) {
+		rule, err := newOutboundProxyRule(pattern, "")
+		if err != nil {
+			return err
+		}
+		parsed = append(parsed, rule)
+	}
+	for _, entry := range splitOutboundProxyList(rules) {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return fmt.Errorf("invalid outbound proxy rule: %s", entry)
+		}
+		rule, err := newOutboundProxyRule(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+		if err != nil {
+			return err
+		}
+		parsed = append(parsed, rule)
+	}
+	if defaultProxy != "" {
+		rule, err := newOutboundProxyRule("*", defaultProxy)
+		if err != nil {
+			return err
+		}
+		parsed = append(parsed, rule)
+	}
+
+	outboundProxyMu.Lock()
+	defer outboundProxyMu.Unlock()
+	outboundProxyRules = parsed
+	return nil
+}
+
+func splitOutboundProxyList(list string) []string {
+	var entries []string
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func newOutboundProxyRule(pattern, rawProxyURL string) (outboundProxyRule, error) {
+	rule := outboundProxyRule{pattern: strings.ToLower(pattern)}
+	if strings.Contains(pattern, "/") {
+		_, ipNet, err := net.ParseCIDR(pattern)
+		if err != nil {
+			return rule, fmt.Errorf("invalid outbound proxy destination: %s", pattern)
+		}
+		rule.ipNet = ipNet
+	}
+	if rawProxyURL == "" {
+		return rule, nil
+	}
+	proxyURL, err := url.Parse(rawProxyURL)
+	if err != nil {
+		return rule, fmt.Errorf("invalid outbound proxy: %s", rawProxyURL)
+	}
+	if (proxyURL.Scheme != "http" && proxyURL.Scheme != "socks5") || proxyURL.Host == "" {
+		return rule, fmt.Errorf("invalid outbound proxy(http or socks5 required): %s", rawProxyURL)
+	}
+	rule.proxyURL = proxyURL
+	return rule, nil
+}
+
+func (r outboundProxyRule) match(host string) bool {
+	host = strings.ToLower(host)
+	switch {
+	case r.pattern == "*":
+		return true
+	case r.ipNet != nil:
+		ip := net.ParseIP(host)
+		return ip != nil && r.ipNet.Contains(ip)
+	case strings.HasPrefix(r.pattern, "."):
+		return strings.HasSuffix(host, r.pattern) || host == r.pattern[1:]
+	default:
+		return host == r.pattern
+	}
+}
+
+// outboundProxyConfigured returns true if any of outbound proxy, rules or no proxy is configured
+func outboundProxyConfigured() bool {
+	outboundProxyMu.RLock()
+	defer outboundProxyMu.RUnlock()
+	return len(outboundProxyRules) > 0
+}
+
+// OutboundProxyFor returns proxy URL used for connection to addr(host:port). returns nil when connected directly
+func OutboundProxyFor(addr string) *url.URL {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	outboundProxyMu.RLock()
+	defer outboundProxyMu.RUnlock()
+	for _, rule := range outboundProxyRules {
+		if rule.match(host) {
+			return rule.proxyURL
+		}
+	}
+	return nil
+}
+
+// OutboundDialContext connects to addr directly or via outbound proxy configured by SetOutboundProxy
+func OutboundDialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	proxyURL := OutboundProxyFor(addr)
+	if proxyURL == nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	HappoAgentLogger().Debugf("connect to %s via %s://%s", addr, proxyURL.Scheme, proxyURL.Host)
+	switch proxyURL.Scheme {
+	case "socks5":
+		return dialSOCKS5(ctx, dialer, proxyURL, network, addr)
+	default:
+		return dialHTTPConnect(ctx, dialer, proxyURL, addr)
+	}
+}
+
+// dialSOCKS5 connects to addr via SOCKS5 proxyURL.
+// connection to proxy and handshake are canceled when ctx is done
+func dialSOCKS5(ctx context.Context, dialer *net.Dialer, proxyURL *url.URL, network, addr string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+	}
+	forward := &contextDialer{ctx: ctx, dialer: dialer, done: make(chan struct{})}
+	defer close(forward.done)
+
+	socks, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, forward)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := socks.Dial(network, addr)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// contextDialer is proxy.Dialer bound to ctx, because proxy.SOCKS5 dials without context.
+// connection is closed when ctx is done before done is closed
+type contextDialer struct {
+	ctx    context.Context
+	dialer *net.Dialer
+	done   chan struct{}
+}
+
+func (d *contextDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(d.ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := d.ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(d.dialer.Timeout))
+	}
+	go func() {
+		select {
+		case <-d.ctx.Done():
+			conn.Close()
+		case <-d.done:
+		}
+	}()
+	return conn, nil
+}
+
+// dialHTTPConnect connects to addr by HTTP CONNECT of proxyURL
+func dialHTTPConnect(ctx context.Context, dialer *net.Dialer, proxyURL *url.URL, addr string) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(dialer.Timeout))
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credential := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credential)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused CONNECT %s: %s", proxyURL.Host, addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	if br.Buffered() > 0 {
+		return &outboundProxyConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// outboundProxyConn is net.Conn which reads bytes buffered while CONNECT first
+type outboundProxyConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *outboundProxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// newOutboundTransport returns http.Transport which connects via outbound proxy
+func newOutboundTransport() *http.Transport {
+	return &http.Transport{
+		DialContext:     OutboundDialContext,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+}
@@ -0,0 +1,182 @@
+package util
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutboundProxyFor1(t *testing.T) {
+	defer SetOutboundProxy("", "", "")
+
+	err := SetOutboundProxy(
+		"http://proxy.example.com:3128",
+		"10.0.0.0/8=socks5://10.0.0.1:1080, .internal.example.com=http://10.0.0.2:3128",
+		"10.1.0.0/16,bastion.example.com",
+	)
+	assert.Nil(t, err)
+
+	var cases = []struct {
+		addr     string
+		expected string
+	}{
+		{"10.0.0.5:6777", "socks5://10.0.0.1:1080"},
+		{"10.1.0.5:6777", ""},
+		{"web01.internal.example.com:6777", "http://10.0.0.2:3128"},
+		{"internal.example.com:6777", "http://10.0.0.2:3128"},
+		{"BASTION.example.com:6777", ""},
+		{"192.0.2.1:6777", "http://proxy.example.com:3128"},
+	}
+	for _, c := range cases {
+		proxyURL := OutboundProxyFor(c.addr)
+		if c.expected == "" {
+			assert.Nil(t, proxyURL, c.addr)
+		} else if assert.NotNil(t, proxyURL, c.addr) {
+			assert.Equal(t, c.expected, proxyURL.String(), c.addr)
+		}
+	}
+
+	SetOutboundProxy("", "", "")
+	assert.Nil(t, OutboundProxyFor("192.0.2.1:6777"))
+}
+
+func TestSetOutboundProxy1(t *testing.T) {
+	defer SetOutboundProxy("", "", "")
+
+	assert.EqualError(t, SetOutboundProxy("ftp://proxy.example.com", "", ""), "invalid outbound proxy(http or socks5 required): ftp://proxy.example.com")
+	assert.EqualError(t, SetOutboundProxy("", "10.0.0.0/8", ""), "invalid outbound proxy rule: 10.0.0.0/8")
+	assert.EqualError(t, SetOutboundProxy("", "", "10.0.0.0/33"), "invalid outbound proxy destination: 10.0.0.0/33")
+}
+
+func TestOutboundDialContext1(t *testing.T) {
+	// HTTP CONNECT
+	defer SetOutboundProxy("", "", "")
+
+	ts := httptest.NewTLSServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "OK")
+			}))
+	defer ts.Close()
+	target := strings.TrimPrefix(ts.URL, "https://")
+
+	var connected string
+	proxyServer := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "CONNECT", r.Method)
+				assert.Equal(t, "Basic dXNlcjpwYXNz", r.Header.Get("Proxy-Authorization"))
+				connected = r.Host
+				upstream, err := net.Dial("tcp", r.Host)
+				if !assert.Nil(t, err) {
+					return
+				}
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+				conn.Close()
+			}))
+	defer proxyServer.Close()
+
+	assert.Nil(t, SetOutboundProxy("http://user:pass@"+strings.TrimPrefix(proxyServer.URL, "http://"), "", ""))
+	resp, err := RequestToCheckAvailableAPI(ts.URL)
+	if assert.Nil(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "OK", string(body))
+	}
+	assert.Equal(t, target, connected)
+}
+
+func TestOutboundDialContext2(t *testing.T) {
+	// SOCKS5
+	defer SetOutboundProxy("", "", "")
+
+	ts := httptest.NewTLSServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "OK")
+			}))
+	defer ts.Close()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer lis.Close()
+	connected := make(chan string, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// greeting: VER NMETHODS METHODS -> no authentication
+		buf := make([]byte, 262)
+		io.ReadFull(conn, buf[:2])
+		io.ReadFull(conn, buf[:buf[1]])
+		conn.Write([]byte{5, 0})
+		// request: VER CMD RSV ATYP(IPv4) ADDR PORT
+		io.ReadFull(conn, buf[:10])
+		addr := net.JoinHostPort(net.IP(buf[4:8]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(buf[8:10]))))
+		connected <- addr
+		upstream, err := net.Dial("tcp", addr)
+		if err != nil {
+			return
+		}
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		go io.Copy(upstream, conn)
+		io.Copy(conn, upstream)
+	}()
+
+	assert.Nil(t, SetOutboundProxy("", "127.0.0.0/8=socks5://"+lis.Addr().String(), ""))
+	resp, err := RequestToCheckAvailableAPI(ts.URL)
+	if assert.Nil(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "OK", string(body))
+	}
+	assert.Equal(t, strings.TrimPrefix(ts.URL, "https://"), <-connected)
+}
+
+func TestOutboundDialContext3(t *testing.T) {
+	// SOCKS5 proxy does not respond: canceled by ctx
+	defer SetOutboundProxy("", "", "")
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer lis.Close()
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	assert.Nil(t, SetOutboundProxy("socks5://"+lis.Addr().String(), "", ""))
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	_, err = OutboundDialContext(ctx, "tcp", "192.0.2.1:6777")
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
@@ -4,10 +4,10 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"runtime"
@@ -45,6 +45,12 @@ func init() {
 
 // ExecCommand execute command with specified timeout behavior
 func ExecCommand(command string, option string) (int, string, string, error) {
+	return ExecCommandContext(context.Background(), command, option)
+}
+
+// ExecCommandContext is ExecCommand which is killed when ctx is done.
+// timeout is shortened to deadline of ctx, and processes left by timed out or canceled command are killed with its process group
+func ExecCommandContext(ctx context.Context, command string, option string) (int, string, string, error) {
 	var timeBegin time.Time
 	var cswBegin int
 	if HappoAgentLoggerEnableInfo() {
@@ -58,9 +64,16 @@ func ExecCommand(command string, option string) (int, string, string, error) {
 	}
 
 	commandWithOptions := fmt.Sprintf("%s %s", command, option)
+	duration := commandTimeout * time.Second
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < duration {
+		duration = time.Until(deadline)
+	}
+	if ctx.Err() != nil || duration <= 0 {
+		return -1, "", "", &TimeoutError{"Exec canceled: " + commandWithOptions}
+	}
 	tio := &timeout.Timeout{
 		Cmd:       exec.Command("/bin/sh", "-c", commandWithOptions),
-		Duration:  commandTimeout * time.Second,
+		Duration:  duration,
 		KillAfter: halib.CommandKillAfterSeconds * time.Second,
 	}
 	if runtime.GOOS == "windows" {
@@ -68,15 +81,37 @@ func ExecCommand(command string, option string) (int, string, string, error) {
 		commandWithOptions += "; exit $LastExitCode"
 		tio = &timeout.Timeout{
 			Cmd:       exec.Command("powershell.exe", commandWithOptions),
-			Duration:  commandTimeout * time.Second,
+			Duration:  duration,
 			KillAfter: halib.CommandKillAfterSeconds * time.Second,
 		}
 	}
-	exitStatus, stdout, stderr, err := tio.Run()
+	setProcessGroup(tio.Cmd)
+	var outBuffer, errBuffer bytes.Buffer
+	tio.Cmd.Stdout = &outBuffer
+	tio.Cmd.Stderr = &errBuffer
 
-	if err == nil && exitStatus.IsTimedOut() {
-		err = &TimeoutError{"Exec timeout: " + commandWithOptions}
+	var exitStatus timeout.ExitStatus
+	ch, err := tio.RunCommand()
+	if err == nil {
+		select {
+		case exitStatus = <-ch:
+			if exitStatus.IsTimedOut() {
+				killProcessGroup(tio.Cmd)
+				err = &TimeoutError{"Exec timeout: " + commandWithOptions}
+			}
+		case <-ctx.Done():
+			// caller have gone or deadline is reached. kill command now, not to wait timeout
+			killProcessGroup(tio.Cmd)
+			tio.Cmd.Process.Kill()
+			exitStatus = <-ch
+			if ctx.Err() == context.DeadlineExceeded {
+				err = &TimeoutError{"Exec timeout: " + commandWithOptions}
+			} else {
+				err = &TimeoutError{"Exec canceled: " + commandWithOptions}
+			}
+		}
 	}
+	stdout, stderr := outBuffer.String(), errBuffer.String()
 
 	if HappoAgentLoggerEnableInfo() {
 		now := time.Now()
@@ -191,6 +226,29 @@ func BindManageParameter(c *cli.Context) (halib.ManageRequest, error) {
 	return manageRequest, nil
 }
 
+// manageAPITransport is transport of RequestToManageAPI, shared to reuse connections.
+// TLS is verified same as http.DefaultTransport
+var manageAPITransport = &http.Transport{
+	Proxy:                 manageAPIProxy,
+	DialContext:           OutboundDialContext,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
+// environmentProxy is proxy of manage API when outbound proxy is not configured
+var environmentProxy = http.ProxyFromEnvironment
+
+// manageAPIProxy returns proxy from environment(HTTPS_PROXY, NO_PROXY) as http.DefaultTransport,
+// only when outbound proxy is not configured by --outbound-proxy* flags
+func manageAPIProxy(req *http.Request) (*url.URL, error) {
+	if outboundProxyConfigured() {
+		return nil, nil
+	}
+	return environmentProxy(req)
+}
+
 // RequestToManageAPI send request to ManageAPI
 func RequestToManageAPI(endpoint string, path string, postdata []byte) (*http.Response, error) {
 	uri := fmt.Sprintf("%s%s", endpoint, path)
@@ -200,7 +258,7 @@ func RequestToManageAPI(endpoint string, path string, postdata []byte) (*http.Re
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	return http.DefaultTransport.RoundTrip(req)
+	return manageAPITransport.RoundTrip(req)
 }
 
 // RequestToMetricAppendAPI send request to MetricAppendPI
@@ -221,9 +279,27 @@ func buildMetricAppendAPIRequest(endpoint string, postdata []byte) (*http.Client
 	req.Header.Set("Content-Type", "application/json")
 
 	//FIXME other parameters should be proper values
-	client := &http.Client{Transport: &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}}
+	client := &http.Client{Transport: newOutboundTransport()}
+	return client, req, err
+}
+
+// RequestToMetricQueryAPI send request to MetricQueryAPI
+func RequestToMetricQueryAPI(endpoint string, query url.Values) (*http.Response, error) {
+	client, req, err := buildMetricQueryAPIRequest(endpoint, query)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req)
+}
+
+func buildMetricQueryAPIRequest(endpoint string, query url.Values) (*http.Client, *http.Request, error) {
+	uri := fmt.Sprintf("%s/metric/query?%s", endpoint, query.Encode())
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client := &http.Client{Transport: newOutboundTransport()}
 	return client, req, err
 }
 
@@ -235,9 +311,7 @@ func RequestToAutoScalingAPI(endpoint string) (*http.Response, error) {
 		return nil, err
 	}
 
-	client := &http.Client{Transport: &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}}
+	client := &http.Client{Transport: newOutboundTransport()}
 
 	return client.Do(req)
 }
@@ -255,9 +329,7 @@ func RequestToCheckAvailableAPI(endpoint string) (*http.Response, error) {
 
 	req = req.WithContext(ctx)
 
-	client := &http.Client{Transport: &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}}
+	client := &http.Client{Transport: newOutboundTransport()}
 
 	return client.Do(req)
 }
@@ -278,9 +350,7 @@ func buildAutoScalingResolveAPIRequest(endpoint string, alias string) (*http.Cli
 		return nil, nil, err
 	}
 
-	client := &http.Client{Transport: &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}}
+	client := &http.Client{Transport: newOutboundTransport()}
 	return client, req, err
 }
 
@@ -301,9 +371,7 @@ func buildAutoScalingRegisterInstanceAPIRequest(endpoint, requestType string, po
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{Transport: &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}}
+	client := &http.Client{Transport: newOutboundTransport()}
 	return client, req, err
 }
 
@@ -324,8 +392,6 @@ func buildAutoScalingLeaveAPIRequest(endpoint string, postdata []byte) (*http.Cl
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{Transport: &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}}
+	client := &http.Client{Transport: newOutboundTransport()}
 	return client, req, err
 }
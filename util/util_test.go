@@ -1,9 +1,16 @@
 package util
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/heartbeatsjp/happo-agent/halib"
 
@@ -104,6 +111,113 @@ func TestExecCommand4(t *testing.T) {
 	assert.False(t, ok)
 }
 
+func TestExecCommandContext1(t *testing.T) {
+	// killed at deadline of ctx
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	startAt := time.Now()
+	_, _, _, err := ExecCommandContext(ctx, "sleep", "10")
+	// sleep is killed within CommandKillAfterSeconds after deadline
+	assert.True(t, time.Since(startAt) < 6*time.Second)
+	_, ok := err.(*TimeoutError)
+	assert.True(t, ok)
+
+	// not executed after deadline
+	_, _, _, err = ExecCommandContext(ctx, "echo", "hoge")
+	assert.Contains(t, err.Error(), "Exec canceled: ")
+}
+
+func TestExecCommandContext2(t *testing.T) {
+	// processes started by command are killed at deadline of ctx
+	if runtime.GOOS == "windows" {
+		t.Skip("process group is not supported")
+	}
+	f, err := ioutil.TempFile("", "happo-agent-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, _, _, err = ExecCommandContext(ctx, "sleep 30 & echo $! >", f.Name()+"; wait")
+	_, ok := err.(*TimeoutError)
+	assert.True(t, ok)
+
+	pid, err := ioutil.ReadFile(f.Name())
+	if !assert.Nil(t, err) {
+		return
+	}
+	time.Sleep(100 * time.Millisecond)
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%s/stat", strings.TrimSpace(string(pid))))
+	if err == nil {
+		// zombie until reaped by init
+		assert.Contains(t, string(stat), ") Z ")
+	}
+}
+
+func TestExecCommandContext3(t *testing.T) {
+	// command and processes started by it are killed when ctx is canceled
+	if runtime.GOOS == "windows" {
+		t.Skip("process group is not supported")
+	}
+	f, err := ioutil.TempFile("", "happo-agent-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		cancel()
+	}()
+	startAt := time.Now()
+	_, _, _, err = ExecCommandContext(ctx, "sleep 30 & echo $! >", f.Name()+"; wait")
+	assert.True(t, time.Since(startAt) < 5*time.Second)
+	_, ok := err.(*TimeoutError)
+	assert.True(t, ok)
+	assert.Contains(t, err.Error(), "Exec canceled: ")
+
+	pid, err := ioutil.ReadFile(f.Name())
+	if !assert.Nil(t, err) {
+		return
+	}
+	time.Sleep(100 * time.Millisecond)
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%s/stat", strings.TrimSpace(string(pid))))
+	if err == nil {
+		// zombie until reaped by init
+		assert.Contains(t, string(stat), ") Z ")
+	}
+}
+
+func TestManageAPIProxy1(t *testing.T) {
+	defer func(f func(*http.Request) (*url.URL, error)) {
+		environmentProxy = f
+	}(environmentProxy)
+	environmentProxy = func(req *http.Request) (*url.URL, error) {
+		return url.Parse("http://env-proxy.example.com:3128")
+	}
+	req, _ := http.NewRequest("POST", "https://manage.example.com/manage/add", nil)
+
+	// proxy from environment when outbound proxy is not configured
+	proxyURL, err := manageAPIProxy(req)
+	assert.Nil(t, err)
+	if assert.NotNil(t, proxyURL) {
+		assert.Equal(t, "http://env-proxy.example.com:3128", proxyURL.String())
+	}
+
+	// outbound proxy is used instead
+	defer SetOutboundProxy("", "", "")
+	assert.Nil(t, SetOutboundProxy("", "", ".example.com"))
+	proxyURL, err = manageAPIProxy(req)
+	assert.Nil(t, err)
+	assert.Nil(t, proxyURL)
+}
+
 func TestBuildMetricAppendAPIRequest1(t *testing.T) {
 	client, req, err := buildMetricAppendAPIRequest("https://127.0.0.2:6777", []byte(
 		`{
@@ -131,3 +245,15 @@ func TestBuildMetricAppendAPIRequest1(t *testing.T) {
 	assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
 	assert.Nil(t, err)
 }
+
+func TestBuildMetricQueryAPIRequest1(t *testing.T) {
+	client, req, err := buildMetricQueryAPIRequest("https://127.0.0.2:6777", url.Values{"hostname": []string{"host1"}, "key": []string{"linux.cpu.*"}})
+	assert.True(t, (client.Transport.(*http.Transport)).TLSClientConfig.InsecureSkipVerify)
+	assert.Equal(t, "https", req.URL.Scheme)
+	assert.Equal(t, "127.0.0.2:6777", req.URL.Host)
+	assert.Equal(t, "/metric/query", req.URL.Path)
+	assert.Equal(t, "host1", req.URL.Query().Get("hostname"))
+	assert.Equal(t, "linux.cpu.*", req.URL.Query().Get("key"))
+	assert.Equal(t, "GET", req.Method)
+	assert.Nil(t, err)
+}